@@ -75,6 +75,9 @@ const (
 	// anrEvent is the string for matching application not responding events in the bug report.
 	anrEvent = "am_anr"
 
+	// crashEvent is the string for matching application crash events in the bug report.
+	crashEvent = "am_crash"
+
 	// lowMemoryEvent is the string for matching low memory events in the bug report.
 	lowMemoryEvent = "am_low_memory"
 
@@ -90,6 +93,10 @@ const (
 	// crashes is the the CSV description of Crash events.
 	crashes = "Crashes"
 
+	// crashMatchWindowMs is how far apart the system log and event log entries for the same crash may be.
+	// The am_crash entry is logged by the activity manager shortly after the FATAL EXCEPTION lines.
+	crashMatchWindowMs = 1000
+
 	// unknownTime is used when the start or end time of an event is unknown.
 	// This is not zero as csv.AddEntryWithOpt ignores events with a zero time.
 	unknownTime = -1
@@ -159,6 +166,34 @@ type parser struct {
 	// partialEvent stores the existing state of a partially parsed event.
 	// e.g. a crash event occurs over several lines and can't be outputted until all parts are found.
 	partialEvent csv.Entry
+
+	// seenCrashes are the crashes outputted so far. A crash is logged in both the system log and the
+	// event log, so these are used to only output it once.
+	seenCrashes []crashRecord
+}
+
+// crashRecord identifies an outputted crash.
+type crashRecord struct {
+	process string
+	ms      int64
+	// fromEventLog is true if the crash was outputted from an am_crash event log entry, or false if it
+	// was outputted from a FATAL EXCEPTION system log entry.
+	fromEventLog bool
+}
+
+// isDuplicateCrash returns whether a crash of the process was already outputted from the other log
+// within crashMatchWindowMs of the given time. Otherwise the crash is recorded as outputted.
+func (p *parser) isDuplicateCrash(process string, ms int64, fromEventLog bool) bool {
+	for _, c := range p.seenCrashes {
+		if c.process != process || c.fromEventLog == fromEventLog {
+			continue
+		}
+		if d := c.ms - ms; -crashMatchWindowMs <= d && d <= crashMatchWindowMs {
+			return true
+		}
+	}
+	p.seenCrashes = append(p.seenCrashes, crashRecord{process, ms, fromEventLog})
+	return false
 }
 
 // newParser creates a parser for the given bugreport.
@@ -442,6 +477,10 @@ func (p *parser) parseEvent(pkgs []*usagepb.PackageInfo, timestamp int64, event,
 			return "", nil
 		}
 		if m, result := historianutils.SubexpNames(crashProcessRE, details); m && p.partialEvent.Value != "" {
+			if p.isDuplicateCrash(result["process"], timestamp, false) {
+				p.partialEvent = csv.Entry{}
+				return "", nil
+			}
 			uid, err := procToUID(result["process"], pkgs)
 			p.csvState.PrintInstantEvent(csv.Entry{
 				Desc:  crashes,
@@ -522,6 +561,9 @@ func (p *parser) parseEvent(pkgs []*usagepb.PackageInfo, timestamp int64, event,
 	case anrEvent:
 		details = strings.Trim(details, "[]")
 		return p.parseANR(pkgs, timestamp, details)
+	case crashEvent:
+		details = strings.Trim(details, "[]")
+		return p.parseCrash(pkgs, timestamp, details)
 	case procStartEvent, procDiedEvent:
 		details = strings.Trim(details, "[]")
 		return p.parseProc(timestamp, details, event)
@@ -612,6 +654,29 @@ func (p *parser) parseANR(pkgs []*usagepb.PackageInfo, timestamp int64, v string
 	return warning, err
 }
 
+func (p *parser) parseCrash(pkgs []*usagepb.PackageInfo, timestamp int64, v string) (string, error) {
+	// Expected format of v is: User,PID,Process Name,Flags,Exception,Message,File,Line.
+	// The message may contain commas, so only the leading parts are checked.
+	parts := strings.Split(v, ",")
+	if len(parts) < 5 {
+		return "", fmt.Errorf("%s: got %d parts, want at least 5", crashEvent, len(parts))
+	}
+	if p.isDuplicateCrash(parts[2], timestamp, true) {
+		return "", nil
+	}
+
+	// Crash event should still be displayed even if uid could not be matched.
+	uid, err := procToUID(parts[2], pkgs)
+	p.csvState.PrintInstantEvent(csv.Entry{
+		Desc:  crashes,
+		Start: timestamp,
+		Type:  "service",
+		Value: fmt.Sprintf("%s: %s", parts[2], parts[4]),
+		Opt:   uid,
+	})
+	return "", err
+}
+
 func (p *parser) parseProc(timestamp int64, v string, t string) (string, error) {
 	switch t {
 	case procStartEvent:
@@ -203,6 +203,79 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "am_crash event",
+			input: []string{
+				`========================================================`,
+				`== dumpstate: 2015-09-27 21:04:31`,
+				`========================================================`,
+				`...`,
+				`------ EVENT LOG (logcat -b events -v threadtime -d *:v) ------`,
+				`09-27 20:44:59.609   808   822 I am_crash: [0,2103,com.google.android.apps.photos,948485700,java.lang.NullPointerException,Attempt to invoke virtual method, on a null object reference,PhotosActivity.java,112]`,
+				`09-27 20:47:08.686   808   822 I am_crash: [0,3503]`,
+				`...`,
+				`[persist.sys.timezone]: [America/Los_Angeles]`,
+			},
+			pkgs: []*usagepb.PackageInfo{
+				{PkgName: proto.String("com.google.android.apps.photos"), Uid: proto.Int32(1)},
+			},
+			wantLogsData: LogsData{
+				Logs: map[string]*Log{
+					EventLogSection: &Log{
+						CSV: strings.Join([]string{
+							csv.FileHeader,
+							`Crashes,service,1443411899609,1443411899609,com.google.android.apps.photos: java.lang.NullPointerException,1`,
+						}, "\n"),
+						StartMs: 1443411899609,
+					},
+				},
+				Errs: []error{
+					errors.New(`am_crash: got 2 parts, want at least 5`),
+				},
+			},
+		},
+		{
+			desc: "Crash in both the system log and the event log",
+			input: []string{
+				`========================================================`,
+				`== dumpstate: 2015-09-27 21:04:31`,
+				`========================================================`,
+				`...`,
+				`------ SYSTEM LOG (logcat -v threadtime -d *:v) ------`,
+				`09-27 20:44:59.520  2103  2103 E AndroidRuntime: FATAL EXCEPTION: main`,
+				`09-27 20:44:59.520  2103  2103 E AndroidRuntime: Process: com.google.android.apps.photos, PID: 2103`,
+				`09-27 20:44:59.520  2103  2103 E AndroidRuntime: java.lang.NullPointerException: Attempt to invoke virtual method`,
+				`...`,
+				`------ EVENT LOG (logcat -b events -v threadtime -d *:v) ------`,
+				`09-27 20:44:59.609   808   822 I am_crash: [0,2103,com.google.android.apps.photos,948485700,java.lang.NullPointerException,Attempt to invoke virtual method,PhotosActivity.java,112]`,
+				`09-27 20:47:08.686   808   822 I am_crash: [0,3503,com.google.android.gms,948485700,java.lang.IllegalStateException,Not allowed,GmsService.java,42]`,
+				`09-27 20:52:10.100   808   822 I am_crash: [0,4012,com.google.android.apps.photos,948485700,java.lang.NullPointerException,Attempt to invoke virtual method,PhotosActivity.java,112]`,
+				`...`,
+				`[persist.sys.timezone]: [America/Los_Angeles]`,
+			},
+			pkgs: []*usagepb.PackageInfo{
+				{PkgName: proto.String("com.google.android.apps.photos"), Uid: proto.Int32(1)},
+			},
+			wantLogsData: LogsData{
+				Logs: map[string]*Log{
+					SystemLogSection: &Log{
+						CSV: strings.Join([]string{
+							csv.FileHeader,
+							`Crashes,service,1443411899520,1443411899520,com.google.android.apps.photos: main,1`,
+						}, "\n"),
+						StartMs: 1443411899520,
+					},
+					EventLogSection: &Log{
+						CSV: strings.Join([]string{
+							csv.FileHeader,
+							`Crashes,service,1443412028686,1443412028686,com.google.android.gms: java.lang.IllegalStateException,`,
+							`Crashes,service,1443412330100,1443412330100,com.google.android.apps.photos: java.lang.NullPointerException,1`,
+						}, "\n"),
+						StartMs: 1443411899609,
+					},
+				},
+			},
+		},
 		{
 			desc: "Event log header appears twice",
 			input: []string{
@@ -17,13 +17,14 @@ package analyzer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -40,6 +41,7 @@ import (
 	"github.com/chenjiacun35/battery-historian/checkindelta"
 	"github.com/chenjiacun35/battery-historian/checkinparse"
 	"github.com/chenjiacun35/battery-historian/checkinutil"
+	"github.com/chenjiacun35/battery-historian/csv"
 	"github.com/chenjiacun35/battery-historian/dmesg"
 	"github.com/chenjiacun35/battery-historian/historianutils"
 	"github.com/chenjiacun35/battery-historian/kernel"
@@ -93,6 +95,9 @@ var (
 	// Initialized in SetResVersion()
 	resVersion int
 
+	// Initialized in SetParseTimeout()
+	parseTimeout time.Duration
+
 	// batteryRE is a regular expression that matches the time information for battery.
 	// e.g. 9,0,l,bt,0,86546081,70845214,99083316,83382448,1458155459650,83944766,68243903
 	batteryRE = regexp.MustCompile(`9,0,l,bt,(?P<batteryTime>.*)`)
@@ -134,6 +139,8 @@ type uploadResponse struct {
 	Location            string                   `json:"location"`
 	OverflowMs          int64                    `json:"overflowMs"`
 	IsDiff              bool                     `json:"isDiff"`
+	// Diagnostics identifies the lines that were skipped because they couldn't be parsed.
+	Diagnostics []*historianutils.ParseError `json:"diagnostics"`
 }
 
 type uploadResponseCompare struct {
@@ -151,6 +158,7 @@ type summariesData struct {
 	timeToDelta     map[string]string
 	errs            []error
 	overflowMs      int64
+	diagnostics     []*historianutils.ParseError
 }
 
 type checkinData struct {
@@ -181,6 +189,13 @@ type ParsedData struct {
 	kd          *csvData
 	md          *csvData
 	data        []presenter.HTMLData
+
+	// logger is used for all log lines while analyzing. The default logger is used if nil.
+	logger *slog.Logger
+
+	// maxEvents, if positive, is the number of events each battery history metric is downsampled to
+	// in the response, so very long timelines can be displayed.
+	maxEvents int
 }
 
 // BatteryStatsInfo holds the extracted batterystats details for a bugreport.
@@ -190,6 +205,14 @@ type BatteryStatsInfo struct {
 	Meta     *bugreportutils.MetaInfo
 }
 
+// log returns the logger to use while analyzing.
+func (pd *ParsedData) log() *slog.Logger {
+	if pd.logger == nil {
+		return slog.Default()
+	}
+	return pd.logger
+}
+
 // Cleanup removes all temporary files written by the ParsedData analyzer.
 // Should be called after ParsedData is no longer needed.
 func (pd *ParsedData) Cleanup() {
@@ -212,6 +235,7 @@ func (pd *ParsedData) SendAsJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	pd.downsampleHistory()
 
 	var buf bytes.Buffer
 	var merge presenter.MultiFileHTMLData
@@ -255,7 +279,7 @@ func (pd *ParsedData) SendAsJSON(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// Send ungzipped data.
-		log.Printf("failed to gzip data: %v", err)
+		Logger(r.Context()).Warn("failed to gzip data", "error", err)
 	}
 	w.Write(unzipped)
 }
@@ -318,6 +342,26 @@ func (pd *ParsedData) appendCSVs() error {
 	return nil
 }
 
+// downsampleHistory downsamples each metric of the battery history CSVs to at most maxEvents events.
+func (pd *ParsedData) downsampleHistory() {
+	if pd.maxEvents <= 0 {
+		return
+	}
+	for i := range pd.responseArr {
+		logs := pd.responseArr[i].HistorianV2Logs
+		for j := range logs {
+			if logs[j].Source != batteryHistory || logs[j].CSV == "" {
+				continue
+			}
+			var errs []error
+			logs[j].CSV, errs = csv.DownsampleCSV(logs[j].CSV, pd.maxEvents)
+			if len(errs) > 0 {
+				pd.log().Warn("dropped malformed battery history records while downsampling", "count", len(errs), "first", errs[0])
+			}
+		}
+	}
+}
+
 // parseKernelFile processes the kernel file and stores the result in the ParsedData.
 func (pd *ParsedData) parseKernelFile(fname, contents string) error {
 	// Try to parse the file as a kernel file.
@@ -417,8 +461,14 @@ func SetIsOptimized(optimized bool) {
 	isOptimizedJs = optimized
 }
 
+// SetParseTimeout sets the maximum time to spend parsing each upload. Uploads are parsed without a
+// deadline if d is not positive.
+func SetParseTimeout(d time.Duration) {
+	parseTimeout = d
+}
+
 // closeConnection closes the http connection and writes a response.
-func closeConnection(w http.ResponseWriter, s string) {
+func closeConnection(w http.ResponseWriter, r *http.Request, s string) {
 	if flusher, ok := w.(http.Flusher); ok {
 		w.Header().Set("Connection", "close")
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s)))
@@ -426,7 +476,7 @@ func closeConnection(w http.ResponseWriter, s string) {
 		io.WriteString(w, s)
 		flusher.Flush()
 	}
-	log.Println(s, " Closing connection.")
+	Logger(r.Context()).Info(s + " Closing connection.")
 	conn, _, _ := w.(http.Hijacker).Hijack()
 	conn.Close()
 }
@@ -452,12 +502,13 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 func HTTPAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 	// Do not accept files that are greater than 100 MBs.
 	if r.ContentLength > maxFileSize {
-		closeConnection(w, "File too large (>100MB).")
+		closeConnection(w, r, "File too large (>100MB).")
 		return
 	}
 	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
-	log.Printf("Trace starting reading uploaded file. %d bytes", r.ContentLength)
-	defer log.Printf("Trace ended analyzing file.")
+	l := Logger(r.Context())
+	l.Info("Trace starting reading uploaded file.", "bytes", r.ContentLength)
+	defer l.Info("Trace ended analyzing file.")
 
 	//get the multipart reader for the request.
 	reader, err := r.MultipartReader()
@@ -541,17 +592,39 @@ func HTTPAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 
 // AnalyzeAndResponse analyzes the uploaded files and sends the HTTP response in JSON.
 func AnalyzeAndResponse(w http.ResponseWriter, r *http.Request, files map[string]UploadedFile) {
-	pd := &ParsedData{}
+	maxEvents, err := maxEventsParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := analysisContext(r)
+	defer cancel()
+	pd := &ParsedData{logger: Logger(ctx), maxEvents: maxEvents}
 	defer pd.Cleanup()
-	if err := pd.AnalyzeFiles(files); err != nil {
+	if err := pd.AnalyzeFilesContext(ctx, files); err != nil {
 		http.Error(w, fmt.Sprintf("failed to analyze file: %v", err), http.StatusInternalServerError)
 		return
 	}
 	pd.SendAsJSON(w, r)
 }
 
+// analysisContext returns the context to analyze the files of the request with, which is done once
+// the parse timeout passes.
+func analysisContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if parseTimeout > 0 {
+		return context.WithTimeout(r.Context(), parseTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 // AnalyzeFiles processes and analyzes the list of uploaded files.
 func (pd *ParsedData) AnalyzeFiles(files map[string]UploadedFile) error {
+	return pd.AnalyzeFilesContext(context.Background(), files)
+}
+
+// AnalyzeFilesContext is the same as AnalyzeFiles, but stops parsing and returns an error if the
+// context is done before the bug reports are parsed.
+func (pd *ParsedData) AnalyzeFilesContext(ctx context.Context, files map[string]UploadedFile) error {
 	fB, okB := files[bugreportFT]
 	if !okB {
 		return errors.New("missing bugreport file")
@@ -559,9 +632,12 @@ func (pd *ParsedData) AnalyzeFiles(files map[string]UploadedFile) error {
 
 	// Parse the bugreport.
 	fB2 := files[bugreport2FT]
-	if err := pd.parseBugReport(fB.FileName, string(fB.Contents), fB2.FileName, string(fB2.Contents)); err != nil {
+	if err := pd.parseBugReport(ctx, fB.FileName, string(fB.Contents), fB2.FileName, string(fB2.Contents)); err != nil {
 		return fmt.Errorf("error parsing bugreport: %v", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("bugreport parsing did not finish: %v", err)
+	}
 	// Write the bug report to a file in case we need it to process a kernel trace file.
 	if len(pd.data) < numberOfFilesToCompare {
 		tmpFile, err := writeTempFile(string(fB.Contents))
@@ -575,7 +651,7 @@ func (pd *ParsedData) AnalyzeFiles(files map[string]UploadedFile) error {
 			return fmt.Errorf("invalid kernel trace file: %v", file.FileName)
 		}
 		if pd.kernelTrace != "" {
-			log.Printf("more than one kernel trace file found")
+			pd.log().Warn("more than one kernel trace file found")
 		} else {
 			// Need bug report to process kernel trace file, so store the file for later processing.
 			tmpFile, err := writeTempFile(string(file.Contents))
@@ -656,7 +732,7 @@ func writeTempFile(contents string) (string, error) {
 // contentsB is an optional second bug report. If it's given and the Android IDs and batterystats
 // checkin start times are the same, a diff of the checkins will be saved, otherwise, they will be
 // saved as separate reports.
-func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string) error {
+func (pd *ParsedData) parseBugReport(ctx context.Context, fnameA, contentsA, fnameB, contentsB string) error {
 
 	doActivity := func(ch chan activity.LogsData, contents string, pkgs []*usagepb.PackageInfo) {
 		ch <- activity.Parse(pkgs, contents)
@@ -673,14 +749,15 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 			Checkin:          proto.String(bs),
 			BuildFingerprint: proto.String(meta.BuildFingerprint),
 		}
-		stats, warnings, errs := checkinparse.ParseBatteryStats(&ctr, checkinparse.CreateBatteryReport(s), pkgs)
+		// Parse on a best effort basis, so a malformed line doesn't lose all the stats.
+		stats, warnings, errs := checkinparse.ParseBatteryStatsPartial(ctx, &ctr, checkinparse.CreateBatteryReport(s), pkgs)
 		if stats == nil {
 			errs = append(errs, errors.New("could not parse aggregated battery stats"))
 		} else {
 			pd.deviceType = stats.GetBuild().GetDevice()
 		}
 		ch <- checkinData{stats, warnings, errs}
-		log.Printf("Trace finished processing checkin.")
+		pd.log().Info("Trace finished processing checkin.")
 	}
 
 	doDmesg := func(ch chan dmesg.Data, contents string) {
@@ -696,15 +773,15 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		}
 		// Don't run the Historian script if it could not create temporary file.
 		defer os.Remove(brFile)
-		html, err := generateHistorianPlot(fname, brFile)
+		html, err := generateHistorianPlot(ctx, fname, brFile)
 		ch <- historianData{html, err}
-		log.Printf("Trace finished generating Historian plot.")
+		pd.log().Info("Trace finished generating Historian plot.")
 	}
 
 	// bs is the batterystats section of the bug report
 	doSummaries := func(ch chan summariesData, bs string, pkgs []*usagepb.PackageInfo) {
-		ch <- analyze(bs, pkgs)
-		log.Printf("Trace finished processing summary data.")
+		ch <- analyze(ctx, bs, pkgs)
+		pd.log().Info("Trace finished processing summary data.")
 	}
 
 	doWearable := func(ch chan string, loc, contents string) {
@@ -715,6 +792,29 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		}
 	}
 
+	// prepared holds the sections of a report that the other parsers depend on.
+	type prepared struct {
+		// bs is the batterystats checkin section.
+		bs   string
+		pkgs []*usagepb.PackageInfo
+		errs []error
+	}
+
+	// doPrepare extracts the batterystats checkin and the installed packages of a report in parallel,
+	// as both scan the whole bug report.
+	doPrepare := func(contents string) prepared {
+		var p prepared
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.bs = bugreportutils.ExtractBatterystatsCheckin(contents)
+		}()
+		p.pkgs, p.errs = packageutils.ExtractAppsFromBugReport(contents)
+		wg.Wait()
+		return p
+	}
+
 	type brData struct {
 		fileName string
 		contents string
@@ -778,9 +878,9 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		}
 
 		if diff {
-			log.Printf("Trace started diffing files.")
+			pd.log().Info("Trace started diffing files.")
 		} else {
-			log.Printf("Trace started analyzing %q file.", brDA.fileName)
+			pd.log().Info("Trace started analyzing file.", "file", brDA.fileName)
 		}
 
 		// Generate the Historian plot and Volta parsing simultaneously.
@@ -806,28 +906,28 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		} else {
 			// No point running these if we don't support the sdk version since we won't get any data from them.
 
-			bsL := bugreportutils.ExtractBatterystatsCheckin(late.contents)
+			// The earlier report is only needed for the checkin, so is prepared while the
+			// sections of the later report are parsed.
+			var prepE prepared
+			var prepWG sync.WaitGroup
+			if diff {
+				prepWG.Add(1)
+				go func() {
+					defer prepWG.Done()
+					prepE = doPrepare(earl.contents)
+				}()
+			}
+
+			prepL := doPrepare(late.contents)
+			bsL, pkgsL := prepL.bs, prepL.pkgs
 			if strings.Contains(bsL, "Exception occurred while dumping") {
 				ce = "Exception found in battery dump."
 				errs = append(errs, errors.New("exception found in battery dump"))
 			}
-
-			pkgsL, pkgErrs := packageutils.ExtractAppsFromBugReport(late.contents)
-			errs = append(errs, pkgErrs...)
+			errs = append(errs, prepL.errs...)
 			checkinECh := make(chan checkinData)
 			checkinLCh := make(chan checkinData)
 			go doCheckin(checkinLCh, late.meta, bsL, pkgsL)
-			if diff {
-				// Calculate batterystats for the earlier report.
-				bsE := bugreportutils.ExtractBatterystatsCheckin(earl.contents)
-				if strings.Contains(bsE, "Exception occurred while dumping") {
-					ce = "Exception found in battery dump."
-					errs = append(errs, errors.New("exception found in battery dump"))
-				}
-				pkgsE, pkgErrs := packageutils.ExtractAppsFromBugReport(earl.contents)
-				errs = append(errs, pkgErrs...)
-				go doCheckin(checkinECh, earl.meta, bsE, pkgsE)
-			}
 
 			// These are only parsed for supported sdk versions, even though they are still
 			// present in unsupported sdk version reports, because the events are rendered
@@ -838,6 +938,17 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 			go doWearable(wearableCh, late.dt.Location().String(), late.contents)
 			go doSummaries(summariesCh, bsL, pkgsL)
 
+			if diff {
+				// Calculate batterystats for the earlier report.
+				prepWG.Wait()
+				if strings.Contains(prepE.bs, "Exception occurred while dumping") {
+					ce = "Exception found in battery dump."
+					errs = append(errs, errors.New("exception found in battery dump"))
+				}
+				errs = append(errs, prepE.errs...)
+				go doCheckin(checkinECh, earl.meta, prepE.bs, prepE.pkgs)
+			}
+
 			checkinL = <-checkinLCh
 			errs = append(errs, checkinL.err...)
 			warnings = append(warnings, checkinL.warnings...)
@@ -885,6 +996,8 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 			bsStats, historianOutput.html,
 			warnings,
 			errs, summariesOutput.overflowMs > 0, true)
+		// The checkin diagnostics are among errs, while the history diagnostics are kept separately.
+		data.Diagnostics = append(historianutils.Diagnostics(errs), summariesOutput.diagnostics...)
 
 		historianV2Logs := []historianV2Log{
 			{
@@ -907,7 +1020,7 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		}
 		for s, l := range activityManagerOutput.Logs {
 			if l == nil {
-				log.Print("Nil logcat log received")
+				pd.log().Warn("Nil logcat log received")
 				continue
 			}
 			source := ""
@@ -919,7 +1032,7 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 			case activity.LastLogcatSection:
 				source = lastLogcat
 			default:
-				log.Printf("Logcat section %q not handled", s)
+				pd.log().Warn("Logcat section not handled", "section", s)
 				// Show it anyway.
 				source = s
 			}
@@ -950,13 +1063,14 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 			Location:        late.dt.Location().String(),
 			OverflowMs:      summariesOutput.overflowMs,
 			IsDiff:          diff,
+			Diagnostics:     data.Diagnostics,
 		})
 		pd.data = append(pd.data, data)
 
 		if diff {
-			log.Printf("Trace finished diffing files.")
+			pd.log().Info("Trace finished diffing files.")
 		} else {
-			log.Printf("Trace finished analyzing %q file.", brDA.fileName)
+			pd.log().Info("Trace finished analyzing file.", "file", brDA.fileName)
 		}
 	}
 
@@ -974,12 +1088,12 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 		var errs []error
 		br.bt, errs = batteryTime(contents)
 		if len(errs) > 0 {
-			log.Printf("failed to extract battery info: %s", historianutils.ErrorsToString(errs))
+			pd.log().Warn("failed to extract battery info", "errors", historianutils.ErrorsToString(errs))
 			// It's fine to continue if this fails.
 		}
 		br.dt, err = bugreportutils.DumpState(contents)
 		if err != nil {
-			log.Printf("failed to extract time information from bugreport dumpstate: %v", err)
+			pd.log().Warn("failed to extract time information from bugreport dumpstate", "error", err)
 		}
 		return &br, nil
 	}
@@ -997,15 +1111,15 @@ func (pd *ParsedData) parseBugReport(fnameA, contentsA, fnameB, contentsB string
 	return nil
 }
 
-func analyze(bugReport string, pkgs []*usagepb.PackageInfo) summariesData {
+func analyze(ctx context.Context, bugReport string, pkgs []*usagepb.PackageInfo) summariesData {
 	upm, errs := parseutils.UIDAndPackageNameMapping(bugReport, pkgs)
 
 	var bufTotal, bufLevel bytes.Buffer
 	// repTotal contains summaries over discharge intervals
-	repTotal := parseutils.AnalyzeHistory(&bufTotal, bugReport, parseutils.FormatTotalTime, upm, false)
+	repTotal := parseutils.AnalyzeHistoryContext(ctx, &bufTotal, bugReport, parseutils.FormatTotalTime, upm, false)
 	// repLevel contains summaries for each battery level drop.
 	// The generated errors would be the exact same as repTotal.Errs so no need to track or add them again.
-	parseutils.AnalyzeHistory(&bufLevel, bugReport, parseutils.FormatBatteryLevel, upm, false)
+	parseutils.AnalyzeHistoryContext(ctx, &bufLevel, bugReport, parseutils.FormatBatteryLevel, upm, false)
 
 	// Exclude summaries with no change in battery level
 	var summariesTotal []parseutils.ActivitySummary
@@ -1016,12 +1130,12 @@ func analyze(bugReport string, pkgs []*usagepb.PackageInfo) summariesData {
 	}
 
 	errs = append(errs, repTotal.Errs...)
-	return summariesData{summariesTotal, bufTotal.String(), bufLevel.String(), repTotal.TimeToDelta, errs, repTotal.OverflowMs}
+	return summariesData{summariesTotal, bufTotal.String(), bufLevel.String(), repTotal.TimeToDelta, errs, repTotal.OverflowMs, repTotal.Diagnostics}
 }
 
 // generateHistorianPlot calls the Historian python script to generate html charts.
-func generateHistorianPlot(reportName, filepath string) (string, error) {
-	return historianutils.RunCommand("python", scriptsPath(scriptsDir, "historian.py"), "-c", "-m", "-r", reportName, filepath)
+func generateHistorianPlot(ctx context.Context, reportName, filepath string) (string, error) {
+	return historianutils.RunCommandContext(ctx, "python", scriptsPath(scriptsDir, "historian.py"), "-c", "-m", "-r", reportName, filepath)
 }
 
 // generateKernelCSV calls the python script to convert kernel trace files into a CSV format parseable by kernel.Parse.
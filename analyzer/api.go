@@ -0,0 +1,302 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analyzer
+
+// api.go serves the JSON REST API used to analyze bug reports programmatically, such as from CI.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chenjiacun35/battery-historian/bugreportutils"
+	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/chenjiacun35/battery-historian/historianutils"
+	"github.com/chenjiacun35/battery-historian/presenter"
+
+	bspb "github.com/chenjiacun35/battery-historian/pb/batterystats_proto"
+)
+
+const (
+	// APIPrefix is the path the REST API is served under.
+	APIPrefix = "/api/v1/"
+
+	// maxStoredReports is the number of analyzed reports kept in memory for the report endpoints.
+	// The oldest report is dropped once more are analyzed.
+	maxStoredReports = 20
+)
+
+// apiSummary is the JSON response of the summary endpoint, and of the analyze endpoint.
+type apiSummary struct {
+	ID          string `json:"id"`
+	FileName    string `json:"fileName"`
+	SDKVersion  int    `json:"sdkVersion"`
+	DeviceModel string `json:"deviceModel"`
+	// BatteryStats are the aggregated checkin stats.
+	BatteryStats *bspb.BatteryStats  `json:"batteryStats"`
+	AppStats     []presenter.AppStat `json:"appStats"`
+	// Summaries summarize the history over each discharge interval.
+	Summaries     []presenter.UnplugSummary    `json:"summaries"`
+	CriticalError string                       `json:"criticalError,omitempty"`
+	Errors        []string                     `json:"errors,omitempty"`
+	Warnings      []string                     `json:"warnings,omitempty"`
+	Diagnostics   []*historianutils.ParseError `json:"diagnostics,omitempty"`
+	// Links are the paths of the other endpoints for the report.
+	Links map[string]string `json:"links"`
+}
+
+// apiTimeline is the JSON response of the timeline endpoint.
+type apiTimeline struct {
+	ID string `json:"id"`
+	// Events are the battery history events of each metric, as encoded by csv.MarshalEventsJSON.
+	Events json.RawMessage `json:"events"`
+}
+
+// apiReport is an analyzed bug report, as served by the report endpoints.
+type apiReport struct {
+	summary apiSummary
+	// events are the battery history events of each metric, as extracted by csv.ExtractEvents.
+	events map[string][]csv.Event
+}
+
+// reportStore keeps the most recently analyzed reports, so they can be fetched by ID.
+type reportStore struct {
+	mu      sync.Mutex
+	max     int
+	reports map[string]*apiReport
+	// ids are the IDs of the stored reports, oldest first.
+	ids []string
+}
+
+func newReportStore(max int) *reportStore {
+	return &reportStore{max: max, reports: make(map[string]*apiReport)}
+}
+
+// add stores the report, dropping the oldest report if the store is full.
+func (s *reportStore) add(id string, r *apiReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ids) >= s.max {
+		delete(s.reports, s.ids[0])
+		s.ids = s.ids[1:]
+	}
+	s.reports[id] = r
+	s.ids = append(s.ids, id)
+}
+
+// get returns the report with the given ID, or nil if there is none.
+func (s *reportStore) get(id string) *apiReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reports[id]
+}
+
+var apiReports = newReportStore(maxStoredReports)
+
+// newReportID returns a random ID for an analyzed report.
+func newReportID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// APIHandler serves the JSON REST API under APIPrefix:
+//
+//	POST /api/v1/analyze                posts a bug report, plain text or zipped, as the request body,
+//	                                    and responds with its summary, including the report ID.
+//	GET  /api/v1/report/{id}/summary    responds with the summary of an analyzed report.
+//	GET  /api/v1/report/{id}/timeline   responds with the battery history events of an analyzed report,
+//	                                    in the schema of csv.MarshalEventsJSON. Add max_events=N to
+//	                                    downsample each metric to at most N events.
+//
+// Only the most recently analyzed reports are kept, in memory, so reports should be fetched soon after
+// they're analyzed. Errors are reported as a JSON object with an "error" message.
+func APIHandler(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, APIPrefix)
+	if p == "analyze" {
+		if r.Method != "POST" {
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		apiAnalyze(w, r)
+		return
+	}
+	parts := strings.Split(p, "/")
+	if len(parts) != 3 || parts[0] != "report" {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown endpoint %q", r.URL.Path))
+		return
+	}
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	rep := apiReports.get(parts[1])
+	if rep == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown report %q", parts[1]))
+		return
+	}
+	switch parts[2] {
+	case "summary":
+		writeAPIJSON(w, http.StatusOK, rep.summary)
+	case "timeline":
+		maxEvents, err := maxEventsParam(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		events := rep.events
+		if maxEvents > 0 {
+			events = csv.DownsampleMap(events, maxEvents)
+		}
+		b, err := csv.MarshalEventsJSON(events)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, apiTimeline{ID: rep.summary.ID, Events: b})
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown endpoint %q", r.URL.Path))
+	}
+}
+
+// apiAnalyze analyzes the bug report posted as the request body, and stores the result.
+func apiAnalyze(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFileSize))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("failed to read bug report: %v", err))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "bugreport.txt"
+	}
+	files, err := bugreportutils.Contents(name, b)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("failed to read bug report: %v", err))
+		return
+	}
+	var fname string
+	var contents []byte
+	for n, f := range files {
+		if bugreportutils.IsBugReport(f) {
+			fname, contents = n, f
+			break
+		}
+	}
+	if contents == nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s does not contain a valid bugreport file", name))
+		return
+	}
+
+	ctx, cancel := analysisContext(r)
+	defer cancel()
+	pd := &ParsedData{logger: Logger(ctx)}
+	defer pd.Cleanup()
+	if err := pd.AnalyzeFilesContext(ctx, map[string]UploadedFile{
+		bugreportFT: {bugreportFT, fname, contents},
+	}); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to analyze bug report: %v", err))
+		return
+	}
+	if len(pd.data) == 0 || len(pd.responseArr) == 0 {
+		writeAPIError(w, http.StatusInternalServerError, "failed to analyze bug report: no results")
+		return
+	}
+	id, err := newReportID()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to create report ID: %v", err))
+		return
+	}
+	rep := newAPIReport(id, pd.data[0], pd.responseArr[0])
+	apiReports.add(id, rep)
+
+	w.Header().Set("Location", rep.summary.Links["summary"])
+	writeAPIJSON(w, http.StatusCreated, rep.summary)
+}
+
+// newAPIReport creates the report served by the report endpoints from the analysis of a bug report.
+func newAPIReport(id string, data presenter.HTMLData, resp uploadResponse) *apiReport {
+	rep := &apiReport{
+		summary: apiSummary{
+			ID:            id,
+			FileName:      data.Filename,
+			SDKVersion:    data.SDKVersion,
+			DeviceModel:   data.DeviceModel,
+			BatteryStats:  resp.BatteryStats,
+			AppStats:      data.AppStats,
+			Summaries:     data.UnplugSummaries,
+			CriticalError: resp.CriticalError,
+			Errors:        splitLines(data.Error),
+			Warnings:      splitLines(data.Warning),
+			Diagnostics:   resp.Diagnostics,
+			Links: map[string]string{
+				"summary":  APIPrefix + "report/" + id + "/summary",
+				"timeline": APIPrefix + "report/" + id + "/timeline",
+			},
+		},
+		events: map[string][]csv.Event{},
+	}
+	for _, l := range resp.HistorianV2Logs {
+		if l.Source != batteryHistory || l.CSV == "" {
+			continue
+		}
+		events, errs := csv.ExtractEvents(l.CSV, nil)
+		rep.events = events
+		for _, err := range errs {
+			rep.summary.Errors = append(rep.summary.Errors, fmt.Sprintf("battery history: %v", err))
+		}
+	}
+	return rep
+}
+
+// splitLines splits newline delimited messages, dropping empty lines.
+func splitLines(s string) []string {
+	var res []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// writeAPIJSON writes v as the JSON response with the given status code.
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeAPIError writes an {"error"} JSON response with the given status code.
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/chenjiacun35/battery-historian/presenter"
+)
+
+// TestReportStore tests that the oldest reports are dropped once the store is full.
+func TestReportStore(t *testing.T) {
+	s := newReportStore(2)
+	a, b, c := &apiReport{}, &apiReport{}, &apiReport{}
+	s.add("a", a)
+	s.add("b", b)
+	s.add("c", c)
+
+	if got := s.get("a"); got != nil {
+		t.Errorf("get(%q) = %v, want nil", "a", got)
+	}
+	if got := s.get("b"); got != b {
+		t.Errorf("get(%q) = %p, want %p", "b", got, b)
+	}
+	if got := s.get("c"); got != c {
+		t.Errorf("get(%q) = %p, want %p", "c", got, c)
+	}
+}
+
+// TestAPIHandler tests the routing of the report endpoints.
+func TestAPIHandler(t *testing.T) {
+	csvInput := strings.Join([]string{
+		csv.FileHeader,
+		"Screen,bool,1000,2000,true,",
+	}, "\n")
+	rep := newAPIReport("test-report", presenter.HTMLData{
+		Filename: "bugreport.txt",
+		Error:    "first error\n\nsecond error\n",
+	}, uploadResponse{
+		HistorianV2Logs: []historianV2Log{{Source: batteryHistory, CSV: csvInput}},
+	})
+	orig := apiReports
+	defer func() { apiReports = orig }()
+	apiReports = newReportStore(maxStoredReports)
+	apiReports.add(rep.summary.ID, rep)
+
+	if want := []string{"first error", "second error"}; !reflect.DeepEqual(rep.summary.Errors, want) {
+		t.Errorf("newAPIReport(...).summary.Errors = %q, want %q", rep.summary.Errors, want)
+	}
+
+	tests := []struct {
+		desc, method, path string
+		wantCode           int
+	}{
+		{"summary", "GET", "/api/v1/report/test-report/summary", http.StatusOK},
+		{"timeline", "GET", "/api/v1/report/test-report/timeline", http.StatusOK},
+		{"unknown report", "GET", "/api/v1/report/unknown/summary", http.StatusNotFound},
+		{"unknown report endpoint", "GET", "/api/v1/report/test-report/other", http.StatusNotFound},
+		{"unknown endpoint", "GET", "/api/v1/other", http.StatusNotFound},
+		{"report not GET", "POST", "/api/v1/report/test-report/summary", http.StatusMethodNotAllowed},
+		{"analyze not POST", "GET", "/api/v1/analyze", http.StatusMethodNotAllowed},
+		{"analyze invalid bug report", "POST", "/api/v1/analyze", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		APIHandler(w, httptest.NewRequest(test.method, test.path, strings.NewReader("not a bug report")))
+		if w.Code != test.wantCode {
+			t.Errorf("%v: APIHandler() status = %d, want %d", test.desc, w.Code, test.wantCode)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%v: APIHandler() content type = %q, want %q", test.desc, got, "application/json")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	APIHandler(w, httptest.NewRequest("GET", "/api/v1/report/test-report/timeline", nil))
+	var got apiTimeline
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("APIHandler() timeline response %q is not valid JSON: %v", w.Body.String(), err)
+	}
+	want := `{"schema":"battery-historian-events","version":1,"metrics":{"Screen":[{"type":"bool","start":1000,"end":2000,"value":"true","opt":""}]}}`
+	if got.ID != "test-report" || string(got.Events) != want {
+		t.Errorf("APIHandler() timeline = %q: %s, want %q: %s", got.ID, got.Events, "test-report", want)
+	}
+}
+
+// TestAPIHandlerMaxEvents tests downsampling the timeline of a report.
+func TestAPIHandlerMaxEvents(t *testing.T) {
+	lines := []string{csv.FileHeader}
+	for i := 0; i < 10; i++ {
+		start := 1422620452417 + int64(i)*1000
+		lines = append(lines, fmt.Sprintf("Battery Level,int,%d,%d,%d,", start, start+1000, 100-i))
+	}
+	rep := newAPIReport("test-report", presenter.HTMLData{}, uploadResponse{
+		HistorianV2Logs: []historianV2Log{{Source: batteryHistory, CSV: strings.Join(lines, "\n")}},
+	})
+	orig := apiReports
+	defer func() { apiReports = orig }()
+	apiReports = newReportStore(maxStoredReports)
+	apiReports.add(rep.summary.ID, rep)
+
+	w := httptest.NewRecorder()
+	APIHandler(w, httptest.NewRequest("GET", "/api/v1/report/test-report/timeline?max_events=4", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("APIHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got struct {
+		Events struct {
+			Metrics map[string][]json.RawMessage `json:"metrics"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("APIHandler() returned invalid JSON %q: %v", w.Body.String(), err)
+	}
+	if n := len(got.Events.Metrics["Battery Level"]); n != 4 {
+		t.Errorf("APIHandler() returned %d events, want 4", n)
+	}
+	if n := len(rep.events["Battery Level"]); n != 10 {
+		t.Errorf("APIHandler() left %d stored events, want 10", n)
+	}
+
+	w = httptest.NewRecorder()
+	APIHandler(w, httptest.NewRequest("GET", "/api/v1/report/test-report/timeline?max_events=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("APIHandler() with invalid max_events status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// TestDownsampleHistory tests downsampling the battery history of the analysis response.
+func TestDownsampleHistory(t *testing.T) {
+	lines := []string{csv.FileHeader}
+	for i := 0; i < 10; i++ {
+		start := 1422620452417 + int64(i)*1000
+		lines = append(lines, fmt.Sprintf("Battery Level,int,%d,%d,%d,", start, start+1000, 100-i))
+	}
+	history := strings.Join(lines, "\n")
+	eventLog := strings.Join([]string{csv.FileHeader, "AM Low Memory,service,1422620452417,1422620452417,20,"}, "\n")
+	pd := &ParsedData{
+		maxEvents: 4,
+		responseArr: []uploadResponse{{
+			HistorianV2Logs: []historianV2Log{
+				{Source: batteryHistory, CSV: history},
+				{Source: "Event", CSV: eventLog},
+			},
+		}},
+	}
+	pd.downsampleHistory()
+
+	logs := pd.responseArr[0].HistorianV2Logs
+	events, errs := csv.ExtractEvents(logs[0].CSV, nil)
+	if len(errs) > 0 {
+		t.Fatalf("downsampleHistory() wrote invalid CSV %q: %v", logs[0].CSV, errs)
+	}
+	if n := len(events["Battery Level"]); n != 4 {
+		t.Errorf("downsampleHistory() kept %d battery level events, want 4", n)
+	}
+	if logs[1].CSV != eventLog {
+		t.Errorf("downsampleHistory() changed the event log CSV to %q, want %q", logs[1].CSV, eventLog)
+	}
+
+	w := httptest.NewRecorder()
+	AnalyzeAndResponse(w, httptest.NewRequest("POST", "/?max_events=none", nil), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("AnalyzeAndResponse() with invalid max_events status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
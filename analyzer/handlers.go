@@ -0,0 +1,258 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analyzer
+
+// handlers.go contains the HTTP handlers for running the analyzer as a service, separate to the upload and analysis handlers.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/chenjiacun35/battery-historian/historianutils"
+)
+
+// RequestIDHeader is the response header RequestID sets to the ID assigned to the request.
+const RequestIDHeader = "X-Request-ID"
+
+// requestLoggerKey is the context key for the request scoped logger set by RequestID.
+type requestLoggerKey struct{}
+
+// The build version and commit are set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/chenjiacun35/battery-historian/analyzer.buildVersion=v1.2 -X github.com/chenjiacun35/battery-historian/analyzer.buildCommit=$(git rev-parse HEAD)"
+var (
+	buildVersion = "unknown"
+	buildCommit  = "unknown"
+)
+
+// versionInfo is the JSON response sent by VersionHandler.
+type versionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+}
+
+// HealthzHandler responds with "ok" to indicate the server is alive.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok")
+}
+
+// VersionHandler responds with the build version and commit of the server as JSON.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(versionInfo{
+		Version: buildVersion,
+		Commit:  buildCommit,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// csvEventsResponse is the JSON response sent by CSVHandler.
+type csvEventsResponse struct {
+	// Events are the extracted events, as encoded by csv.MarshalEventsJSON.
+	Events json.RawMessage `json:"events"`
+	Errors []string        `json:"errors,omitempty"`
+}
+
+// CSVHandler extracts the events from a Historian CSV, such as one generated by a previous run,
+// posted as the request body, and responds with the events for each metric as JSON, in the schema
+// of csv.MarshalEventsJSON. The first line of the CSV must be the header in csv.FileHeader. Any
+// malformed records are skipped and reported in the errors of the response.
+//
+// If the format query parameter is "ndjson", the events are instead streamed as newline delimited
+// JSON, as written by csv.WriteEventsNDJSON, followed by an {"errors"} object if there were any
+// errors. The response is flushed after each metric, so large reports can be rendered progressively.
+//
+// If the max_events query parameter is set, each metric is downsampled to at most that many events
+// with csv.Downsample, so very long timelines can be displayed.
+func CSVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFileSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read CSV: %v", err), http.StatusBadRequest)
+		return
+	}
+	input := strings.TrimLeft(string(b), "\ufeff")
+	if header := strings.TrimSpace(strings.SplitN(input, "\n", 2)[0]); header != csv.FileHeader {
+		http.Error(w, fmt.Sprintf("invalid CSV header %q, want %q", header, csv.FileHeader), http.StatusBadRequest)
+		return
+	}
+	maxEvents, err := maxEventsParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, errs := csv.ExtractEvents(input, nil)
+	if maxEvents > 0 {
+		events = csv.DownsampleMap(events, maxEvents)
+	}
+	if r.URL.Query().Get("format") == "ndjson" {
+		streamNDJSON(w, events, errs)
+		return
+	}
+	eventsJSON, err := csv.MarshalEventsJSON(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := csvEventsResponse{Events: eventsJSON}
+	for _, err := range errs {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// Gzip data if it's accepted by the requester, as for the analysis response.
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if gzipped, err := historianutils.GzipCompress(out); err == nil {
+			w.Header().Add("Content-Encoding", "gzip")
+			w.Write(gzipped)
+			return
+		}
+	}
+	w.Write(out)
+}
+
+// maxEventsParam returns the max_events query parameter of the request, which is the number of events
+// each metric should be downsampled to, or 0 if it isn't set.
+func maxEventsParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("max_events")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid max_events %q, want a positive integer", v)
+	}
+	return n, nil
+}
+
+// streamNDJSON streams the events as newline delimited JSON, flushing after each metric.
+func streamNDJSON(w http.ResponseWriter, events map[string][]csv.Event, errs []error) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := csv.WriteEventsNDJSON(w, events); err != nil {
+		// The status has already been sent, so the client will see a truncated stream.
+		return
+	}
+	if len(errs) == 0 {
+		return
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	json.NewEncoder(w).Encode(struct {
+		Errors []string `json:"errors"`
+	}{msgs})
+}
+
+// CORSConfig specifies the cross-origin requests allowed by CORS.
+type CORSConfig struct {
+	// AllowedOrigins are the origins that may make cross-origin requests. "*" allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are sent in response to preflight requests.
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+// allowsOrigin returns whether the config allows requests from the given origin.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS wraps h to set the CORS headers on responses to allowed origins, and responds to
+// preflight OPTIONS requests. If no origins are allowed, h is returned unchanged.
+func CORS(c CORSConfig, h http.Handler) http.Handler {
+	if len(c.AllowedOrigins) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !c.allowsOrigin(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if len(c.AllowedMethods) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+			}
+			if len(c.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newRequestID returns a random ID for correlating the log lines of a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestID wraps h to assign an ID to each request, returned in the X-Request-ID response header.
+// The request context carries a logger that includes the ID in every log line, retrieved by Logger.
+func RequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set(RequestIDHeader, id)
+		l := slog.Default().With("request_id", id)
+		start := time.Now()
+		l.Info("request started", "method", r.Method, "path", r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, l)))
+		l.Info("request finished", "duration", time.Since(start))
+	})
+}
+
+// Logger returns the request scoped logger set by RequestID, or the default logger if there is none.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,324 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+)
+
+// TestHealthzHandler tests that the health check responds with ok.
+func TestHealthzHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("HealthzHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Body.String(); got != "ok" {
+		t.Errorf("HealthzHandler() body = %q, want %q", got, "ok")
+	}
+}
+
+// TestVersionHandler tests that the linker set build info is returned as JSON.
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c string) {
+		buildVersion, buildCommit = v, c
+	}(buildVersion, buildCommit)
+	buildVersion = "v1.2"
+	buildCommit = "4d85cb0"
+
+	w := httptest.NewRecorder()
+	VersionHandler(w, httptest.NewRequest("GET", "/version", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("VersionHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("VersionHandler() Content-Type = %q, want %q", got, "application/json")
+	}
+	want := `{"version":"v1.2","commit":"4d85cb0"}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("VersionHandler() body = %q, want %q", got, want)
+	}
+}
+
+// TestCORS tests that CORS headers are only set for allowed origins.
+func TestCORS(t *testing.T) {
+	c := CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type"},
+	}
+	tests := []struct {
+		desc        string
+		config      CORSConfig
+		method      string
+		origin      string
+		preflight   bool
+		wantCode    int
+		wantOrigin  string
+		wantMethods string
+	}{
+		{
+			desc:       "Allowed origin",
+			config:     c,
+			method:     "GET",
+			origin:     "https://app.example.com",
+			wantCode:   http.StatusOK,
+			wantOrigin: "https://app.example.com",
+		},
+		{
+			desc:     "Disallowed origin",
+			config:   c,
+			method:   "GET",
+			origin:   "https://other.example.com",
+			wantCode: http.StatusOK,
+		},
+		{
+			desc:        "Preflight from allowed origin",
+			config:      c,
+			method:      "OPTIONS",
+			origin:      "https://app.example.com",
+			preflight:   true,
+			wantCode:    http.StatusNoContent,
+			wantOrigin:  "https://app.example.com",
+			wantMethods: "GET, POST",
+		},
+		{
+			desc:     "No allowed origins",
+			method:   "GET",
+			origin:   "https://app.example.com",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/version", nil)
+		r.Header.Set("Origin", test.origin)
+		if test.preflight {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		CORS(test.config, http.HandlerFunc(HealthzHandler)).ServeHTTP(w, r)
+
+		if w.Code != test.wantCode {
+			t.Errorf("%v: CORS() status = %d, want %d", test.desc, w.Code, test.wantCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+			t.Errorf("%v: CORS() Access-Control-Allow-Origin = %q, want %q", test.desc, got, test.wantOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != test.wantMethods {
+			t.Errorf("%v: CORS() Access-Control-Allow-Methods = %q, want %q", test.desc, got, test.wantMethods)
+		}
+	}
+}
+
+// TestRequestID tests that each request is assigned an ID returned in the response header,
+// and that the request logger is available to the wrapped handler.
+func TestRequestID(t *testing.T) {
+	var gotLogger bool
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotLogger = Logger(r.Context()) != slog.Default()
+		HealthzHandler(w, r)
+	}))
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+
+		id := w.Header().Get(RequestIDHeader)
+		if id == "" {
+			t.Fatalf("RequestID() response missing %s header", RequestIDHeader)
+		}
+		if seen[id] {
+			t.Errorf("RequestID() reused request ID %q", id)
+		}
+		seen[id] = true
+		if !gotLogger {
+			t.Errorf("RequestID() wrapped handler got the default logger, want the request logger")
+		}
+	}
+}
+
+// TestCSVHandler tests extracting the events from a posted CSV.
+func TestCSVHandler(t *testing.T) {
+	validCSV := strings.Join([]string{
+		csv.FileHeader,
+		"Screen,bool,1422620452417,1422620453917,true,",
+		"Reboot,bool,notanumber,1430000000000,true,",
+		"Wakelock_in,service,1422620452417,1422620452917,com.google.android.gms,10041",
+	}, "\n")
+	tests := []struct {
+		desc       string
+		method     string
+		body       string
+		wantCode   int
+		wantEvents map[string][]csv.Event
+		wantErrors []string
+	}{
+		{
+			desc:     "Valid CSV",
+			method:   "POST",
+			body:     validCSV,
+			wantCode: http.StatusOK,
+			wantEvents: map[string][]csv.Event{
+				"Screen": {
+					{Type: "bool", Start: 1422620452417, End: 1422620453917, Value: "true"},
+				},
+				"Wakelock_in": {
+					{Type: "service", Start: 1422620452417, End: 1422620452917, Value: "com.google.android.gms", Opt: "10041"},
+				},
+			},
+			wantErrors: []string{`record 2: start: strconv.ParseInt: parsing "notanumber": invalid syntax`},
+		},
+		{
+			desc:     "Missing header",
+			method:   "POST",
+			body:     "Screen,bool,1422620452417,1422620453917,true,",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			desc:     "GET not allowed",
+			method:   "GET",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		CSVHandler(w, httptest.NewRequest(test.method, "/csv", strings.NewReader(test.body)))
+
+		if w.Code != test.wantCode {
+			t.Errorf("%v: CSVHandler() status = %d, want %d", test.desc, w.Code, test.wantCode)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var got csvEventsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%v: CSVHandler() returned invalid JSON %q: %v", test.desc, w.Body.String(), err)
+			continue
+		}
+		wantEvents, err := csv.MarshalEventsJSON(test.wantEvents)
+		if err != nil {
+			t.Fatalf("%v: csv.MarshalEventsJSON(%v) unexpected error: %v", test.desc, test.wantEvents, err)
+		}
+		if string(got.Events) != string(wantEvents) {
+			t.Errorf("%v: CSVHandler() events = %s, want %s", test.desc, got.Events, wantEvents)
+		}
+		if !reflect.DeepEqual(got.Errors, test.wantErrors) {
+			t.Errorf("%v: CSVHandler() errors = %q, want %q", test.desc, got.Errors, test.wantErrors)
+		}
+	}
+}
+
+// TestCSVHandlerNDJSON tests streaming the events of each metric as newline delimited JSON.
+func TestCSVHandlerNDJSON(t *testing.T) {
+	body := strings.Join([]string{
+		csv.FileHeader,
+		"Screen,bool,1422620452417,1422620453917,true,",
+		"Reboot,bool,notanumber,1430000000000,true,",
+		"Wakelock_in,service,1422620452417,1422620452917,com.google.android.gms,10041",
+		"Screen,bool,1422620454917,1422620455917,true,",
+	}, "\n")
+	w := httptest.NewRecorder()
+	CSVHandler(w, httptest.NewRequest("POST", "/csv?format=ndjson", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("CSVHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/x-ndjson"; got != want {
+		t.Errorf("CSVHandler() Content-Type = %q, want %q", got, want)
+	}
+	if !w.Flushed {
+		t.Errorf("CSVHandler() didn't flush the stream")
+	}
+
+	var schema string
+	var metrics []string
+	numEvents, numErrors := 0, 0
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var obj struct {
+			Schema string   `json:"schema"`
+			Metric string   `json:"metric"`
+			Errors []string `json:"errors"`
+		}
+		if err := dec.Decode(&obj); err != nil {
+			t.Fatalf("CSVHandler() returned invalid NDJSON %q: %v", w.Body.String(), err)
+		}
+		if obj.Schema != "" {
+			schema = obj.Schema
+		}
+		if obj.Metric != "" {
+			numEvents++
+			if len(metrics) == 0 || metrics[len(metrics)-1] != obj.Metric {
+				metrics = append(metrics, obj.Metric)
+			}
+		}
+		numErrors += len(obj.Errors)
+	}
+	if schema != csv.EventsSchema {
+		t.Errorf("CSVHandler() streamed schema %q, want %q", schema, csv.EventsSchema)
+	}
+	if want := []string{"Screen", "Wakelock_in"}; !reflect.DeepEqual(metrics, want) {
+		t.Errorf("CSVHandler() streamed metrics %v, want %v", metrics, want)
+	}
+	if numEvents != 3 || numErrors != 1 {
+		t.Errorf("CSVHandler() streamed %d events and %d errors, want 3 events and 1 error", numEvents, numErrors)
+	}
+}
+
+// TestCSVHandlerMaxEvents tests downsampling the events of each metric.
+func TestCSVHandlerMaxEvents(t *testing.T) {
+	lines := []string{csv.FileHeader}
+	for i := 0; i < 10; i++ {
+		start := 1422620452417 + int64(i)*1000
+		lines = append(lines, fmt.Sprintf("Battery Level,int,%d,%d,%d,", start, start+1000, 100-i))
+	}
+	body := strings.Join(lines, "\n")
+
+	w := httptest.NewRecorder()
+	CSVHandler(w, httptest.NewRequest("POST", "/csv?max_events=4", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("CSVHandler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got struct {
+		Events struct {
+			Metrics map[string][]json.RawMessage `json:"metrics"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("CSVHandler() returned invalid JSON %q: %v", w.Body.String(), err)
+	}
+	if n := len(got.Events.Metrics["Battery Level"]); n != 4 {
+		t.Errorf("CSVHandler() returned %d events, want 4", n)
+	}
+
+	w = httptest.NewRecorder()
+	CSVHandler(w, httptest.NewRequest("POST", "/csv?max_events=none", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("CSVHandler() with invalid max_events status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -23,22 +23,49 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chenjiacun35/battery-historian/csv"
 	"github.com/chenjiacun35/battery-historian/historianutils"
 	"github.com/chenjiacun35/battery-historian/packageutils"
 )
 
 const (
+	// WifiScan is the metric name of the wifi scan events returned by WifiScans.
+	WifiScan = "Wifi scan"
+
+	// SensorUsage is the metric name of the sensor events returned by SensorRegistrations.
+	SensorUsage = "Sensor usage"
+
+	// Vibrator is the metric name of the vibration events returned by Vibrations.
+	Vibrator = "Vibrator on"
+
+	// ThermalThrottling is the metric name of the thermal events returned by ThermalStatus.
+	ThermalThrottling = "Thermal throttling"
+
+	// ForegroundService is the metric name of the foreground service events returned by ForegroundServices.
+	ForegroundService = "Foreground service"
+
 	// GPSSensorNumber is the hard-coded sensor number defined in frameworks/base/core/java/android/os/BatteryStats.Sensor
 	GPSSensorNumber = -10000
 
 	// TimeLayout is the timestamp layout commonly printed in bug reports.
 	TimeLayout = "2006-01-02 15:04:05"
+
+	// Range of checkin report versions known to Battery Historian.
+	minCheckinVersion = 11
+	maxCheckinVersion = 21
 )
 
+// ErrUnknownCheckinVersion indicates that the checkin report version is outside the range known to Battery Historian.
+var ErrUnknownCheckinVersion = errors.New("unknown checkin version")
+
+// ErrNoPowerProfile indicates that the bug report doesn't contain the device power profile.
+var ErrNoPowerProfile = errors.New("no power profile in bugreport")
+
 var (
 	// BugReportSectionRE is a regular expression to match the beginning of a bug report section.
 	BugReportSectionRE = regexp.MustCompile(`------\s+(?P<section>.*)\s+-----`)
@@ -58,6 +85,65 @@ var (
 	// pidRE is a regular expression to match PID to app name and UID.
 	pidRE = regexp.MustCompile(`PID #` + `(?P<pid>\d+)` + `: ProcessRecord[^:]+:` + `(?P<app>[^/]+)` + `/` + `(?P<uid>.*)` + `}`)
 
+	// procLRURE is a regular expression to match a process in the LRU list of the activity manager processes dump.
+	// e.g. "Proc #11: fore  T/A/T  trm: 0 3178:com.google.android.apps.nexuslauncher/u0a51 (top-activity)"
+	procLRURE = regexp.MustCompile(`^(PERS|Proc)\s*#\s*\d+:\s+` + `(?P<adj>\S+)\s+.*?trm:\s*\d+\s+` +
+		`(?P<pid>\d+):` + `(?P<app>[^/\s]+)` + `/` + `(?P<uid>\S+)` + `\s+\((?P<importance>[^)]*)\)`)
+
+	// serviceRecordRE is a regular expression to match the first line of a service in the activity manager services dump.
+	// e.g. "* ServiceRecord{7f9a3b1 u0 com.google.android.gms/.chimera.PersistentIntentOperationService}"
+	serviceRecordRE = regexp.MustCompile(`^\*\s+ServiceRecord\{\S+\s+u\d+\s+` + `(?P<package>[^/\s]+)/(?P<class>[^\s}]+)\}`)
+
+	// serviceCreateTimeRE is a regular expression to match the time since a service was created, in the activity manager services dump.
+	// e.g. "createTime=-1h23m4s567ms startingBgTimeout=--"
+	serviceCreateTimeRE = regexp.MustCompile(`^createTime=-(?P<created>\S+)`)
+
+	// wifiScanRE is a regular expression to match a scan request in the local log of the wifiscanner service dump.
+	// e.g. "2017-05-03T10:11:12.345 - addSingleScanRequest: ClientInfo[uid=10041,android.os.Messenger@63c1a3d],Id=3,..."
+	wifiScanRE = regexp.MustCompile(`^\s*(?P<date>\d+-\d+-\d+)T(?P<time>\d+:\d+:\d+)\.(?P<remainder>\d+)\s+-\s+` +
+		`(?P<request>\w*[Ss]can\w*):\s+ClientInfo\[uid=(?P<uid>\d+)`)
+
+	// vibrationRE is a regular expression to match a previous vibration in the vibrator service dump.
+	// e.g. "startTime: 2018-07-25 13:42:20.165, effect: OneShot{mTiming=20, mAmplitude=-1}, originalEffect: null, usageHint: 0, uid: 10077, opPkg: com.android.systemui"
+	vibrationRE = regexp.MustCompile(`^\s*startTime:\s+(?P<timestamp>\d+-\d+-\d+\s+\d+:\d+:\d+)\.(?P<remainder>\d+),\s+` +
+		`effect:\s+(?P<effect>\w+)\{(?P<params>[^}]*)\}.*?,\s+uid:\s+(?P<uid>\d+)(,\s+opPkg:\s+(?P<pkg>[^\s,]+))?`)
+
+	// vibrationTimingRE matches the timing of a one shot vibration effect, e.g. "mTiming=20".
+	vibrationTimingRE = regexp.MustCompile(`mTiming=(?P<timing>\d+)`)
+
+	// vibrationTimingsRE matches the timings of a waveform vibration effect that doesn't repeat,
+	// e.g. "mTimings=[0, 100, 50, 100], mAmplitudes=[0, 255, 0, 255], mRepeat=-1".
+	vibrationTimingsRE = regexp.MustCompile(`mTimings=\[(?P<timings>[\d,\s]*)\].*mRepeat=-1`)
+
+	// thermalTemperatureRE is a regular expression to match a temperature reported by the thermal HAL in the thermalservice dump.
+	// e.g. "Temperature{mValue=45.5, mType=3, mName=skin, mStatus=2}"
+	thermalTemperatureRE = regexp.MustCompile(`^\s*Temperature\{mValue=(?P<value>[^,]+),\s*mType=(?P<type>-?\d+),\s*` +
+		`mName=(?P<name>[^,]+),\s*mStatus=(?P<status>\d+)\}`)
+
+	// kernelLineRE is a regular expression to match the kernel version line in the header of a bug report,
+	// or the output of uname.
+	// e.g. "Kernel: Linux version 4.14.117-g5d9e1c2 (android-build@abfarm) (clang version 8.0.12) #1 SMP PREEMPT"
+	kernelLineRE = regexp.MustCompile(`^(Kernel:\s+Linux version|Linux\s+\S+)\s+(?P<version>\S+)`)
+
+	// kernelVersionRE is a regular expression to match the major.minor.patch components at the start of a kernel version.
+	kernelVersionRE = regexp.MustCompile(`^(?P<major>\d+)\.(?P<minor>\d+)\.(?P<patch>\d+)([^\d.]|$)`)
+
+	// powerProfileConstantRE is a regular expression to match a constant in the power profile dump of batterystats.
+	// e.g. "cpu.active=172.0" or "screen.on: 102.4"
+	powerProfileConstantRE = regexp.MustCompile(`^\s*(?P<name>[a-z][\w.]*)\s*[=:]\s*(?P<value>-?[\d.]+(e[-+]?\d+)?)\s*$`)
+
+	// dischargeStepRE is a regular expression to match a row of the discharge step durations table in the batterystats dump.
+	// e.g. "#0: +5m12s345ms to 57 (screen-off, power-save-off, device-idle-off)"
+	dischargeStepRE = regexp.MustCompile(`^#\d+:\s+\+(?P<duration>\S+)\s+to\s+(?P<level>\d+)` + `(\s+\((?P<modes>[^)]*)\))?`)
+
+	// batteryHealthRE is a regular expression to match the health line in the battery service dump.
+	// e.g. "  health: 2"
+	batteryHealthRE = regexp.MustCompile(`^health:\s+(?P<health>\d+)\s*$`)
+
+	// checkinVersionRE is a regular expression to match the version line at the start of the batterystats checkin.
+	// e.g. "9,0,i,vers,11,116,LMY06B,LMY06B"
+	checkinVersionRE = regexp.MustCompile(`^\d+,0,i,vers,(?P<version>\d+),`)
+
 	// sensorLineMMinusRE is a regular expression to match the sensor list line in the sensorservice dump of a bug report from MNC or before.
 	sensorLineMMinusRE = regexp.MustCompile(`(?P<sensorName>[^|]+)` + `\|` + `(?P<sensorManufacturer>[^|]+)` + `\|` +
 		`(\s*version=(?P<versionNumber>\d+)\s*\|)?` + `\s*(?P<sensorTypeString>[^|]+)` +
@@ -68,11 +154,20 @@ var (
 		`(?P<sensorName>[^|]+)` + `\s*\|` + `(?P<sensorManufacturer>[^|]+)` + `\|\s*ver:\s*` +
 		`(?P<versionNumber>\d+)` + `\s*\|\s*type:\s*` + `(?P<sensorTypeString>[^(]+)` + `\(\d+\)\s*\|`)
 
+	// sensorRegistrationRE is a regular expression to match a line in the previous registrations of the sensorservice dump.
+	// e.g. "08:18:46 + 0x0000000b pid= 2076 uid= 1000 package=com.android.server.display.AutomaticBrightnessController samplingPeriod=250000us batchingPeriod=0us"
+	sensorRegistrationRE = regexp.MustCompile(`^\s*(?P<time>\d+:\d+:\d+)\s+(?P<transition>[+-])\s+` +
+		`(?P<handle>0x[0-9A-Fa-f]+)\s+pid=\s*(?P<pid>\d+)\s+uid=\s*(?P<uid>\d+)`)
+
 	// TimeZoneRE is a regular expression to match the timezone string in a bug report.
 	TimeZoneRE = regexp.MustCompile(`^\[persist.sys.timezone\]:\s+\[` + `(?P<timezone>\S+)\]`)
 
 	// DumpstateRE is a regular expression that matches the time information from the dumpstate line at the start of a bug report.
 	DumpstateRE = regexp.MustCompile(`==\sdumpstate:\s(?P<timestamp>\d+-\d+-\d+\s\d+:\d+:\d+)`)
+
+	// totalRunTimeRE is a regular expression to match the "Total run time" line in the batterystats dump of a bug report.
+	// e.g. "Total run time: 1d 2h 3m 4s 5ms realtime, 20h 1m 2s 3ms uptime"
+	totalRunTimeRE = regexp.MustCompile(`^Total run time:\s+(?P<realtime>.+?)\s+realtime,\s+(?P<uptime>.+?)\s+uptime`)
 )
 
 // Contents returns a map of the contents of each file from the given bytes slice, with the key being the file name.
@@ -268,6 +363,172 @@ Loop:
 	return strings.Join(bsCheckin, "\n")
 }
 
+// batteryHealths are the battery health names, indexed by the health constants in android.os.BatteryManager.
+var batteryHealths = []string{"", "unknown", "good", "overheat", "dead", "over-voltage", "failure", "cold"}
+
+// BatteryHealth returns the battery health, such as "good" or "overheat", from the current state
+// in the battery service dump of a bug report.
+func BatteryHealth(bugReport string) (string, error) {
+	inBattery := false
+	for _, line := range strings.Split(bugReport, "\n") {
+		if m, result := historianutils.SubexpNames(historianutils.ServiceDumpRE, line); m {
+			inBattery = result["service"] == "battery"
+			continue
+		}
+		if !inBattery {
+			continue
+		}
+		m, result := historianutils.SubexpNames(batteryHealthRE, line)
+		if !m {
+			continue
+		}
+		h, err := strconv.Atoi(result["health"])
+		if err != nil || h < 1 || h >= len(batteryHealths) {
+			return "", fmt.Errorf("unknown battery health %q", result["health"])
+		}
+		return batteryHealths[h], nil
+	}
+	return "", errors.New("could not find battery health in bugreport")
+}
+
+// PowerProfile returns the device power profile constants in the batterystats dump of a bug report,
+// such as "cpu.active" and "screen.on", mapped to their values (in mA, or mAh for battery.capacity).
+// Constants with several values, such as the per frequency CPU constants, are skipped.
+// ErrNoPowerProfile is returned if the bug report doesn't have a power profile section.
+func PowerProfile(bugReport string) (map[string]float64, error) {
+	var profile map[string]float64
+	indent := -1
+	for _, line := range strings.Split(bugReport, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if profile == nil {
+			if trimmed == "Power Profile:" {
+				profile = make(map[string]float64)
+				indent = len(line) - len(strings.TrimLeft(line, " \t"))
+			}
+			continue
+		}
+		// The section ends at the first line that isn't indented further than the header.
+		if trimmed == "" || len(line)-len(strings.TrimLeft(line, " \t")) <= indent {
+			break
+		}
+		m, result := historianutils.SubexpNames(powerProfileConstantRE, line)
+		if !m {
+			continue
+		}
+		v, err := strconv.ParseFloat(result["value"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("power profile %q: %v", line, err)
+		}
+		profile[result["name"]] = v
+	}
+	if profile == nil {
+		return nil, ErrNoPowerProfile
+	}
+	return profile, nil
+}
+
+// DischargeStep is a row of the discharge step durations table in the batterystats dump.
+type DischargeStep struct {
+	// DurationMs is how long it took to discharge by one percent, to Level.
+	DurationMs int64
+	Level      int
+	// Screen is the screen state during the step, such as "screen-on", "screen-off" or "screen-doze",
+	// or empty if not listed.
+	Screen    string
+	PowerSave bool
+}
+
+// DischargeSteps returns the rows of the first discharge step durations table in the batterystats dump
+// of a bug report, most recent first, as listed. Tables in the daily stats, which may follow it, are not
+// included. Rows that don't match the expected format are skipped.
+func DischargeSteps(bugReport string) []DischargeStep {
+	var steps []DischargeStep
+	inTable := false
+	for _, line := range strings.Split(bugReport, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !inTable {
+			inTable = trimmed == "Discharge step durations:"
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		m, result := historianutils.SubexpNames(dischargeStepRE, trimmed)
+		if !m {
+			continue
+		}
+		ms, err := historianutils.ParseAndroidDuration(result["duration"])
+		if err != nil {
+			continue
+		}
+		level, err := strconv.Atoi(result["level"])
+		if err != nil {
+			continue
+		}
+		step := DischargeStep{DurationMs: ms, Level: level}
+		for _, mode := range strings.Split(result["modes"], ",") {
+			switch mode = strings.TrimSpace(mode); {
+			case strings.HasPrefix(mode, "screen-"):
+				step.Screen = mode
+			case mode == "power-save-on":
+				step.PowerSave = true
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// ParseKernelVersion returns the major, minor and patch components of the kernel version in the bug report,
+// e.g. 4, 14 and 117 for "4.14.117-g5d9e1c2". An error is returned if the kernel version is missing
+// or doesn't start with major.minor.patch.
+func ParseKernelVersion(bugReport string) (major, minor, patch int, err error) {
+	for _, line := range strings.Split(bugReport, "\n") {
+		m, result := historianutils.SubexpNames(kernelLineRE, strings.TrimSpace(line))
+		if !m {
+			continue
+		}
+		v := result["version"]
+		m, result = historianutils.SubexpNames(kernelVersionRE, v)
+		if !m {
+			return 0, 0, 0, fmt.Errorf("unrecognized kernel version %q", v)
+		}
+		// The components are all digits so can only fail on overflow.
+		if major, err = strconv.Atoi(result["major"]); err != nil {
+			return 0, 0, 0, err
+		}
+		if minor, err = strconv.Atoi(result["minor"]); err != nil {
+			return 0, 0, 0, err
+		}
+		if patch, err = strconv.Atoi(result["patch"]); err != nil {
+			return 0, 0, 0, err
+		}
+		return major, minor, patch, nil
+	}
+	return 0, 0, 0, errors.New("could not find kernel version in bugreport")
+}
+
+// CheckinVersion returns the report version from the batterystats checkin header of a bug report.
+// If the version is outside the range known to Battery Historian, the version is returned with
+// an error wrapping ErrUnknownCheckinVersion.
+func CheckinVersion(bugReport string) (int, error) {
+	for _, line := range strings.Split(bugReport, "\n") {
+		m, result := historianutils.SubexpNames(checkinVersionRE, line)
+		if !m {
+			continue
+		}
+		v, err := strconv.Atoi(result["version"])
+		if err != nil {
+			return 0, err
+		}
+		if v < minCheckinVersion || v > maxCheckinVersion {
+			return v, fmt.Errorf("%w: %d", ErrUnknownCheckinVersion, v)
+		}
+		return v, nil
+	}
+	return 0, errors.New("could not find checkin version in bugreport")
+}
+
 // ExtractBugReport extracts and returns only the first valid bug report data
 // in the given contents. The second returned parameter will be the determined
 // file name.
@@ -311,6 +572,369 @@ func ExtractPIDMappings(contents string) (map[string][]AppInfo, []string) {
 	return mapping, warnings
 }
 
+// ProcInfo holds the importance of a running process, as listed in the activity manager processes dump.
+type ProcInfo struct {
+	PID  string
+	UID  string
+	Name string
+	// Adj is the OOM adjustment label for the process. e.g. "fore", "vis" or "cch+5".
+	Adj string
+	// Importance is the reason given for the process's adjustment. e.g. "top-activity" or "cch-empty".
+	Importance string
+}
+
+// ExtractProcInfo returns the processes listed in the process LRU list of the activity manager processes dump.
+// Lines that don't match the expected format, or have an invalid UID, are skipped.
+func ExtractProcInfo(contents string) []ProcInfo {
+	var procs []ProcInfo
+	for _, line := range strings.Split(contents, "\n") {
+		m, result := historianutils.SubexpNames(procLRURE, line)
+		if !m {
+			continue
+		}
+		appID, err := packageutils.AppIDFromString(result["uid"])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, ProcInfo{
+			PID:        result["pid"],
+			UID:        strconv.Itoa(int(appID)),
+			Name:       result["app"],
+			Adj:        result["adj"],
+			Importance: result["importance"],
+		})
+	}
+	return procs
+}
+
+// ServiceInfo holds the details of a running service, as listed in the activity manager services dump.
+type ServiceInfo struct {
+	Package string
+	// Class is the service class as printed in the dump, which is relative to the package if it starts with ".".
+	Class string
+	// StartReason is "foreground" for a foreground service, "started" for a service started with
+	// startService, "bound" for a service that is only bound, or empty if none of these is listed.
+	StartReason string
+	// RunningMs is the time since the service was created.
+	RunningMs int64
+}
+
+// RunningServices returns the services listed in the activity manager services dump of a bug report,
+// in the order they are listed. Service lines that don't match the expected format are skipped, as
+// are the details following them.
+func RunningServices(bugReport string) []ServiceInfo {
+	var services []ServiceInfo
+	var cur *ServiceInfo
+	for _, line := range strings.Split(bugReport, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "ACTIVITY MANAGER ") || historianutils.ServiceDumpRE.MatchString(line) {
+			cur = nil
+			continue
+		}
+		if strings.HasPrefix(line, "* ServiceRecord") {
+			cur = nil
+			if m, result := historianutils.SubexpNames(serviceRecordRE, line); m {
+				services = append(services, ServiceInfo{Package: result["package"], Class: result["class"]})
+				cur = &services[len(services)-1]
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if m, result := historianutils.SubexpNames(serviceCreateTimeRE, line); m {
+			if ms, err := historianutils.ParseAndroidDuration(result["created"]); err == nil {
+				cur.RunningMs = ms
+			}
+		}
+		switch {
+		case strings.Contains(line, "isForeground=true"):
+			cur.StartReason = "foreground"
+		case strings.Contains(line, "startRequested=true") && cur.StartReason != "foreground":
+			cur.StartReason = "started"
+		case strings.HasPrefix(line, "* IntentBindRecord") && cur.StartReason == "":
+			cur.StartReason = "bound"
+		}
+	}
+	return services
+}
+
+// ForegroundServices returns an event for each service running in the foreground at the time of the
+// bug report, with the package and service class in Value, e.g. "com.spotify.music/.playback.PlaybackService".
+// The services dump only has the time since each service was created, so the events start at the create
+// time and end at the dumpstate time. Bug reports without foreground services return no events and no error.
+func ForegroundServices(bugReport string) ([]csv.Event, error) {
+	var services []ServiceInfo
+	for _, s := range RunningServices(bugReport) {
+		if s.StartReason == "foreground" {
+			services = append(services, s)
+		}
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	d, err := DumpState(bugReport)
+	if err != nil {
+		return nil, err
+	}
+	ms := d.UnixNano() / int64(time.Millisecond)
+	events := make([]csv.Event, 0, len(services))
+	for _, s := range services {
+		events = append(events, csv.Event{
+			Type:  "service",
+			Start: ms - s.RunningMs,
+			End:   ms,
+			Value: s.Package + "/" + s.Class,
+		})
+	}
+	return events, nil
+}
+
+// WifiScans returns an instant event for each wifi scan request in the wifiscanner service dump,
+// with the type of request in Value and the UID of the requesting app in Opt.
+// Back to back scans are not merged.
+func WifiScans(contents string, loc *time.Location) ([]csv.Event, []error) {
+	var events []csv.Event
+	var errs []error
+	for _, line := range strings.Split(contents, "\n") {
+		m, result := historianutils.SubexpNames(wifiScanRE, line)
+		if !m {
+			continue
+		}
+		ms, err := TimeStampToMs(result["date"]+" "+result["time"], result["remainder"], loc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("wifi scan %q: %v", line, err))
+			continue
+		}
+		events = append(events, csv.Event{
+			Type:  "service",
+			Start: ms,
+			End:   ms,
+			Value: result["request"],
+			Opt:   result["uid"],
+		})
+	}
+	return events, errs
+}
+
+// SensorRegistrations returns an event for each sensor registration in the previous registrations of
+// the sensorservice dump, with the sensor name (or handle if unknown) in Value and the UID of the
+// requesting app in Opt. Each sensor has its own events, so concurrent use of different sensors is
+// kept separate. Registrations still active at the end of the list end at the dumpstate time, and
+// unregistrations for registrations before the start of the list are ignored.
+// The registrations only have the time of day, so the dates are inferred backwards from the dumpstate time.
+func SensorRegistrations(bugReport string) ([]csv.Event, []error) {
+	type registration struct {
+		result map[string]string
+		line   string
+	}
+	var regs []registration
+	for _, line := range strings.Split(bugReport, "\n") {
+		if m, result := historianutils.SubexpNames(sensorRegistrationRE, line); m {
+			regs = append(regs, registration{result, line})
+		}
+	}
+	if len(regs) == 0 {
+		return nil, nil
+	}
+	d, err := DumpState(bugReport)
+	if err != nil {
+		return nil, []error{err}
+	}
+	sensors, err := extractSensorInfo(bugReport)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	// Assign dates starting from the most recent registration, going back a day each time the time of
+	// day wraps around.
+	var errs []error
+	times := make([]int64, len(regs))
+	day := d
+	next := d
+	for i := len(regs) - 1; i >= 0; i-- {
+		tod, err := time.Parse("15:04:05", regs[i].result["time"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sensor registration %q: %v", regs[i].line, err))
+			times[i] = -1
+			continue
+		}
+		t := time.Date(day.Year(), day.Month(), day.Day(), tod.Hour(), tod.Minute(), tod.Second(), 0, d.Location())
+		if t.After(next) {
+			day = day.AddDate(0, 0, -1)
+			t = t.AddDate(0, 0, -1)
+		}
+		next = t
+		times[i] = t.UnixNano() / int64(time.Millisecond)
+	}
+
+	var events []csv.Event
+	active := make(map[string]int)
+	for i, r := range regs {
+		if times[i] < 0 {
+			continue
+		}
+		key := r.result["handle"] + "/" + r.result["pid"] + "/" + r.result["uid"]
+		if r.result["transition"] == "-" {
+			if j, ok := active[key]; ok {
+				events[j].End = times[i]
+				delete(active, key)
+			}
+			continue
+		}
+		if _, ok := active[key]; ok {
+			// Already registered, such as when the sampling rate is changed.
+			continue
+		}
+		value := r.result["handle"]
+		if n, err := strconv.ParseInt(value, 0, 32); err == nil {
+			if s, ok := sensors[int32(n)]; ok {
+				value = strings.TrimSpace(s.Name)
+			}
+		}
+		active[key] = len(events)
+		events = append(events, csv.Event{
+			Type:  "service",
+			Start: times[i],
+			End:   -1,
+			Value: value,
+			Opt:   r.result["uid"],
+		})
+	}
+	for _, j := range active {
+		events[j].End = d.UnixNano() / int64(time.Millisecond)
+	}
+	return events, errs
+}
+
+// Vibrations returns an event for each vibration listed in the vibrator service dump, with the
+// effect type in Value, the UID of the requesting app in Opt and its package in AppName if known.
+// Events last for the duration of the effect, or are instant events if it is unknown, such as for
+// prebaked and repeating effects. Back to back vibrations are not merged.
+func Vibrations(contents string, loc *time.Location) ([]csv.Event, []error) {
+	var events []csv.Event
+	var errs []error
+	for _, line := range strings.Split(contents, "\n") {
+		m, result := historianutils.SubexpNames(vibrationRE, line)
+		if !m {
+			continue
+		}
+		ms, err := TimeStampToMs(result["timestamp"], result["remainder"], loc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vibration %q: %v", line, err))
+			continue
+		}
+		var durMs int64
+		if m, t := historianutils.SubexpNames(vibrationTimingRE, result["params"]); m {
+			durMs, err = strconv.ParseInt(t["timing"], 10, 64)
+		} else if m, t := historianutils.SubexpNames(vibrationTimingsRE, result["params"]); m {
+			for _, v := range strings.Split(t["timings"], ",") {
+				var d int64
+				if d, err = strconv.ParseInt(strings.TrimSpace(v), 10, 64); err != nil {
+					break
+				}
+				durMs += d
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vibration %q: %v", line, err))
+			continue
+		}
+		events = append(events, csv.Event{
+			Type:    "service",
+			Start:   ms,
+			End:     ms + durMs,
+			Value:   result["effect"],
+			Opt:     result["uid"],
+			AppName: result["pkg"],
+		})
+	}
+	return events, errs
+}
+
+// thermalSeverities are the throttling severities defined in android.os.Temperature, indexed by status.
+var thermalSeverities = []string{"NONE", "LIGHT", "MODERATE", "SEVERE", "CRITICAL", "EMERGENCY", "SHUTDOWN"}
+
+// ThermalStatus returns an event for each thermal zone that was being throttled at the time of the bug report,
+// with the zone and severity in Value, e.g. "skin:SEVERE".
+// The thermalservice dump only has the current status of each zone, so the events start and end at the dumpstate time.
+// Bug reports without thermal data return no events and no error.
+func ThermalStatus(bugReport string) ([]csv.Event, error) {
+	var events []csv.Event
+	inHAL := false
+	for _, line := range strings.Split(bugReport, "\n") {
+		if strings.TrimSpace(line) == "Current temperatures from HAL:" {
+			inHAL = true
+			continue
+		}
+		if !inHAL {
+			continue
+		}
+		m, result := historianutils.SubexpNames(thermalTemperatureRE, line)
+		if !m {
+			// The temperatures are listed on consecutive lines.
+			inHAL = false
+			continue
+		}
+		status, err := strconv.Atoi(result["status"])
+		if err != nil {
+			return nil, fmt.Errorf("thermal status %q: %v", line, err)
+		}
+		if status == 0 {
+			continue
+		}
+		severity := result["status"]
+		if status < len(thermalSeverities) {
+			severity = thermalSeverities[status]
+		}
+		events = append(events, csv.Event{
+			Type:  "service",
+			Value: result["name"] + ":" + severity,
+		})
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	d, err := DumpState(bugReport)
+	if err != nil {
+		return nil, err
+	}
+	ms := d.UnixNano() / int64(time.Millisecond)
+	for i := range events {
+		events[i].Start = ms
+		events[i].End = ms
+	}
+	return events, nil
+}
+
+// PackageVersion holds the version of an installed package.
+type PackageVersion struct {
+	Name        string
+	VersionCode int32
+	VersionName string
+}
+
+// InstalledPackages returns the name and version of each package in the package service dump of a
+// bug report, sorted by name. Packages without any version information are skipped.
+func InstalledPackages(bugReport string) []PackageVersion {
+	pkgs, _ := packageutils.ExtractAppsFromBugReport(bugReport)
+	var res []PackageVersion
+	for _, p := range pkgs {
+		if p.GetPkgName() == "" || (p.VersionCode == nil && p.VersionName == nil) {
+			continue
+		}
+		res = append(res, PackageVersion{
+			Name:        p.GetPkgName(),
+			VersionCode: p.GetVersionCode(),
+			VersionName: p.GetVersionName(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
 // TimeStampToMs converts a timestamp in the TimeLayout format, combined with the fraction of a second, to a unix ms timestamp based on the location.
 func TimeStampToMs(timestamp, remainder string, loc *time.Location) (int64, error) {
 	if loc == nil {
@@ -368,3 +992,28 @@ func DumpState(contents string) (time.Time, error) {
 	}
 	return time.Time{}, errors.New("could not find dumpstate information in bugreport")
 }
+
+// UptimeSleep returns the total time the device was awake (uptime) and the total time spent in
+// deep sleep, as read from the first "Total run time" line in the batterystats dump of a bug report.
+// Deep sleep time is the realtime not accounted for by the uptime.
+func UptimeSleep(bugReport string) (uptimeMs, sleepMs int64, err error) {
+	for _, line := range strings.Split(bugReport, "\n") {
+		m, result := historianutils.SubexpNames(totalRunTimeRE, line)
+		if !m {
+			continue
+		}
+		realtimeMs, err := historianutils.ParseAndroidDuration(result["realtime"])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid total realtime %q: %v", result["realtime"], err)
+		}
+		uptimeMs, err := historianutils.ParseAndroidDuration(result["uptime"])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid total uptime %q: %v", result["uptime"], err)
+		}
+		if uptimeMs > realtimeMs {
+			return 0, 0, fmt.Errorf("total uptime (%dms) greater than total realtime (%dms)", uptimeMs, realtimeMs)
+		}
+		return uptimeMs, realtimeMs - uptimeMs, nil
+	}
+	return 0, 0, errors.New("could not find total run time in bugreport")
+}
@@ -20,6 +20,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/chenjiacun35/battery-historian/csv"
 )
 
 // Tests the conversion of times in the format: "2015-05-28 19:50:27.636636" to unix time in ms.
@@ -418,3 +420,551 @@ func TestExtractPIDMappings(t *testing.T) {
 		}
 	}
 }
+
+// Tests the extracting of process importance from the activity manager processes dump.
+func TestExtractProcInfo(t *testing.T) {
+	input := strings.Join([]string{
+		`ACTIVITY MANAGER RUNNING PROCESSES (dumpsys activity processes)`,
+		`  PID mappings:`,
+		`    PID #1604: ProcessRecord{9b4f852 1604:system/1000}`,
+		`  Process LRU list (sorted by oom_adj, 4 total, non-act at 2, non-svc at 2):`,
+		`    PERS #3: sys   F/ /P  trm: 0 1604:system/1000 (fixed)`,
+		`    Proc #2: fore  T/A/T  trm: 0 3178:com.google.android.apps.nexuslauncher/u0a51 (top-activity)`,
+		`    Proc #1: prcp  F/S/FGS  trm: 0 2750:com.google.android.gms.persistent/u0a12 (fg-service)`,
+		`    Proc # 0: cch+5 B/ /CE trm: 0 10822:com.android.chrome/u0a79 (cch-empty)`,
+		`    Proc #9: fore  T/A/T  trm: 0 3178:com.example.bad/notauid (top-activity)`,
+		`    Proc #8: malformed line`,
+	}, "\n")
+	want := []ProcInfo{
+		{PID: "1604", UID: "1000", Name: "system", Adj: "sys", Importance: "fixed"},
+		{PID: "3178", UID: "10051", Name: "com.google.android.apps.nexuslauncher", Adj: "fore", Importance: "top-activity"},
+		{PID: "2750", UID: "10012", Name: "com.google.android.gms.persistent", Adj: "prcp", Importance: "fg-service"},
+		{PID: "10822", UID: "10079", Name: "com.android.chrome", Adj: "cch+5", Importance: "cch-empty"},
+	}
+	if got := ExtractProcInfo(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractProcInfo(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// TestRunningServices tests extracting the running services from the activity manager services dump.
+func TestRunningServices(t *testing.T) {
+	input := strings.Join([]string{
+		`DUMP OF SERVICE activity:`,
+		`ACTIVITY MANAGER SERVICES (dumpsys activity services)`,
+		`  User 0 active services:`,
+		`  * ServiceRecord{7f9a3b1 u0 com.google.android.gms/.chimera.PersistentIntentOperationService}`,
+		`    intent={cmp=com.google.android.gms/.chimera.PersistentIntentOperationService}`,
+		`    packageName=com.google.android.gms`,
+		`    createTime=-1h23m4s567ms startingBgTimeout=--`,
+		`    lastActivity=-5m2s100ms restartTime=-1h23m4s567ms createdFromFg=true`,
+		`    startRequested=true delayedStop=false stopIfKilled=false callStart=true lastStartId=3`,
+		`  * ServiceRecord{2c1d0e4 u0 com.spotify.music/.playback.PlaybackService}`,
+		`    isForeground=true foregroundId=1 foregroundNoti=Notification(channel=playback)`,
+		`    createTime=-10m0s0ms startingBgTimeout=--`,
+		`    startRequested=true delayedStop=false stopIfKilled=false callStart=true lastStartId=1`,
+		`  * ServiceRecord{malformed}`,
+		`    createTime=-1s0ms startingBgTimeout=--`,
+		`  * ServiceRecord{5e6f7a8 u0 com.android.systemui/.keyguard.KeyguardService}`,
+		`    createTime=-bad startingBgTimeout=--`,
+		`    * IntentBindRecord{3b4c5d6 CREATE}:`,
+		``,
+		`ACTIVITY MANAGER CONTENT PROVIDERS (dumpsys activity providers)`,
+		`    createTime=-2s0ms`,
+	}, "\n")
+	want := []ServiceInfo{
+		{Package: "com.google.android.gms", Class: ".chimera.PersistentIntentOperationService", StartReason: "started", RunningMs: 4984567},
+		{Package: "com.spotify.music", Class: ".playback.PlaybackService", StartReason: "foreground", RunningMs: 600000},
+		{Package: "com.android.systemui", Class: ".keyguard.KeyguardService", StartReason: "bound"},
+	}
+	if got := RunningServices(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("RunningServices(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// TestForegroundServices tests the foreground service events built from the activity manager services dump.
+func TestForegroundServices(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  []csv.Event
+	}{
+		{
+			desc: "foreground and background services",
+			input: strings.Join([]string{
+				`== dumpstate: 2017-05-03 10:11:12`,
+				`[persist.sys.timezone]: [UTC]`,
+				`ACTIVITY MANAGER SERVICES (dumpsys activity services)`,
+				`  User 0 active services:`,
+				`  * ServiceRecord{7f9a3b1 u0 com.google.android.gms/.chimera.PersistentIntentOperationService}`,
+				`    createTime=-1h23m4s567ms startingBgTimeout=--`,
+				`    startRequested=true delayedStop=false stopIfKilled=false callStart=true lastStartId=3`,
+				`  * ServiceRecord{2c1d0e4 u0 com.spotify.music/.playback.PlaybackService}`,
+				`    isForeground=true foregroundId=1 foregroundNoti=Notification(channel=playback)`,
+				`    createTime=-10m0s0ms startingBgTimeout=--`,
+			}, "\n"),
+			want: []csv.Event{
+				{Type: "service", Start: 1493805672000, End: 1493806272000, Value: "com.spotify.music/.playback.PlaybackService"},
+			},
+		},
+		{
+			desc: "no foreground services",
+			input: strings.Join([]string{
+				`== dumpstate: 2017-05-03 10:11:12`,
+				`  * ServiceRecord{7f9a3b1 u0 com.google.android.gms/.chimera.PersistentIntentOperationService}`,
+				`    startRequested=true delayedStop=false stopIfKilled=false callStart=true lastStartId=3`,
+			}, "\n"),
+		},
+	}
+	for _, test := range tests {
+		got, err := ForegroundServices(test.input)
+		if err != nil {
+			t.Errorf("%v: ForegroundServices() returned error: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: ForegroundServices():\n  got: %v\n  want: %v", test.desc, got, test.want)
+		}
+	}
+}
+
+// TestDischargeSteps tests extracting the discharge step durations table from the batterystats dump.
+func TestDischargeSteps(t *testing.T) {
+	input := strings.Join([]string{
+		`DUMP OF SERVICE batterystats:`,
+		`Discharge step durations:`,
+		`  #0: +5m12s345ms to 57 (screen-off, power-save-off, device-idle-off)`,
+		`  #1: +1m30s0ms to 58 (screen-on, power-save-on, device-idle-off)`,
+		`  #2: +bad to 59 (screen-on)`,
+		`  #3: +2m0s0ms to 60`,
+		`  Estimated discharge time remaining: +4h10m0s0ms`,
+		`Daily stats:`,
+		`  Current start time: 2015-09-27-00-00-00`,
+		`    Discharge step durations:`,
+		`      #0: +10m0s0ms to 90 (screen-off)`,
+	}, "\n")
+	want := []DischargeStep{
+		{DurationMs: 312345, Level: 57, Screen: "screen-off"},
+		{DurationMs: 90000, Level: 58, Screen: "screen-on", PowerSave: true},
+		{DurationMs: 120000, Level: 60},
+	}
+	if got := DischargeSteps(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("DischargeSteps(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// Tests the extracting of installed package versions from the package service dump.
+func TestInstalledPackages(t *testing.T) {
+	input := strings.Join([]string{
+		"DUMP OF SERVICE package:",
+		"Database versions:",
+		"  SDK Version: internal=22 external=22",
+		"Packages:",
+		"  Package [com.google.android.youtube] (1cce8bc):",
+		"    userId=10089 gids=[3003, 1028, 1015]",
+		"    versionCode=60013301 targetSdk=21",
+		"    versionName=6.0.13",
+		"  Package [com.google.android.gms] (24f5913f):",
+		"    userId=10012 gids=[]",
+		"    versionCode=6759430 targetSdk=21",
+		"    versionName=6.7.59",
+		"  Package [com.example.noversion] (2a1b6c7):",
+		"    userId=10100 gids=[]",
+		"    versionCode=notanumber targetSdk=21",
+		"Hidden system packages:",
+		"  Package [com.google.android.youtube] (3a2c1d0):",
+		"    versionCode=1 targetSdk=21",
+	}, "\n")
+	want := []PackageVersion{
+		{Name: "com.google.android.gms", VersionCode: 6759430, VersionName: "6.7.59"},
+		{Name: "com.google.android.youtube", VersionCode: 60013301, VersionName: "6.0.13"},
+	}
+	if got := InstalledPackages(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("InstalledPackages(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// Tests the extracting of wifi scan requests from the wifiscanner service dump.
+func TestWifiScans(t *testing.T) {
+	input := strings.Join([]string{
+		`DUMP OF SERVICE wifiscanner:`,
+		`2017-05-03T10:11:12.345 - addSingleScanRequest: ClientInfo[uid=10041,android.os.Messenger@63c1a3d],Id=3,WorkSource{10041}`,
+		`2017-05-03T10:11:12.400 - addSingleScanRequest: ClientInfo[uid=10041,android.os.Messenger@63c1a3d],Id=4,WorkSource{10041}`,
+		`2017-05-03T10:11:13.467 - Successfully started single scan`,
+		`2017-05-03T10:15:02.009 - addScanRequest: ClientInfo[uid=1000,android.os.Messenger@2a1b6c7],Id=5`,
+		`Latest scan results:`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "service", Start: 1493806272345, End: 1493806272345, Value: "addSingleScanRequest", Opt: "10041"},
+		{Type: "service", Start: 1493806272400, End: 1493806272400, Value: "addSingleScanRequest", Opt: "10041"},
+		{Type: "service", Start: 1493806502009, End: 1493806502009, Value: "addScanRequest", Opt: "1000"},
+	}
+	got, errs := WifiScans(input, time.UTC)
+	if len(errs) > 0 {
+		t.Errorf("WifiScans(%v) unexpected errors: %v", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WifiScans(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// Tests the extracting of sensor usage spans from the sensorservice dump.
+func TestSensorRegistrations(t *testing.T) {
+	input := strings.Join([]string{
+		`== dumpstate: 2017-05-03 00:30:00`,
+		`[persist.sys.timezone]: [UTC]`,
+		`DUMP OF SERVICE sensorservice:`,
+		`Sensor List:`,
+		`0x00000001) BMI160 accelerometer      | Bosch           | ver: 1 | type: android.sensor.accelerometer(1) | perm: n/a`,
+		`	 continuous | minRate=1.00Hz | maxRate=400.00Hz | FIFO (max,reserved) = (5440, 0) events | non-wakeUp | |`,
+		`0x00000002) BMI160 gyroscope          | Bosch           | ver: 1 | type: android.sensor.gyroscope(4) | perm: n/a`,
+		`	 continuous | minRate=1.00Hz | maxRate=400.00Hz | FIFO (max,reserved) = (5440, 0) events | non-wakeUp | |`,
+		`Previous Registrations:`,
+		`23:59:50 - 0x00000002 pid=  3001 uid=10041 package=com.example.earlier`,
+		`23:59:55 + 0x00000001 pid=  2345 uid=10041 package=com.google.android.gms samplingPeriod=200000us batchingPeriod=0us`,
+		`00:00:05 + 0x00000002 pid=  4567 uid=10050 package=com.example.game samplingPeriod=5000us batchingPeriod=0us`,
+		`00:00:10 - 0x00000001 pid=  2345 uid=10041 package=com.google.android.gms`,
+		`00:10:00 + 0x0000000b pid=  1234 uid= 1000 package=com.android.server.display.AutomaticBrightnessController samplingPeriod=250000us batchingPeriod=0us`,
+		`00:20:00 - 0x0000000b pid=  1234 uid= 1000 package=com.android.server.display.AutomaticBrightnessController`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "service", Start: 1493769595000, End: 1493769610000, Value: "BMI160 accelerometer", Opt: "10041"},
+		{Type: "service", Start: 1493769605000, End: 1493771400000, Value: "BMI160 gyroscope", Opt: "10050"},
+		{Type: "service", Start: 1493770200000, End: 1493770800000, Value: "0x0000000b", Opt: "1000"},
+	}
+	got, errs := SensorRegistrations(input)
+	if len(errs) > 0 {
+		t.Errorf("SensorRegistrations(%v) unexpected errors: %v", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SensorRegistrations(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+
+	if got, errs := SensorRegistrations(`== dumpstate: 2017-05-03 00:30:00`); got != nil || errs != nil {
+		t.Errorf("SensorRegistrations() with no registrations = %v, %v, want nil, nil", got, errs)
+	}
+}
+
+// Tests the extracting of vibrations from the vibrator service dump.
+func TestVibrations(t *testing.T) {
+	input := strings.Join([]string{
+		`DUMP OF SERVICE vibrator:`,
+		`Vibrator Service:`,
+		`  mCurrentVibration=null`,
+		`  mLowPowerMode=false`,
+		`  Previous vibrations:`,
+		`    startTime: 2018-07-25 13:42:20.165, effect: OneShot{mTiming=20, mAmplitude=-1}, originalEffect: null, usageHint: 0, uid: 10077, opPkg: com.android.systemui`,
+		`    startTime: 2018-07-25 13:42:20.300, effect: OneShot{mTiming=20, mAmplitude=-1}, originalEffect: null, usageHint: 0, uid: 10077, opPkg: com.android.systemui`,
+		`    startTime: 2018-07-25 13:45:01.002, effect: Waveform{mTimings=[0, 100, 50, 100], mAmplitudes=[0, 255, 0, 255], mRepeat=-1}, originalEffect: null, usageHint: 6, uid: 10041, opPkg: com.google.android.gm`,
+		`    startTime: 2018-07-25 13:46:10.500, effect: Prebaked{mEffectId=0, mEffectStrength=1, mFallback=true}, originalEffect: null, usageHint: 0, uid: 1000`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "service", Start: 1532526140165, End: 1532526140185, Value: "OneShot", Opt: "10077", AppName: "com.android.systemui"},
+		{Type: "service", Start: 1532526140300, End: 1532526140320, Value: "OneShot", Opt: "10077", AppName: "com.android.systemui"},
+		{Type: "service", Start: 1532526301002, End: 1532526301252, Value: "Waveform", Opt: "10041", AppName: "com.google.android.gm"},
+		{Type: "service", Start: 1532526370500, End: 1532526370500, Value: "Prebaked", Opt: "1000"},
+	}
+	got, errs := Vibrations(input, time.UTC)
+	if len(errs) > 0 {
+		t.Errorf("Vibrations(%v) unexpected errors: %v", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Vibrations(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+}
+
+// Tests the extracting of throttled thermal zones from the thermalservice dump.
+func TestThermalStatus(t *testing.T) {
+	thermalDump := strings.Join([]string{
+		`== dumpstate: 2017-05-03 10:11:12`,
+		`[persist.sys.timezone]: [UTC]`,
+		`DUMP OF SERVICE thermalservice:`,
+		`IsStatusOverride: false`,
+		`ThermalEventListeners:`,
+		`	callbacks: 1`,
+		`Current temperatures from HAL:`,
+		`	Temperature{mValue=38.2, mType=2, mName=battery, mStatus=0}`,
+		`	Temperature{mValue=45.5, mType=3, mName=skin, mStatus=2}`,
+		`	Temperature{mValue=95.0, mType=0, mName=cpu0, mStatus=4}`,
+		`Current cooling devices from HAL:`,
+		`	CoolingDevice{mValue=1, mType=2, mName=cpu0}`,
+		`Temperature static thresholds from HAL:`,
+		`	Temperature{mValue=99.0, mType=0, mName=cpu1, mStatus=3}`,
+	}, "\n")
+
+	tests := []struct {
+		desc  string
+		input string
+		want  []csv.Event
+	}{
+		{
+			desc:  "throttled zones",
+			input: thermalDump,
+			want: []csv.Event{
+				{Type: "service", Start: 1493806272000, End: 1493806272000, Value: "skin:MODERATE"},
+				{Type: "service", Start: 1493806272000, End: 1493806272000, Value: "cpu0:CRITICAL"},
+			},
+		},
+		{
+			desc: "no throttling",
+			input: strings.Join([]string{
+				`== dumpstate: 2017-05-03 10:11:12`,
+				`Current temperatures from HAL:`,
+				`	Temperature{mValue=38.2, mType=2, mName=battery, mStatus=0}`,
+			}, "\n"),
+		},
+		{
+			desc:  "no thermal data",
+			input: `== dumpstate: 2017-05-03 10:11:12`,
+		},
+	}
+	for _, test := range tests {
+		got, err := ThermalStatus(test.input)
+		if err != nil {
+			t.Errorf("%v: ThermalStatus(%v) unexpected error: %v", test.desc, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: ThermalStatus(%v):\n  got: %v\n  want: %v", test.desc, test.input, got, test.want)
+		}
+	}
+}
+
+// Tests the extracting of total uptime and deep sleep time from a bug report.
+func TestUptimeSleep(t *testing.T) {
+	tests := []struct {
+		desc       string
+		input      []string
+		wantUptime int64
+		wantSleep  int64
+		wantErr    error
+	}{
+		{
+			desc: "Both values present",
+			input: []string{
+				`DUMP OF SERVICE batterystats:`,
+				`Battery History (2% used, 5980 used of 256KB, 45 strings using 2592):`,
+				`...`,
+				`Statistics since last charge:`,
+				`  System starts: 0, currently on battery: true`,
+				`  Time on battery: 1h 2m 3s 0ms (100.0%) realtime, 30m 0s 0ms (48.4%) uptime`,
+				`  Total run time: 1d 2h 0m 0s 500ms realtime, 20h 0m 0s 0ms uptime`,
+				`Statistics since last unplugged:`,
+				`  Total run time: 1h 0m 0s 0ms realtime, 1h 0m 0s 0ms uptime`,
+			},
+			wantUptime: 20 * 3600 * 1000,
+			wantSleep:  6*3600*1000 + 500,
+		},
+		{
+			desc: "Missing total run time",
+			input: []string{
+				`DUMP OF SERVICE batterystats:`,
+				`Statistics since last charge:`,
+				`  System starts: 0, currently on battery: true`,
+			},
+			wantErr: errors.New("could not find total run time in bugreport"),
+		},
+	}
+	for _, test := range tests {
+		uptime, sleep, err := UptimeSleep(strings.Join(test.input, "\n"))
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("%v: UptimeSleep(%v)\n got err: %v\n want err: %v", test.desc, test.input, err, test.wantErr)
+		}
+		if uptime != test.wantUptime || sleep != test.wantSleep {
+			t.Errorf("%v: UptimeSleep(%v)\n got: %v, %v\n want: %v, %v", test.desc, test.input, uptime, sleep, test.wantUptime, test.wantSleep)
+		}
+	}
+}
+
+// Tests the extracting of the checkin version from the batterystats checkin header.
+func TestCheckinVersion(t *testing.T) {
+	tests := []struct {
+		desc        string
+		input       []string
+		want        int
+		wantUnknown bool
+		wantErr     bool
+	}{
+		{
+			desc: "Known version",
+			input: []string{
+				`------ CHECKIN BATTERYSTATS (dumpsys batterystats -c) ------`,
+				`9,0,i,vers,17,150,NRD90M,NRD90M`,
+				`9,0,i,uid,1000,android`,
+			},
+			want: 17,
+		},
+		{
+			desc: "Unknown version",
+			input: []string{
+				`9,0,i,vers,35,214,UP1A,UP1A`,
+			},
+			want:        35,
+			wantUnknown: true,
+			wantErr:     true,
+		},
+		{
+			desc: "Missing header",
+			input: []string{
+				`9,0,i,uid,1000,android`,
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := CheckinVersion(strings.Join(test.input, "\n"))
+		if got != test.want {
+			t.Errorf("%v: CheckinVersion(%v) = %d, want %d", test.desc, test.input, got, test.want)
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: CheckinVersion(%v) got err: %v, want err: %v", test.desc, test.input, err, test.wantErr)
+		}
+		if errors.Is(err, ErrUnknownCheckinVersion) != test.wantUnknown {
+			t.Errorf("%v: CheckinVersion(%v) got err: %v, want ErrUnknownCheckinVersion: %v", test.desc, test.input, err, test.wantUnknown)
+		}
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		desc                string
+		input               []string
+		major, minor, patch int
+		wantErr             bool
+	}{
+		{
+			desc: "Typical kernel line",
+			input: []string{
+				`Build fingerprint: 'google/coral/coral:10/QQ1A.200105.002/6031802:user/release-keys'`,
+				`Kernel: Linux version 4.14.117-g5d9e1c2 (android-build@abfarm-us-west1-c-0024) (clang version 8.0.12) #1 SMP PREEMPT Thu Nov 14 21:46:43 UTC 2019`,
+				`Command line: androidboot.hardware=coral`,
+			},
+			major: 4,
+			minor: 14,
+			patch: 117,
+		},
+		{
+			desc: "uname output",
+			input: []string{
+				`------ KERNEL VERSION (uname -a) ------`,
+				`Linux localhost 3.18.31-perf-g0b1d7e9 #1 SMP PREEMPT Tue Jan 3 18:19:18 2017 aarch64`,
+			},
+			major: 3,
+			minor: 18,
+			patch: 31,
+		},
+		{
+			desc: "Odd vendor string",
+			input: []string{
+				`Kernel: Linux version vendor-kernel-r5 (builder@vendor) #1 SMP PREEMPT`,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Missing kernel line",
+			input: []string{
+				`Build fingerprint: 'google/coral/coral:10/QQ1A.200105.002/6031802:user/release-keys'`,
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		input := strings.Join(test.input, "\n")
+		major, minor, patch, err := ParseKernelVersion(input)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: ParseKernelVersion(%v) got err: %v, want err: %v", test.desc, input, err, test.wantErr)
+			continue
+		}
+		if major != test.major || minor != test.minor || patch != test.patch {
+			t.Errorf("%v: ParseKernelVersion(%v) = %d.%d.%d, want %d.%d.%d", test.desc, input, major, minor, patch, test.major, test.minor, test.patch)
+		}
+	}
+}
+
+func TestPowerProfile(t *testing.T) {
+	input := strings.Join([]string{
+		`DUMP OF SERVICE batterystats:`,
+		`  Power Profile:`,
+		`    battery.capacity=3000.0`,
+		`    cpu.active=172.0`,
+		`    cpu.idle: 3.5`,
+		`    cpu.core_speeds.cluster0=[300000, 576000, 748800]`,
+		`    screen.on=102.4`,
+		`    screen.full=406.0`,
+		`    wifi.on=0.5`,
+		`    radio.active=220`,
+		`  Per-PID Stats:`,
+		`    wifi.off=1.0`,
+	}, "\n")
+	want := map[string]float64{
+		"battery.capacity": 3000,
+		"cpu.active":       172,
+		"cpu.idle":         3.5,
+		"screen.on":        102.4,
+		"screen.full":      406,
+		"wifi.on":          0.5,
+		"radio.active":     220,
+	}
+	got, err := PowerProfile(input)
+	if err != nil {
+		t.Fatalf("PowerProfile(%v) unexpected error: %v", input, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PowerProfile(%v):\n  got: %v\n  want: %v", input, got, want)
+	}
+
+	if _, err := PowerProfile(`DUMP OF SERVICE batterystats:`); err != ErrNoPowerProfile {
+		t.Errorf("PowerProfile() with no power profile got err: %v, want: %v", err, ErrNoPowerProfile)
+	}
+}
+
+func TestBatteryHealth(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   []string
+		want    string
+		wantErr bool
+	}{
+		{
+			desc: "Overheat",
+			input: []string{
+				`DUMP OF SERVICE batteryproperties:`,
+				`  health: 2`,
+				`DUMP OF SERVICE battery:`,
+				`Current Battery Service state:`,
+				`  AC powered: false`,
+				`  status: 3`,
+				`  health: 3`,
+				`  present: true`,
+				`  level: 85`,
+				`  voltage: 4173`,
+				`  temperature: 462`,
+			},
+			want: "overheat",
+		},
+		{
+			desc: "Unknown health constant",
+			input: []string{
+				`DUMP OF SERVICE battery:`,
+				`  health: 42`,
+			},
+			wantErr: true,
+		},
+		{
+			desc: "Missing battery service",
+			input: []string{
+				`DUMP OF SERVICE batterystats:`,
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		input := strings.Join(test.input, "\n")
+		got, err := BatteryHealth(input)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: BatteryHealth(%v) got err: %v, want err: %v", test.desc, input, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("%v: BatteryHealth(%v) = %q, want %q", test.desc, input, got, test.want)
+		}
+	}
+}
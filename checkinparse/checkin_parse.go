@@ -16,6 +16,7 @@
 package checkinparse
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -44,6 +45,8 @@ const (
 	// Current range of supported/expected checkin versions.
 	minParseReportVersion = 11
 	maxParseReportVersion = 21
+	// checkinSection is the name of the checkin section in parse diagnostics.
+	checkinSection = "batterystats checkin"
 )
 
 // Possible battery stats categories generated by on device java code.
@@ -481,6 +484,26 @@ func SortByCount(items []*WakelockInfo) {
 // ParseBatteryStats parses the aggregated battery stats in checkin report
 // according to frameworks/base/core/java/android/os/BatteryStats.java.
 func ParseBatteryStats(pc checkinutil.Counter, cr *checkinutil.BatteryReport, pkgs []*usagepb.PackageInfo) (*bspb.BatteryStats, []string, []error) {
+	return ParseBatteryStatsContext(context.Background(), pc, cr, pkgs)
+}
+
+// ParseBatteryStatsContext is the same as ParseBatteryStats, but gives up with the context's error
+// if the context is done before all the checkin lines are parsed.
+func ParseBatteryStatsContext(ctx context.Context, pc checkinutil.Counter, cr *checkinutil.BatteryReport, pkgs []*usagepb.PackageInfo) (*bspb.BatteryStats, []string, []error) {
+	return parseBatteryStats(ctx, pc, cr, pkgs, false)
+}
+
+// ParseBatteryStatsPartial is the same as ParseBatteryStatsContext, but makes a best effort to parse
+// the report: checkin lines that can't be parsed are skipped rather than failing the whole report, and
+// the stats parsed from the other lines are returned. The error for each skipped line is a
+// *historianutils.ParseError identifying the line.
+func ParseBatteryStatsPartial(ctx context.Context, pc checkinutil.Counter, cr *checkinutil.BatteryReport, pkgs []*usagepb.PackageInfo) (*bspb.BatteryStats, []string, []error) {
+	return parseBatteryStats(ctx, pc, cr, pkgs, true)
+}
+
+// parseBatteryStats parses the checkin report, skipping lines that can't be parsed if partial is
+// true, and otherwise failing on the first such line.
+func parseBatteryStats(ctx context.Context, pc checkinutil.Counter, cr *checkinutil.BatteryReport, pkgs []*usagepb.PackageInfo, partial bool) (*bspb.BatteryStats, []string, []error) {
 	// Support a single version and single aggregation type in a checkin report.
 	var aggregationType bspb.BatteryStats_AggregationType
 	var allAppComputedPowerMah float32
@@ -494,13 +517,23 @@ func ParseBatteryStats(pc checkinutil.Counter, cr *checkinutil.BatteryReport, pk
 	if len(errs) > 0 {
 		return nil, warnings, errs
 	}
-	for _, r := range cr.RawBatteryStats {
+	for i, r := range cr.RawBatteryStats {
+		if err := ctx.Err(); err != nil {
+			return nil, warnings, append(errs, fmt.Errorf("stopped parsing battery stats: %v", err))
+		}
+		// lineErr returns the error for the line, identifying it if parsing partially.
+		lineErr := func(err error) error {
+			if !partial {
+				return err
+			}
+			return historianutils.NewParseError(checkinSection, i+1, strings.Join(r, ","), err)
+		}
 		var rawUID int32
 		var rawAggregationType, section string
 		// The first element in r is '9', which used to be the report version but is now just there as a legacy field.
 		remaining, err := parseSlice(pc, "All", r[1:], &rawUID, &rawAggregationType, &section)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("error parsing entire line: %v", err))
+			errs = append(errs, lineErr(fmt.Errorf("error parsing entire line: %v", err)))
 			continue
 		}
 
@@ -529,7 +562,10 @@ func ParseBatteryStats(pc checkinutil.Counter, cr *checkinutil.BatteryReport, pk
 			aggregationType = bspb.BatteryStats_SINCE_UNPLUGGED
 		case info: // Not an aggregation type so nothing to do.
 		default:
-			errs = append(errs, fmt.Errorf("unsupported aggregation type %s", rawAggregationType))
+			errs = append(errs, lineErr(fmt.Errorf("unsupported aggregation type %s", rawAggregationType)))
+			if partial {
+				continue
+			}
 			return nil, warnings, errs
 		}
 
@@ -589,8 +625,13 @@ func ParseBatteryStats(pc checkinutil.Counter, cr *checkinutil.BatteryReport, pk
 		// Parse csv lines according to
 		// frameworks/base/core/java/android/os/BatteryStats.java.
 		parsed, warn, csErrs := parseSection(pc, reportVersion, rawUID, section, remaining, stats, system, apkSeen, &allAppComputedPowerMah)
+		for j, err := range csErrs {
+			if err != nil {
+				csErrs[j] = lineErr(err)
+			}
+		}
 		e := false
-		if e, warnings, errs = saveWarningsAndErrors(warnings, warn, errs, csErrs...); e {
+		if e, warnings, errs = saveWarningsAndErrors(warnings, warn, errs, csErrs...); e && !partial {
 			return nil, warnings, errs
 		}
 		if !parsed {
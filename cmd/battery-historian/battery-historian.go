@@ -21,6 +21,8 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/chenjiacun35/battery-historian/analyzer"
 )
@@ -36,6 +38,12 @@ var (
 	templateDir   = flag.String("template_dir", "./templates", "Directory containing HTML templates.")
 	thirdPartyDir = flag.String("third_party_dir", "./third_party", "Directory containing third party files for Historian v2.")
 
+	corsOrigins = flag.String("cors_origins", "", "Comma separated list of origins allowed to make cross-origin requests to the JSON endpoints. CORS is disabled if empty.")
+	corsMethods = flag.String("cors_methods", "GET,POST", "Comma separated list of methods allowed in cross-origin requests.")
+	corsHeaders = flag.String("cors_headers", "Content-Type", "Comma separated list of headers allowed in cross-origin requests.")
+
+	parseTimeout = flag.Duration("parse_timeout", 5*time.Minute, "Maximum time to spend parsing each uploaded bug report. Uploads are parsed without a deadline if 0.")
+
 	// resVersion should be incremented whenever the JS or CSS files are modified.
 	resVersion = flag.Int("res_version", 2, "The current version of JS and CSS files. Used to force JS and CSS reloading to avoid cache issues when rolling out new versions.")
 )
@@ -43,8 +51,9 @@ var (
 type analysisServer struct{}
 
 func (s *analysisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Trace starting analysisServer processing for: %s", r.Method)
-	defer log.Printf("Trace finished analysisServer processing for: %s", r.Method)
+	l := analyzer.Logger(r.Context())
+	l.Info("Trace starting analysisServer processing.", "method", r.Method)
+	defer l.Info("Trace finished analysisServer processing.", "method", r.Method)
 
 	switch r.Method {
 	case "GET":
@@ -89,7 +98,28 @@ func thirdPartyPath() string {
 	return dir
 }
 
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 func initFrontend() {
+	cors := analyzer.CORSConfig{
+		AllowedOrigins: splitList(*corsOrigins),
+		AllowedMethods: splitList(*corsMethods),
+		AllowedHeaders: splitList(*corsHeaders),
+	}
+	http.HandleFunc("/healthz", analyzer.HealthzHandler)
+	http.Handle("/version", analyzer.CORS(cors, http.HandlerFunc(analyzer.VersionHandler)))
+	http.Handle("/csv", analyzer.CORS(cors, analyzer.RequestID(http.HandlerFunc(analyzer.CSVHandler))))
+	http.Handle(analyzer.APIPrefix, analyzer.CORS(cors, analyzer.RequestID(http.HandlerFunc(analyzer.APIHandler))))
+
 	urlPrefix := []string{"/", "/historian/"} // Add all paths relative to root
 	urlDirs := map[string]string{
 		"compiled":    compiledPath(),
@@ -98,7 +128,7 @@ func initFrontend() {
 	}
 
 	for _, p := range urlPrefix {
-		http.Handle(p, &analysisServer{})
+		http.Handle(p, analyzer.CORS(cors, analyzer.RequestID(&analysisServer{})))
 
 		for u, f := range urlDirs {
 			url := path.Join(p, u) + "/"
@@ -120,6 +150,7 @@ func main() {
 	analyzer.SetScriptsDir(*scriptsDir)
 	analyzer.SetResVersion(*resVersion)
 	analyzer.SetIsOptimized(*optimized)
+	analyzer.SetParseTimeout(*parseTimeout)
 	log.Println("Listening on port: ", *port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// binary.go contains functions to encode extracted events more compactly than CSV.
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// MarshalEventsBinary encodes the map of metric to events, as returned by ExtractEvents,
+// in a binary format that can be decoded with UnmarshalEventsBinary.
+func MarshalEventsBinary(m map[string][]Event) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(m); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalEventsBinary decodes a map of metric to events encoded by MarshalEventsBinary.
+func UnmarshalEventsBinary(b []byte) (map[string][]Event, error) {
+	var m map[string][]Event
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
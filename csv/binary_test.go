@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestEventsBinaryRoundTrip tests that events are unchanged after being encoded and decoded.
+func TestEventsBinaryRoundTrip(t *testing.T) {
+	input := map[string][]Event{
+		"Wakelock_in": {
+			{Type: "service", Start: 1422620456417, End: 1422620458417, Value: "*alarm*", Opt: "10051", AppName: "com.google.android.gms"},
+			{Type: "service", Start: 1422620457000, End: 1422620459000, Value: "NlpWakeLock", Opt: "10014"},
+		},
+		"Charging status": {
+			{Type: "string", Start: 1422620452417, End: 1422620453917, Value: "c"},
+		},
+		"Temperature": {
+			{Type: "int", Start: -1, End: 0, Value: "-52"},
+		},
+	}
+
+	b, err := MarshalEventsBinary(input)
+	if err != nil {
+		t.Fatalf("MarshalEventsBinary(%v) unexpected error: %v", input, err)
+	}
+	got, err := UnmarshalEventsBinary(b)
+	if err != nil {
+		t.Fatalf("UnmarshalEventsBinary(MarshalEventsBinary(%v)) unexpected error: %v", input, err)
+	}
+	if !reflect.DeepEqual(got, input) {
+		t.Errorf("UnmarshalEventsBinary(MarshalEventsBinary(%v)) = %v, want %v", input, got, input)
+	}
+
+	if _, err := UnmarshalEventsBinary([]byte("metric,type,start_time")); err == nil {
+		t.Errorf("UnmarshalEventsBinary(CSV) got no error, want error")
+	}
+}
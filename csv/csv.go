@@ -143,6 +143,10 @@ type State struct {
 	curWakeupReason *wakeupReason
 
 	rebootEvent *Entry
+
+	// OnEvent, if set, is called with each event as it is printed, such as for streaming events to
+	// a sink without waiting for the full CSV.
+	OnEvent func(metric string, e Event)
 }
 
 // Key is the unique identifier for an entry.
@@ -259,6 +263,9 @@ func (s *State) Print(desc, metricType string, start, end int64, value, opt stri
 	// CSV parsing on the JS side to treat the quotes as a text qualifier rather than part of the value.
 	value = stripQuotes(value)
 	opt = stripQuotes(opt)
+	if s.OnEvent != nil {
+		s.OnEvent(desc, Event{Type: metricType, Start: start, End: end, Value: value, Opt: opt})
+	}
 	s.writer.Write([]string{desc, metricType, strconv.FormatInt(start, 10), strconv.FormatInt(end, 10), value, opt})
 	s.writer.Flush()
 }
@@ -0,0 +1,126 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// downsample.go contains functions to reduce the number of events of long timelines for display.
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Downsample returns at most max events representing the given events, so very long timelines can
+// be displayed. Metrics where every Value is numeric, such as the battery level, are downsampled with
+// DownsampleLTTB, keeping the events that best preserve the shape of the graph. Other metrics are
+// state metrics, and are coalesced with CapEvents. Marker events are always kept, and don't count
+// towards max. If max is not positive, or there are at most max events, the given events are returned
+// as is. The given slice is not modified.
+func Downsample(events []Event, max int) []Event {
+	markers, others := splitMarkers(events)
+	if max <= 0 || len(others) <= max {
+		return events
+	}
+	for _, e := range others {
+		if _, err := strconv.ParseFloat(e.Value, 64); err != nil {
+			return CapEvents(events, max)
+		}
+	}
+	return withMarkers(DownsampleLTTB(others, max), markers)
+}
+
+// DownsampleMap applies Downsample to the events of each metric in the map of metric to events, as
+// returned by ExtractEvents. The given map is not modified.
+func DownsampleMap(m map[string][]Event, max int) map[string][]Event {
+	res := make(map[string][]Event, len(m))
+	for metric, events := range m {
+		res[metric] = Downsample(events, max)
+	}
+	return res
+}
+
+// DownsampleCSV applies Downsample to the events of each metric in the Historian CSV, and returns
+// the result as a Historian CSV, as written by WriteEventsCSV. Malformed records are dropped, and
+// reported in the returned errors. If max is not positive, the CSV is returned as is.
+func DownsampleCSV(csvInput string, max int) (string, []error) {
+	if max <= 0 {
+		return csvInput, nil
+	}
+	events, errs := ExtractEvents(csvInput, nil)
+	var b bytes.Buffer
+	WriteEventsCSV(&b, DownsampleMap(events, max))
+	return b.String(), errs
+}
+
+// DownsampleLTTB selects at most max of the events of a numeric metric using the largest triangle three
+// buckets algorithm, treating each event as a point at its Start with its Value. The first and last
+// events are always kept, and the events in between are split into max-2 buckets, keeping from each
+// the event forming the largest triangle with the event kept from the previous bucket and the average
+// of the next bucket. Events with non numeric Values are treated as 0. The selected events are returned
+// in order of start time. If max is not positive, or there are at most max events, the given events are
+// returned as is. The given slice is not modified.
+func DownsampleLTTB(events []Event, max int) []Event {
+	if max <= 0 || len(events) <= max {
+		return events
+	}
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.Stable(sortByStartTime(sorted))
+	if max < 3 {
+		if max == 1 {
+			return sorted[:1]
+		}
+		return []Event{sorted[0], sorted[len(sorted)-1]}
+	}
+
+	ys := make([]float64, len(sorted))
+	for i, e := range sorted {
+		ys[i], _ = strconv.ParseFloat(e.Value, 64)
+	}
+	res := make([]Event, 0, max)
+	res = append(res, sorted[0])
+	// Buckets split the events between the first and last into equal sized groups.
+	n, buckets := len(sorted)-2, max-2
+	prev := 0
+	for b := 0; b < buckets; b++ {
+		start, end := 1+b*n/buckets, 1+(b+1)*n/buckets
+
+		// Average of the next bucket, which is just the last event for the last bucket.
+		nextStart, nextEnd := end, 1+(b+2)*n/buckets
+		if b == buckets-1 {
+			nextStart, nextEnd = len(sorted)-1, len(sorted)
+		}
+		var avgX, avgY float64
+		for i := nextStart; i < nextEnd; i++ {
+			avgX += float64(sorted[i].Start)
+			avgY += ys[i]
+		}
+		avgX /= float64(nextEnd - nextStart)
+		avgY /= float64(nextEnd - nextStart)
+
+		px, py := float64(sorted[prev].Start), ys[prev]
+		best, bestArea := start, -1.0
+		for i := start; i < end; i++ {
+			area := math.Abs((px-avgX)*(ys[i]-py) - (px-float64(sorted[i].Start))*(avgY-py))
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		res = append(res, sorted[best])
+		prev = best
+	}
+	return append(res, sorted[len(sorted)-1])
+}
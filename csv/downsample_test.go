@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDownsampleLTTB tests that the peaks of a numeric metric are kept when downsampling.
+func TestDownsampleLTTB(t *testing.T) {
+	// A flat battery level with a single spike and a single dip.
+	values := []string{"50", "50", "50", "90", "50", "50", "50", "10", "50", "50"}
+	var input []Event
+	for i, v := range values {
+		input = append(input, Event{Type: "int", Start: int64(i) * 1000, End: int64(i+1) * 1000, Value: v})
+	}
+	want := []Event{input[0], input[3], input[7], input[9]}
+	if got := DownsampleLTTB(input, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("DownsampleLTTB(%v, 4) = %v, want %v", input, got, want)
+	}
+	if got := DownsampleLTTB(input, 20); !reflect.DeepEqual(got, input) {
+		t.Errorf("DownsampleLTTB(%v, 20) = %v, want %v", input, got, input)
+	}
+	if got, want := DownsampleLTTB(input, 2), []Event{input[0], input[9]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DownsampleLTTB(%v, 2) = %v, want %v", input, got, want)
+	}
+}
+
+// TestDownsample tests that numeric metrics are sampled and state metrics are coalesced.
+func TestDownsample(t *testing.T) {
+	var numeric []Event
+	for i := 0; i < 100; i++ {
+		numeric = append(numeric, Event{Type: "int", Start: int64(i) * 1000, End: int64(i+1) * 1000, Value: strconv.Itoa(i % 7)})
+	}
+	reset := NewMarker(50500, "RESET")
+	got := Downsample(append(numeric, reset), 10)
+	if len(got) != 11 {
+		t.Errorf("Downsample(numeric, 10) returned %d events, want 10 and the marker", len(got))
+	}
+	for _, e := range got {
+		if e.End-e.Start != 1000 && !e.Marker {
+			t.Errorf("Downsample(numeric, 10) returned %v, want only original events", e)
+		}
+	}
+
+	state := []Event{
+		{Type: "service", Start: 0, End: 1000, Value: "a"},
+		{Type: "service", Start: 1100, End: 2000, Value: "b"},
+		{Type: "service", Start: 5000, End: 6000, Value: "c"},
+	}
+	want := []Event{
+		{Type: "service", Start: 0, End: 2000, Value: "a"},
+		{Type: "service", Start: 5000, End: 6000, Value: "c"},
+	}
+	if got := Downsample(state, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Downsample(%v, 2) = %v, want %v", state, got, want)
+	}
+}
+
+// TestDownsampleCSV tests downsampling the metrics of a Historian CSV.
+func TestDownsampleCSV(t *testing.T) {
+	lines := []string{FileHeader, "Screen,bool,1000,5000,true,"}
+	for i := 0; i < 10; i++ {
+		start := int64(i) * 1000
+		lines = append(lines, "Battery Level,int,"+strconv.FormatInt(start, 10)+","+strconv.FormatInt(start+1000, 10)+","+strconv.Itoa(100-i)+",")
+	}
+	input := strings.Join(lines, "\n")
+
+	got, errs := DownsampleCSV(input, 4)
+	if len(errs) > 0 {
+		t.Fatalf("DownsampleCSV(%q, 4) unexpected errors: %v", input, errs)
+	}
+	want := strings.Join([]string{
+		FileHeader,
+		"Battery Level,int,0,1000,100,",
+		"Battery Level,int,1000,2000,99,",
+		"Battery Level,int,5000,6000,95,",
+		"Battery Level,int,9000,10000,91,",
+		"Screen,bool,1000,5000,true,",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("DownsampleCSV(%q, 4) = %q, want %q", input, got, want)
+	}
+
+	if got, _ := DownsampleCSV(input, 0); got != input {
+		t.Errorf("DownsampleCSV(%q, 0) = %q, want the input unchanged", input, got)
+	}
+}
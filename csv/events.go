@@ -17,11 +17,20 @@ package csv
 // events.go processes the CSV generated by csv.go, and creates a map from metric to events.
 
 import (
+	"compress/gzip"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chenjiacun35/battery-historian/checkinutil"
 	"github.com/chenjiacun35/battery-historian/historianutils"
@@ -43,6 +52,99 @@ type Event struct {
 	Value      string
 	Opt        string
 	AppName    string // For populating from package info.
+	// Index is the index of the CSV record the event was parsed from, set by ExtractEventsWithIndex.
+	// The header, if present, is record 0.
+	Index int
+	// Marker is set for instantaneous events denoting a change of state, such as a RESET, SHUTDOWN
+	// or START in the history. Markers are points that are never merged with other events, and are
+	// kept as is by MergeEvents and the functions in transform.go.
+	Marker bool
+}
+
+// NewMarker returns a marker event at the given time, with the given Value, such as "RESET".
+func NewMarker(t int64, value string) Event {
+	return Event{Type: "marker", Start: t, End: t, Value: value, Marker: true}
+}
+
+// splitMarkers returns the marker events and the other events, each in their original order.
+func splitMarkers(events []Event) (markers, others []Event) {
+	for _, e := range events {
+		if e.Marker {
+			markers = append(markers, e)
+		} else {
+			others = append(others, e)
+		}
+	}
+	return markers, others
+}
+
+// withMarkers returns the events sorted by start time, with the markers inserted by their start
+// time. Markers come before other events starting at the same time.
+func withMarkers(sorted, markers []Event) []Event {
+	if len(markers) == 0 {
+		return sorted
+	}
+	markers = append([]Event(nil), markers...)
+	sort.Stable(sortByStartTime(markers))
+	res := make([]Event, 0, len(sorted)+len(markers))
+	for len(sorted) > 0 || len(markers) > 0 {
+		if len(markers) > 0 && (len(sorted) == 0 || markers[0].Start <= sorted[0].Start) {
+			res = append(res, markers[0])
+			markers = markers[1:]
+			continue
+		}
+		res = append(res, sorted[0])
+		sorted = sorted[1:]
+	}
+	return res
+}
+
+// ValidationSection is the Section of the ParseErrors reported for events failing validation.
+const ValidationSection = "csv"
+
+// Validator checks an event extracted for the given metric, returning an error if it is malformed.
+type Validator func(metric string, e Event) error
+
+// ValidateUID returns a Validator that checks the Opt of any event for the given metrics is a numeric UID.
+// Events for other metrics are not checked.
+func ValidateUID(metrics ...string) Validator {
+	m := make(map[string]bool)
+	for _, metric := range metrics {
+		m[metric] = true
+	}
+	return func(metric string, e Event) error {
+		if !m[metric] {
+			return nil
+		}
+		if _, err := strconv.ParseInt(e.Opt, 10, 32); err != nil {
+			return fmt.Errorf("invalid UID %q for metric %q", e.Opt, metric)
+		}
+		return nil
+	}
+}
+
+// Validate checks that the events form a well formed timeline, returning an error for each problem
+// found along with the index of the offending event. Events must not have negative timestamps or
+// end before they start, although an End of -1 is allowed for events that haven't finished.
+// If expectSorted is true, the events must also be in ascending order of Start.
+func Validate(events []Event, expectSorted bool) []error {
+	var errs []error
+	for i, e := range events {
+		if e.Start < 0 {
+			errs = append(errs, fmt.Errorf("event %d: negative start %d", i, e.Start))
+		}
+		switch {
+		case e.End == -1:
+		case e.End < 0:
+			errs = append(errs, fmt.Errorf("event %d: negative end %d", i, e.End))
+		case e.End < e.Start:
+			errs = append(errs, fmt.Errorf("event %d: end %d before start %d", i, e.End, e.Start))
+		}
+		if expectSorted && i > 0 && e.Start < events[i-1].Start {
+			errs = append(errs, fmt.Errorf("event %d: start %d before start %d of previous event", i, e.Start, events[i-1].Start))
+		}
+	}
+	return errs
 }
 
 // ExtractEvents returns all events matching any of the given metrics names.
@@ -50,25 +152,177 @@ type Event struct {
 // If the metrics slice is nil, all events will be extracted.
 // Errors encountered during parsing will be collected into an errors slice and will continue parsing remaining events.
 func ExtractEvents(csvInput string, metrics []string) (map[string][]Event, []error) {
+	return ExtractEventsWithValidators(csvInput, metrics)
+}
+
+// ExtractEventsWithValidators is the same as ExtractEvents, but also runs each extracted event through the given validators.
+// Events failing validation are still returned, with a *historianutils.ParseError of class
+// historianutils.ErrorClassValidation collected for each failure.
+func ExtractEventsWithValidators(csvInput string, metrics []string, validators ...Validator) (map[string][]Event, []error) {
+	return extractRecords(splitRecords(csvInput), metrics, validators, false)
+}
+
+// ExtractEventsWithIndex is the same as ExtractEvents, but also sets the Index of each event to the
+// index of the record it was parsed from, so events can be traced back to their line in the input.
+func ExtractEventsWithIndex(csvInput string, metrics []string) (map[string][]Event, []error) {
+	return extractRecords(splitRecords(csvInput), metrics, nil, true)
+}
+
+// ExtractEventsInRange is the same as ExtractEvents, but only returns the events overlapping the
+// window from startMs to endMs, in Unix milliseconds, with their Start and End clipped to the window.
+// Events are filtered as they are extracted, as described for FilterByWindow.
+func ExtractEventsInRange(csvInput string, metrics []string, startMs, endMs int64) (map[string][]Event, []error) {
+	if endMs < startMs {
+		return nil, []error{fmt.Errorf("invalid range: end %d is before start %d", endMs, startMs)}
+	}
+	events := make(map[string][]Event, len(metrics))
+	for _, m := range metrics {
+		events[m] = nil
+	}
+	errs := eachEvent(splitRecords(csvInput), metrics, nil, false, func(metric string, e Event) error {
+		if e, ok := clipToWindow(e, startMs, endMs); ok {
+			events[metric] = append(events[metric], e)
+		}
+		return nil
+	})
+	return events, errs
+}
+
+// ExtractEventsWithHeader is the same as ExtractEvents, but the first line of the input is a header
+// naming each column, allowing the columns to be in any order. The column names are those in FileHeader.
+// All columns except opt are required.
+func ExtractEventsWithHeader(csvInput string, metrics []string) (map[string][]Event, []error) {
 	records := checkinutil.ParseCSV(csvInput)
-	if records == nil {
-		return nil, []error{errors.New("nil result generated by ParseCSV")}
+	if len(records) == 0 {
+		return nil, []error{errors.New("missing header")}
+	}
+	cols := make(map[string]int)
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+	names := strings.Split(FileHeader, ",")
+	var idx []int
+	for _, name := range names {
+		i, ok := cols[name]
+		if !ok {
+			if name != "opt" {
+				return nil, []error{fmt.Errorf("missing column %q in header", name)}
+			}
+			i = -1
+		}
+		idx = append(idx, i)
+	}
+
+	// Reorder the columns to match FileHeader.
+	ordered := [][]string{names}
+	for _, r := range records[1:] {
+		parts := make([]string, len(idx))
+		short := false
+		for j, i := range idx {
+			switch {
+			case i < 0:
+			case i < len(r):
+				parts[j] = r[i]
+			default:
+				short = true
+			}
+		}
+		if short {
+			// Drop a column so eventFromRecord reports the malformed record.
+			parts = parts[:len(parts)-1]
+		}
+		ordered = append(ordered, parts)
+	}
+	return extractRecords(parsedRecords(ordered), metrics, nil, false)
+}
+
+// headerFields are the fields of the FileHeader record.
+var headerFields = strings.Split(FileHeader, ",")
+
+// isHeader returns whether the fields are those of the FileHeader record.
+func isHeader(fields []string) bool {
+	if len(fields) != len(headerFields) {
+		return false
 	}
+	for i, f := range fields {
+		if f != headerFields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordFunc returns the fields of the next CSV record, reusing dst if possible, or nil if there are
+// no more records. The returned fields are only valid until the next call.
+type recordFunc func(dst []string) []string
+
+// splitRecords returns a recordFunc splitting the CSV input one record at a time, so the extraction
+// of large CSVs doesn't allocate a slice for every record.
+func splitRecords(csvInput string) recordFunc {
+	return func(dst []string) []string {
+		var fields []string
+		fields, csvInput = historianutils.SplitRecord(csvInput, dst)
+		return fields
+	}
+}
+
+// parsedRecords returns a recordFunc over already parsed CSV records.
+func parsedRecords(records [][]string) recordFunc {
+	return func([]string) []string {
+		if len(records) == 0 {
+			return nil
+		}
+		r := records[0]
+		records = records[1:]
+		if r == nil {
+			// Distinguish an empty record from the end of the records.
+			r = []string{}
+		}
+		return r
+	}
+}
+
+// extractRecords returns the events in the CSV records returned by next matching any of the given
+// metrics, running each event through the validators. If index is true, the Index of each event is set.
+func extractRecords(next recordFunc, metrics []string, validators []Validator, index bool) (map[string][]Event, []error) {
 	events := make(map[string][]Event, len(metrics))
 	// Only store metrics requested.
 	for _, m := range metrics {
 		events[m] = nil
 	}
+	errs := eachEvent(next, metrics, validators, index, func(metric string, e Event) error {
+		events[metric] = append(events[metric], e)
+		return nil
+	})
+	return events, errs
+}
+
+// eachEvent calls emit with each event in the CSV records returned by next matching any of the given
+// metrics, or all metrics if metrics is nil. It stops at the first error returned by emit, and returns
+// it after any errors for records that couldn't be parsed or failed validation.
+func eachEvent(next recordFunc, metrics []string, validators []Validator, index bool, emit func(metric string, e Event) error) []error {
+	var want map[string]bool
+	if metrics != nil {
+		want = make(map[string]bool, len(metrics))
+		for _, m := range metrics {
+			want[m] = true
+		}
+	}
 
 	var errs []error
-	for i, parts := range records {
+	var buf []string
+	for i := 0; ; i++ {
+		parts := next(buf)
+		if parts == nil {
+			break
+		}
+		buf = parts
 		// Skip CSV header.
-		if len(parts) == 0 || strings.Join(records[i], ",") == FileHeader {
+		if len(parts) == 0 || isHeader(parts) {
 			continue
 		}
 		desc := parts[0]
-		metricEvents, ok := events[desc]
-		if metrics != nil && !ok {
+		if want != nil && !want[desc] {
 			// Ignore non matching metrics.
 			continue
 		}
@@ -77,7 +331,147 @@ func ExtractEvents(csvInput string, metrics []string) (map[string][]Event, []err
 			errs = append(errs, fmt.Errorf("record %v: %v", i, err))
 			continue
 		}
-		events[desc] = append(metricEvents, e)
+		if index {
+			e.Index = i
+		}
+		for _, v := range validators {
+			if err := v(desc, e); err != nil {
+				errs = append(errs, &historianutils.ParseError{
+					Section: ValidationSection,
+					Line:    i + 1,
+					Class:   historianutils.ErrorClassValidation,
+					Raw:     strings.Join(parts, ","),
+					Err:     fmt.Errorf("record %v: %v", i, err),
+				})
+			}
+		}
+		if err := emit(desc, e); err != nil {
+			return append(errs, err)
+		}
+	}
+	return errs
+}
+
+// readRecords returns a recordFunc reading the CSV from r one record at a time, parsing fields the
+// same way as checkinutil.ParseCSV. If reading fails, the error is stored in errp and no more records
+// are returned.
+func readRecords(r io.Reader, errp *error) recordFunc {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+	return func([]string) []string {
+		rec, err := cr.Read()
+		if err != nil {
+			if err != io.EOF {
+				*errp = err
+			}
+			return nil
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		return rec
+	}
+}
+
+// ExtractEventsFromReader is the same as ExtractEvents, but reads the CSV from r incrementally and
+// calls cb with each event and the metric it belongs to rather than returning the events, so inputs of
+// any size can be processed without holding them in memory. Extraction stops at the first error
+// returned by cb or from reading r, which is returned after any errors for records that couldn't be parsed.
+func ExtractEventsFromReader(r io.Reader, metrics []string, cb func(metric string, e Event) error) []error {
+	var readErr error
+	errs := eachEvent(readRecords(r, &readErr), metrics, nil, false, cb)
+	if readErr != nil {
+		errs = append(errs, fmt.Errorf("failed to read input: %v", readErr))
+	}
+	return errs
+}
+
+// ExtractEventsGzip is the same as ExtractEvents, but reads the CSV from gzip compressed input.
+// An error is returned if the input is not gzip compressed.
+func ExtractEventsGzip(r io.Reader, metrics []string) (map[string][]Event, []error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, []error{fmt.Errorf("input is not gzip compressed: %v", err)}
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to decompress input: %v", err)}
+	}
+	return ExtractEvents(string(b), metrics)
+}
+
+// annotation is a manually labelled region of a report, as stored in an annotation file.
+type annotation struct {
+	Label   string `json:"label"`
+	StartMs int64  `json:"startMs"`
+	EndMs   int64  `json:"endMs"`
+}
+
+// LoadAnnotations reads a JSON array of {"label", "startMs", "endMs"} objects, such as
+// [{"label": "user reported lag here", "startMs": 1000, "endMs": 2000}], and returns them as
+// events of type "annotation" with the label as the Value, so they can be overlaid on extracted events.
+func LoadAnnotations(r io.Reader) ([]Event, error) {
+	var as []annotation
+	if err := json.NewDecoder(r).Decode(&as); err != nil {
+		return nil, fmt.Errorf("invalid annotations: %v", err)
+	}
+	events := make([]Event, 0, len(as))
+	for i, a := range as {
+		if a.EndMs < a.StartMs {
+			return nil, fmt.Errorf("annotation %d (%q) ends at %d before it starts at %d", i, a.Label, a.EndMs, a.StartMs)
+		}
+		events = append(events, Event{Type: "annotation", Start: a.StartMs, End: a.EndMs, Value: a.Label})
+	}
+	return events, nil
+}
+
+// ExtractEventsMulti runs ExtractEvents over each of the inputs using the given number of workers.
+// Events for each metric are concatenated in the order of the inputs, and any errors are prefixed with the index of the input they came from.
+func ExtractEventsMulti(inputs []string, metrics []string, workers int) (map[string][]Event, []error) {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		events map[string][]Event
+		errs   []error
+	}
+	results := make([]result, len(inputs))
+
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				// Each worker writes to a distinct index, so no locking is needed.
+				events, errs := ExtractEvents(inputs[i], metrics)
+				results[i] = result{events, errs}
+			}
+		}()
+	}
+	for i := range inputs {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	events := make(map[string][]Event, len(metrics))
+	for _, m := range metrics {
+		events[m] = nil
+	}
+	var errs []error
+	for i, r := range results {
+		for m, es := range r.events {
+			events[m] = append(events[m], es...)
+		}
+		for _, err := range r.errs {
+			errs = append(errs, fmt.Errorf("input %d: %v", i, err))
+		}
 	}
 	return events, errs
 }
@@ -88,11 +482,11 @@ func eventFromRecord(parts []string) (Event, error) {
 	if len(parts) != 6 {
 		return Event{}, fmt.Errorf("non matching %v, len was %v", parts, len(parts))
 	}
-	start, err := strconv.ParseInt(parts[2], 10, 64)
+	start, err := historianutils.ParseIntField("start", parts[2])
 	if err != nil {
 		return Event{}, err
 	}
-	end, err := strconv.ParseInt(parts[3], 10, 64)
+	end, err := historianutils.ParseIntField("end", parts[3])
 	if err != nil {
 		return Event{}, err
 	}
@@ -106,24 +500,572 @@ func eventFromRecord(parts []string) (Event, error) {
 }
 
 // MergeEvents merges all overlapping events.
+// Each merged event keeps the Index of its earliest starting constituent event.
 func MergeEvents(events []Event) []Event {
+	return MergeEventsWithGap(events, 0)
+}
+
+// MergeEventsWithGap is the same as MergeEvents, but also merges events separated by at most gapMs.
+// Marker events are never merged, and are returned as is, ordered by start time with the merged events.
+func MergeEventsWithGap(events []Event, gapMs int64) []Event {
 	if len(events) == 0 {
 		return nil
 	}
 	// Need to sort the events by start time here,
 	// because the following algorithm relies on sorted events.
 	sort.Sort(sortByStartTime(events))
+	if markers, others := splitMarkers(events); len(markers) > 0 {
+		return withMarkers(MergeEventsWithGap(others, gapMs), markers)
+	}
 
 	var res []Event
 	prev := events[0]
 	for _, cur := range events[1:] {
-		if prev.End < cur.Start {
+		if prev.End+gapMs < cur.Start {
 			res = append(res, prev)
 			prev = cur
 		} else {
-			prev = Event{Start: prev.Start, End: historianutils.MaxInt64(prev.End, cur.End)}
+			prev = Event{Start: prev.Start, End: historianutils.MaxInt64(prev.End, cur.End), Index: prev.Index}
 		}
 	}
 	res = append(res, prev)
 	return res
 }
+
+// MergeAppend integrates newEvents into merged, which must already be sorted and merged, such as
+// the output of MergeEvents. Only the merged events that could overlap the new events are merged
+// again, so the result is the same as MergeEvents on the combined events without re-merging the
+// whole history. Marker events are never merged, and are returned as is, ordered by start time with
+// the merged events. Neither of the given slices is modified.
+func MergeAppend(merged, newEvents []Event) []Event {
+	if len(newEvents) == 0 {
+		return CloneEvents(merged)
+	}
+	// Markers would break the ordering by End that the search below relies on.
+	oldMarkers, oldOthers := splitMarkers(merged)
+	newMarkers, newOthers := splitMarkers(newEvents)
+	if markers := append(oldMarkers, newMarkers...); len(markers) > 0 {
+		return withMarkers(MergeAppend(oldOthers, newOthers), markers)
+	}
+	minStart := newEvents[0].Start
+	for _, e := range newEvents[1:] {
+		minStart = minInt64(minStart, e.Start)
+	}
+	// Merged events ending before the earliest new event are unaffected.
+	i := sort.Search(len(merged), func(i int) bool { return merged[i].End >= minStart })
+	tail := make([]Event, 0, len(merged)-i+len(newEvents))
+	tail = append(tail, merged[i:]...)
+	tail = append(tail, newEvents...)
+	return append(CloneEvents(merged[:i]), MergeEvents(tail)...)
+}
+
+// MergeEventsKeepLongest merges all overlapping events like MergeEvents, but each merged event
+// keeps the Value, and other fields, of its longest constituent event rather than discarding them.
+// Ties are broken by keeping the lexically smallest Value. Marker events are never merged. The
+// given slice is not modified.
+func MergeEventsKeepLongest(events []Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	if markers, others := splitMarkers(events); len(markers) > 0 {
+		return withMarkers(MergeEventsKeepLongest(others), markers)
+	}
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.Stable(sortByStartTime(sorted))
+
+	var res []Event
+	cur, longest := sorted[0], sorted[0]
+	for _, e := range sorted[1:] {
+		if cur.End < e.Start {
+			longest.Start, longest.End = cur.Start, cur.End
+			res = append(res, longest)
+			cur, longest = e, e
+			continue
+		}
+		cur.End = historianutils.MaxInt64(cur.End, e.End)
+		if d, ld := e.End-e.Start, longest.End-longest.Start; d > ld || (d == ld && e.Value < longest.Value) {
+			longest = e
+		}
+	}
+	longest.Start, longest.End = cur.Start, cur.End
+	return append(res, longest)
+}
+
+// Reducer combines an event into the merged event acc, returning the updated merged event.
+// The Start and End of the returned event are ignored.
+type Reducer func(acc, e Event) Event
+
+// SumValues is a Reducer adding up the numeric Values of merged events. If either Value isn't
+// numeric, acc is returned unchanged.
+func SumValues(acc, e Event) Event {
+	a, err := strconv.ParseFloat(acc.Value, 64)
+	if err != nil {
+		return acc
+	}
+	b, err := strconv.ParseFloat(e.Value, 64)
+	if err != nil {
+		return acc
+	}
+	acc.Value = strconv.FormatFloat(a+b, 'f', -1, 64)
+	return acc
+}
+
+// JoinDistinct returns a Reducer joining the distinct Values, Opts and AppNames of merged events with
+// sep, in the order they were first seen, so a merged event keeps which apps it was attributed to.
+// Empty strings are skipped.
+func JoinDistinct(sep string) Reducer {
+	join := func(acc, s string) string {
+		if s == "" {
+			return acc
+		}
+		if acc == "" {
+			return s
+		}
+		for _, p := range strings.Split(acc, sep) {
+			if p == s {
+				return acc
+			}
+		}
+		return acc + sep + s
+	}
+	return func(acc, e Event) Event {
+		acc.Value = join(acc.Value, e.Value)
+		acc.Opt = join(acc.Opt, e.Opt)
+		acc.AppName = join(acc.AppName, e.AppName)
+		return acc
+	}
+}
+
+// MergeEventsWithReducer merges all overlapping events like MergeEvents, but each merged event starts
+// as its earliest starting constituent event, and every later constituent event is combined into it
+// using reduce, so the merged event keeps a meaningful Value, Opt and AppName. Marker events are never
+// merged. The given slice is not modified.
+func MergeEventsWithReducer(events []Event, reduce Reducer) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	if markers, others := splitMarkers(events); len(markers) > 0 {
+		return withMarkers(MergeEventsWithReducer(others, reduce), markers)
+	}
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.Stable(sortByStartTime(sorted))
+
+	var res []Event
+	cur := sorted[0]
+	for _, e := range sorted[1:] {
+		if cur.End < e.Start {
+			res = append(res, cur)
+			cur = e
+			continue
+		}
+		start, end := cur.Start, historianutils.MaxInt64(cur.End, e.End)
+		cur = reduce(cur, e)
+		cur.Start, cur.End = start, end
+	}
+	return append(res, cur)
+}
+
+// MergeRuns merges the events into contiguous, non overlapping spans keyed by Value, such as for
+// "top app" style metrics. Consecutive events with the same Value are merged, and a span ends as
+// soon as an event with a different Value starts, so at an overlap the later event wins. Each span
+// keeps the other fields of its first event. The given slice is not modified.
+func MergeRuns(events []Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.Stable(sortByStartTime(sorted))
+
+	var res []Event
+	cur := sorted[0]
+	for _, e := range sorted[1:] {
+		if e.Value == cur.Value && e.Start <= cur.End {
+			cur.End = historianutils.MaxInt64(cur.End, e.End)
+			continue
+		}
+		// Drop spans that are cut down to nothing by an event starting at the same time.
+		if e.Start < cur.End {
+			cur.End = e.Start
+			if cur.End == cur.Start {
+				cur = e
+				continue
+			}
+		}
+		res = append(res, cur)
+		cur = e
+	}
+	return append(res, cur)
+}
+
+// latestTime returns the latest start or end time of any of the events, which is taken as the end of
+// the report for events that haven't finished.
+func latestTime(m map[string][]Event) int64 {
+	var latest int64
+	for _, events := range m {
+		for _, e := range events {
+			latest = historianutils.MaxInt64(latest, historianutils.MaxInt64(e.Start, e.End))
+		}
+	}
+	return latest
+}
+
+// priorityEvent is an event competing for time in MergeWithPriority.
+type priorityEvent struct {
+	// rank is the position of the event's metric in the priority order, and idx is the index of the
+	// event within its metric. Lower values have higher priority.
+	rank, idx  int
+	start, end int64
+}
+
+// priorityHeap is a min-heap of events by priority.
+type priorityHeap []priorityEvent
+
+func (h priorityHeap) Len() int { return len(h) }
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].idx < h[j].idx
+}
+func (h priorityHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *priorityHeap) Push(x interface{}) { *h = append(*h, x.(priorityEvent)) }
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// MergeWithPriority combines the events of several metrics into a single non overlapping timeline,
+// where the metric earliest in priority claims any time contested with later metrics. Metrics not
+// in priority have the lowest priority, in order of name. Each returned event keeps the fields of
+// the event it came from, with Start and End clipped to the time it claimed, and the events are
+// ordered by time. Events that haven't finished, with an End of -1, are ongoing until the latest
+// time of any event, and keep an End of -1 if they claim the time up to then. Instant events don't
+// claim any time so are dropped. The given events are not modified.
+func MergeWithPriority(sets map[string][]Event, priority []string) []Event {
+	order := append([]string(nil), priority...)
+	listed := make(map[string]bool)
+	for _, m := range priority {
+		listed[m] = true
+	}
+	var rest []string
+	for m := range sets {
+		if !listed[m] {
+			rest = append(rest, m)
+		}
+	}
+	sort.Strings(rest)
+	order = append(order, rest...)
+
+	reportEnd := latestTime(sets)
+	var items []priorityEvent
+	var bounds []int64
+	for rank, m := range order {
+		for idx, e := range sets[m] {
+			end := e.End
+			if end == -1 {
+				end = reportEnd
+			}
+			if end <= e.Start {
+				continue
+			}
+			items = append(items, priorityEvent{rank, idx, e.Start, end})
+			bounds = append(bounds, e.Start, end)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].start < items[j].start })
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var res []Event
+	// active holds the events started so far, including ended ones that haven't been popped yet.
+	active := &priorityHeap{}
+	next := 0
+	// The event the last returned event came from.
+	last := priorityEvent{rank: -1}
+	for i := 1; i < len(bounds); i++ {
+		start, end := bounds[i-1], bounds[i]
+		if start == end {
+			continue
+		}
+		for ; next < len(items) && items[next].start <= start; next++ {
+			heap.Push(active, items[next])
+		}
+		for active.Len() > 0 && (*active)[0].end <= start {
+			heap.Pop(active)
+		}
+		if active.Len() == 0 {
+			continue
+		}
+		top := (*active)[0]
+		if n := len(res); n > 0 && top.rank == last.rank && top.idx == last.idx && res[n-1].End == start {
+			res[n-1].End = end
+			continue
+		}
+		e := sets[order[top.rank]][top.idx]
+		e.Start, e.End = start, end
+		res = append(res, e)
+		last = top
+	}
+	// Events that haven't finished are still ongoing at the end.
+	if n := len(res); n > 0 && res[n-1].End == reportEnd && sets[order[last.rank]][last.idx].End == -1 {
+		res[n-1].End = -1
+	}
+	return res
+}
+
+// MergeBy groups the events by the key returned by keyFn, and merges the overlapping events
+// within each group. The given slice is not modified.
+func MergeBy(events []Event, keyFn func(Event) string) map[string][]Event {
+	groups := make(map[string][]Event)
+	for _, e := range events {
+		k := keyFn(e)
+		groups[k] = append(groups[k], e)
+	}
+	for k, g := range groups {
+		groups[k] = MergeEvents(g)
+	}
+	return groups
+}
+
+// MergeMaps combines two event maps, such as the results of extracting different parts of a report.
+// The events of metrics present in both maps are concatenated and sorted by start time, and if
+// mergeOverlaps is true, the overlapping events of each metric are merged as in MergeEvents.
+// Metrics present in only one of the maps are carried through. Neither of the given maps is modified.
+func MergeMaps(a, b map[string][]Event, mergeOverlaps bool) map[string][]Event {
+	res := make(map[string][]Event)
+	for _, m := range []map[string][]Event{a, b} {
+		for metric, events := range m {
+			res[metric] = append(res[metric], events...)
+		}
+	}
+	for metric, events := range res {
+		if mergeOverlaps {
+			res[metric] = MergeEvents(events)
+		} else {
+			sort.Stable(sortByStartTime(events))
+		}
+	}
+	return res
+}
+
+// FlagProximate returns the events sorted by start time, and whether each of the sorted events is
+// proximate: some earlier event ends within gapMs of its start, or some later event starts within
+// gapMs of its end. Events are not merged. Overlapping events, including events nested inside a longer
+// earlier event, are always considered proximate, and events that haven't finished, with an End of -1,
+// overlap every later event. The given slice is not modified.
+func FlagProximate(events []Event, gapMs int64) ([]Event, []bool) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	res := make([]Event, len(events))
+	copy(res, events)
+	sort.Stable(sortByStartTime(res))
+
+	proximate := make([]bool, len(res))
+	// last is the index of the event ending last among the events seen so far.
+	last := 0
+	for i := 1; i < len(res); i++ {
+		end := res[last].End
+		if end == -1 {
+			end = math.MaxInt64
+		}
+		if res[i].Start <= end || res[i].Start-end <= gapMs {
+			proximate[last] = true
+			proximate[i] = true
+		}
+		if res[last].End != -1 && (res[i].End == -1 || res[i].End > res[last].End) {
+			last = i
+		}
+	}
+	return res, proximate
+}
+
+// DiffEvents compares two sets of events for the same metric, such as from two different builds.
+// Events with the same Value and Opt are matched if they overlap, or are within toleranceMs of
+// each other. Events in b without a match are returned as added, and events in a without a match
+// are returned as removed. Matched events whose start or end moved by more than toleranceMs are
+// returned as changed, using the event from b. The given slices are not modified.
+func DiffEvents(a, b []Event, toleranceMs int64) (added, removed, changed []Event) {
+	ca := make([]Event, len(a))
+	copy(ca, a)
+	sort.Stable(sortByStartTime(ca))
+	cb := make([]Event, len(b))
+	copy(cb, b)
+	sort.Stable(sortByStartTime(cb))
+
+	matched := make([]bool, len(cb))
+	for _, ea := range ca {
+		// Match with the unmatched event in b that has the largest overlap.
+		best := -1
+		var bestOverlap int64
+		for j, eb := range cb {
+			if matched[j] || ea.Value != eb.Value || ea.Opt != eb.Opt {
+				continue
+			}
+			if eb.Start > ea.End+toleranceMs || ea.Start > eb.End+toleranceMs {
+				continue
+			}
+			overlap := minInt64(ea.End, eb.End) - historianutils.MaxInt64(ea.Start, eb.Start)
+			if best == -1 || overlap > bestOverlap {
+				best, bestOverlap = j, overlap
+			}
+		}
+		if best == -1 {
+			removed = append(removed, ea)
+			continue
+		}
+		matched[best] = true
+		eb := cb[best]
+		if absInt64(ea.Start-eb.Start) > toleranceMs || absInt64(ea.End-eb.End) > toleranceMs {
+			changed = append(changed, eb)
+		}
+	}
+	for j, eb := range cb {
+		if !matched[j] {
+			added = append(added, eb)
+		}
+	}
+	return added, removed, changed
+}
+
+// EventPair is an event paired with the nearest event of another set by PairNearest.
+type EventPair struct {
+	A, B Event
+	// DeltaMs is the start of B minus the start of A, so it is negative if B started first.
+	DeltaMs int64
+	// Paired is false if there was no event to pair A with, in which case B and DeltaMs are zero.
+	Paired bool
+}
+
+// PairNearest pairs each event in a with the event in b whose start is nearest to its start, such as
+// for finding the likely cause of each event. Several events in a may be paired with the same event
+// in b. If two events in b are equally near, the earlier one is used. The pairs are in the order of
+// a, and the given slices are not modified.
+func PairNearest(a, b []Event) []EventPair {
+	sorted := make([]Event, len(b))
+	copy(sorted, b)
+	sort.Stable(sortByStartTime(sorted))
+
+	pairs := make([]EventPair, 0, len(a))
+	for _, ea := range a {
+		p := EventPair{A: ea}
+		if len(sorted) > 0 {
+			// Index of the first event in b starting at or after ea. The nearest is it or the one before it.
+			i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Start >= ea.Start })
+			best := i
+			if i == len(sorted) || (i > 0 && absInt64(ea.Start-sorted[i-1].Start) <= absInt64(sorted[i].Start-ea.Start)) {
+				best = i - 1
+			}
+			p.B, p.DeltaMs, p.Paired = sorted[best], sorted[best].Start-ea.Start, true
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func absInt64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// ParseValueKV splits the event's Value into key=value pairs delimited by ';'.
+// e.g. "pkg=com.foo;reason=alarm" gives {"pkg": "com.foo", "reason": "alarm"}.
+// Tokens without an '=' are stored as keys with an empty value, and empty tokens are ignored.
+func ParseValueKV(e Event) map[string]string {
+	kv := make(map[string]string)
+	for _, tok := range strings.Split(e.Value, ";") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		parts := strings.SplitN(tok, "=", 2)
+		k := strings.TrimSpace(parts[0])
+		if len(parts) == 1 {
+			kv[k] = ""
+			continue
+		}
+		kv[k] = strings.TrimSpace(parts[1])
+	}
+	return kv
+}
+
+// WakeupReasons returns the kernel wakeup events attributed to the given CPU running events, with
+// the wakeup reason, such as the IRQ source, as the Value. The CPU running events store their
+// wakeup reasons in the Value as pipe delimited "start~reason" or "start~end~reason" entries.
+// Entries without an end are instantaneous, and have the same Start and End.
+func WakeupReasons(running []Event) ([]Event, []error) {
+	var res []Event
+	var errs []error
+	for _, r := range running {
+		if r.Value == "" {
+			continue
+		}
+		for _, entry := range strings.Split(r.Value, "|") {
+			parts := strings.SplitN(entry, "~", 3)
+			if len(parts) < 2 {
+				errs = append(errs, fmt.Errorf("invalid wakeup reason %q", entry))
+				continue
+			}
+			if len(parts) == 2 {
+				// Instantaneous wakeup reason, the reason is the last part.
+				parts = []string{parts[0], parts[0], parts[1]}
+			}
+			start, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid wakeup reason %q start: %v", entry, err))
+				continue
+			}
+			end, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid wakeup reason %q end: %v", entry, err))
+				continue
+			}
+			res = append(res, Event{Type: "string", Start: start, End: end, Value: parts[2]})
+		}
+	}
+	return res, errs
+}
+
+// GroupByReason groups the wakeup events, such as those returned by WakeupReasons, by their reason.
+// The events of each reason are sorted by start time, and are not merged. The given slice is not modified.
+func GroupByReason(events []Event) map[string][]Event {
+	groups := make(map[string][]Event)
+	for _, e := range events {
+		groups[e.Value] = append(groups[e.Value], e)
+	}
+	for _, g := range groups {
+		sort.Stable(sortByStartTime(g))
+	}
+	return groups
+}
+
+// FormatEvent returns a human readable description of the event for debugging, in the form
+// "[HH:MM:SS.mmm - HH:MM:SS.mmm] type value". The start and end of the event are offsets in
+// milliseconds from base, which is a unix ms timestamp, and are printed in the given location.
+// An End of -1 means the event hasn't finished and is printed as "...".
+func FormatEvent(e Event, base int64, loc *time.Location) string {
+	if loc == nil {
+		loc = time.UTC
+	}
+	format := func(ms int64) string {
+		return time.Unix(0, (base+ms)*int64(time.Millisecond)).In(loc).Format("15:04:05.000")
+	}
+	end := "..."
+	if e.End != -1 {
+		end = format(e.End)
+	}
+	return fmt.Sprintf("[%s - %s] %s %s", format(e.Start), end, e.Type, e.Value)
+}
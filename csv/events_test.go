@@ -15,10 +15,16 @@
 package csv
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/chenjiacun35/battery-historian/checkinutil"
+	"github.com/chenjiacun35/battery-historian/historianutils"
 )
 
 // TestExtractEvents tests the extracting of metric specific events from the CSV output.
@@ -147,7 +153,7 @@ func TestExtractEvents(t *testing.T) {
 				},
 			},
 			wantErrs: []error{
-				errors.New(`record 2: strconv.ParseInt: parsing "notanumber": invalid syntax`),
+				errors.New(`record 2: start: strconv.ParseInt: parsing "notanumber": invalid syntax`),
 				errors.New(`record 3: non matching [Reboot bool 1422620454417 1430000000000 ], len was 5`),
 			},
 		},
@@ -165,6 +171,391 @@ func TestExtractEvents(t *testing.T) {
 	}
 }
 
+// TestValidate tests that malformed timelines are reported with the index of each offending event.
+func TestValidate(t *testing.T) {
+	input := []Event{
+		{Start: 1000, End: 2000},
+		{Start: 3000, End: 2500},
+		{Start: 2000, End: 4000},
+		{Start: 5000, End: -1},
+		{Start: -100, End: 100},
+	}
+	tests := []struct {
+		desc         string
+		expectSorted bool
+		want         []error
+	}{
+		{
+			desc:         "Sorted",
+			expectSorted: true,
+			want: []error{
+				errors.New("event 1: end 2500 before start 3000"),
+				errors.New("event 2: start 2000 before start 3000 of previous event"),
+				errors.New("event 4: negative start -100"),
+				errors.New("event 4: start -100 before start 5000 of previous event"),
+			},
+		},
+		{
+			desc: "Unsorted",
+			want: []error{
+				errors.New("event 1: end 2500 before start 3000"),
+				errors.New("event 4: negative start -100"),
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := Validate(input, test.expectSorted); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: Validate(%v, %v) = %v, want %v", test.desc, input, test.expectSorted, got, test.want)
+		}
+	}
+	if errs := Validate(input[:1], true); errs != nil {
+		t.Errorf("Validate(%v, true) = %v, want no errors", input[:1], errs)
+	}
+}
+
+// TestExtractEventsWithValidators tests that events failing validation are kept and reported as errors.
+func TestExtractEventsWithValidators(t *testing.T) {
+	input := strings.Join([]string{
+		FileHeader,
+		`Wakelock_in,service,1422620456417,1422620458417,"com.google.android.apps.docs",10051`,
+		`Wakelock_in,service,1422620458417,1422620459417,"com.google.android.gm",gmail`,
+		"Charging status,string,1422620452417,1422620453917,c,",
+	}, "\n")
+
+	wantEvents := map[string][]Event{
+		"Wakelock_in": {
+			{
+				Type:  "service",
+				Start: 1422620456417,
+				End:   1422620458417,
+				Value: "com.google.android.apps.docs",
+				Opt:   "10051",
+			},
+			{
+				Type:  "service",
+				Start: 1422620458417,
+				End:   1422620459417,
+				Value: "com.google.android.gm",
+				Opt:   "gmail",
+			},
+		},
+		"Charging status": {
+			{
+				Type:  "string",
+				Start: 1422620452417,
+				End:   1422620453917,
+				Value: "c",
+			},
+		},
+	}
+	wantErrs := []error{
+		&historianutils.ParseError{
+			Section: ValidationSection,
+			Line:    3,
+			Class:   historianutils.ErrorClassValidation,
+			Raw:     `Wakelock_in,service,1422620458417,1422620459417,com.google.android.gm,gmail`,
+			Err:     errors.New(`record 2: invalid UID "gmail" for metric "Wakelock_in"`),
+		},
+	}
+
+	got, errs := ExtractEventsWithValidators(input, nil, ValidateUID("Wakelock_in"))
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("ExtractEventsWithValidators(%v) generated unexpected errors\n got %v\n want %v", input, errs, wantErrs)
+	}
+	if diags := historianutils.Diagnostics(errs); len(diags) != 1 || diags[0].Class != historianutils.ErrorClassValidation {
+		t.Errorf("historianutils.Diagnostics(%v) = %v, want one diagnostic of class %q", errs, diags, historianutils.ErrorClassValidation)
+	}
+	if !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("ExtractEventsWithValidators(%v) generated incorrect events:\n got: %v\n want: %v", input, got, wantEvents)
+	}
+}
+
+// TestExtractEventsWithHeader tests extracting events where the columns are ordered by a header.
+func TestExtractEventsWithHeader(t *testing.T) {
+	tests := []struct {
+		desc       string
+		input      []string
+		wantEvents map[string][]Event
+		wantErrs   []error
+	}{
+		{
+			desc: "Reordered columns",
+			input: []string{
+				"start_time,end_time,metric,value,opt,type",
+				"1422620452417,1422620453917,Mobile network type,hspa,,string",
+				`1422620456417,1422620458417,Wakelock_in,"com.google.android.apps.docs/com.google/noogler@google.com",10051,service`,
+				"1422620452417,1422620453917,Charging status,c,,string",
+			},
+			wantEvents: map[string][]Event{
+				"Mobile network type": {
+					{Type: "string", Start: 1422620452417, End: 1422620453917, Value: "hspa"},
+				},
+				"Wakelock_in": {
+					{Type: "service", Start: 1422620456417, End: 1422620458417, Value: "com.google.android.apps.docs/com.google/noogler@google.com", Opt: "10051"},
+				},
+			},
+		},
+		{
+			desc: "Missing opt column",
+			input: []string{
+				"metric,value,type,end_time,start_time",
+				"Mobile network type,lte,string,1422620454417,1422620453917",
+			},
+			wantEvents: map[string][]Event{
+				"Mobile network type": {
+					{Type: "string", Start: 1422620453917, End: 1422620454417, Value: "lte"},
+				},
+				"Wakelock_in": nil,
+			},
+		},
+		{
+			desc: "Missing required column",
+			input: []string{
+				"metric,type,start_time,value,opt",
+				"Mobile network type,string,1422620452417,hspa,",
+			},
+			wantErrs: []error{errors.New(`missing column "end_time" in header`)},
+		},
+	}
+	for _, test := range tests {
+		events, errs := ExtractEventsWithHeader(strings.Join(test.input, "\n"), []string{"Mobile network type", "Wakelock_in"})
+		if !reflect.DeepEqual(errs, test.wantErrs) {
+			t.Errorf("%v: ExtractEventsWithHeader(%v) generated errors %v, want %v", test.desc, test.input, errs, test.wantErrs)
+		}
+		if !reflect.DeepEqual(events, test.wantEvents) {
+			t.Errorf("%v: ExtractEventsWithHeader(%v) = %v, want %v", test.desc, test.input, events, test.wantEvents)
+		}
+	}
+}
+
+// TestExtractEventsWithIndex tests that the index of each event lines up with its row in the input,
+// and that merging keeps the index of the first event.
+func TestExtractEventsWithIndex(t *testing.T) {
+	input := strings.Join([]string{
+		FileHeader,
+		"Screen,bool,1000,2000,true,",
+		"Charging status,string,1500,2500,c,",
+		"Screen,bool,1800,3000,true,",
+		"Screen,bool,5000,6000,true,",
+	}, "\n")
+	want := []Event{
+		{Type: "bool", Start: 1000, End: 2000, Value: "true", Index: 1},
+		{Type: "bool", Start: 1800, End: 3000, Value: "true", Index: 3},
+		{Type: "bool", Start: 5000, End: 6000, Value: "true", Index: 4},
+	}
+	events, errs := ExtractEventsWithIndex(input, []string{"Screen"})
+	if len(errs) > 0 {
+		t.Fatalf("ExtractEventsWithIndex(%v) unexpected errors: %v", input, errs)
+	}
+	rows := strings.Split(input, "\n")
+	for _, e := range events["Screen"] {
+		if !strings.HasPrefix(rows[e.Index], fmt.Sprintf("Screen,bool,%d,%d,", e.Start, e.End)) {
+			t.Errorf("ExtractEventsWithIndex(%v) event %v has index of row %q", input, e, rows[e.Index])
+		}
+	}
+	if !reflect.DeepEqual(events["Screen"], want) {
+		t.Errorf("ExtractEventsWithIndex(%v) = %v, want %v", input, events["Screen"], want)
+	}
+
+	wantMerged := []Event{
+		{Start: 1000, End: 3000, Index: 1},
+		{Type: "bool", Start: 5000, End: 6000, Value: "true", Index: 4},
+	}
+	if got := MergeEvents(events["Screen"]); !reflect.DeepEqual(got, wantMerged) {
+		t.Errorf("MergeEvents(%v) = %v, want %v", events["Screen"], got, wantMerged)
+	}
+}
+
+// TestExtractEventsGzip tests extracting events from a gzip compressed CSV.
+func TestExtractEventsGzip(t *testing.T) {
+	input := strings.Join([]string{
+		FileHeader,
+		"Mobile network type,string,1422620452417,1422620453917,hspa,",
+		"Charging status,string,1422620452417,1422620453917,c,",
+	}, "\n")
+	want := map[string][]Event{
+		"Mobile network type": {
+			{Type: "string", Start: 1422620452417, End: 1422620453917, Value: "hspa"},
+		},
+	}
+	compressed, err := historianutils.GzipCompress([]byte(input))
+	if err != nil {
+		t.Fatalf("GzipCompress(%v) unexpected error: %v", input, err)
+	}
+
+	got, errs := ExtractEventsGzip(bytes.NewReader(compressed), []string{"Mobile network type"})
+	if len(errs) > 0 {
+		t.Errorf("ExtractEventsGzip(%v) unexpected errors: %v", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractEventsGzip(%v) = %v, want %v", input, got, want)
+	}
+
+	// Uncompressed input should give an error rather than garbage.
+	got, errs = ExtractEventsGzip(strings.NewReader(input), []string{"Mobile network type"})
+	if got != nil || len(errs) != 1 {
+		t.Errorf("ExtractEventsGzip(%v) = %v, %v, want nil and one error", input, got, errs)
+	}
+}
+
+// TestExtractEventsInRange tests extracting only the events within a time window.
+func TestExtractEventsInRange(t *testing.T) {
+	input := strings.Join([]string{
+		FileHeader,
+		"CPU running,service,1000,2000,a,",
+		"CPU running,service,3000,8000,b,",
+		"CPU running,service,9000,9000,c,",
+		"CPU running,service,11000,12000,d,",
+		"Charging status,string,0,20000,c,",
+	}, "\n")
+	want := map[string][]Event{
+		"CPU running": {
+			{Type: "service", Start: 5000, End: 8000, Value: "b"},
+			{Type: "service", Start: 9000, End: 9000, Value: "c"},
+		},
+	}
+	got, errs := ExtractEventsInRange(input, []string{"CPU running"}, 5000, 10000)
+	if len(errs) > 0 {
+		t.Errorf("ExtractEventsInRange(%v, 5000, 10000) unexpected errors: %v", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractEventsInRange(%v, 5000, 10000) = %v, want %v", input, got, want)
+	}
+
+	if got, errs := ExtractEventsInRange(input, nil, 10000, 5000); got != nil || len(errs) != 1 {
+		t.Errorf("ExtractEventsInRange(%v, 10000, 5000) = %v, %v, want nil and one error", input, got, errs)
+	}
+}
+
+// TestExtractEventsFromReader tests extracting events from a reader one at a time.
+func TestExtractEventsFromReader(t *testing.T) {
+	input := strings.Join([]string{
+		FileHeader,
+		"Mobile network type,string,1422620452417,1422620453917,hspa,",
+		"Charging status,string,1422620452417,1422620453917,c,",
+		"",
+		"Mobile network type,string,1422620453917,bad,lte,",
+		`Mobile network type,string,1422620454917,1422620455917,"lte, 4g",`,
+	}, "\n")
+	want := []Event{
+		{Type: "string", Start: 1422620452417, End: 1422620453917, Value: "hspa"},
+		{Type: "string", Start: 1422620454917, End: 1422620455917, Value: "lte, 4g"},
+	}
+	var got []Event
+	errs := ExtractEventsFromReader(strings.NewReader(input), []string{"Mobile network type"}, func(metric string, e Event) error {
+		if metric != "Mobile network type" {
+			t.Errorf("ExtractEventsFromReader(%v) got event for unrequested metric %q", input, metric)
+		}
+		got = append(got, e)
+		return nil
+	})
+	if len(errs) != 1 {
+		t.Errorf("ExtractEventsFromReader(%v) got errors %v, want one error for the bad record", input, errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractEventsFromReader(%v) = %v, want %v", input, got, want)
+	}
+
+	// An error from the callback should stop extraction.
+	stop := errors.New("stop")
+	n := 0
+	errs = ExtractEventsFromReader(strings.NewReader(input), nil, func(string, Event) error {
+		n++
+		return stop
+	})
+	if n != 1 || len(errs) != 1 || errs[0] != stop {
+		t.Errorf("ExtractEventsFromReader(%v) with failing callback called it %d times and returned %v, want 1 call and [%v]", input, n, errs, stop)
+	}
+}
+
+// TestLoadAnnotations tests loading manually labelled regions from JSON.
+func TestLoadAnnotations(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		want    []Event
+		wantErr bool
+	}{
+		{
+			desc: "two annotations",
+			input: `[
+				{"label": "user reported lag here", "startMs": 1000, "endMs": 2000},
+				{"label": "screen flicker", "startMs": 3000, "endMs": 3000}
+			]`,
+			want: []Event{
+				{Type: "annotation", Start: 1000, End: 2000, Value: "user reported lag here"},
+				{Type: "annotation", Start: 3000, End: 3000, Value: "screen flicker"},
+			},
+		},
+		{
+			desc:    "malformed JSON",
+			input:   `[{"label": "user reported lag here", "startMs": 1000,`,
+			wantErr: true,
+		},
+		{
+			desc:    "end before start",
+			input:   `[{"label": "backwards", "startMs": 2000, "endMs": 1000}]`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := LoadAnnotations(strings.NewReader(test.input))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: LoadAnnotations(%v) error = %v, want error: %v", test.desc, test.input, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: LoadAnnotations(%v) = %v, want %v", test.desc, test.input, got, test.want)
+		}
+	}
+}
+
+// TestExtractEventsMulti tests extracting events from several CSVs concurrently.
+func TestExtractEventsMulti(t *testing.T) {
+	inputs := []string{
+		strings.Join([]string{
+			FileHeader,
+			"Charging status,string,1000,2000,c,",
+			"Reboot,bool,3000,4000,true,",
+		}, "\n"),
+		strings.Join([]string{
+			FileHeader,
+			"Charging status,string,5000,6000,d,",
+			"Reboot,bool,notanumber,8000,true,",
+		}, "\n"),
+		strings.Join([]string{
+			FileHeader,
+			"Mobile network type,string,1000,2000,lte,",
+		}, "\n"),
+		strings.Join([]string{
+			FileHeader,
+			"Charging status,string,9000,10000,c,",
+		}, "\n"),
+	}
+	wantEvents := map[string][]Event{
+		"Charging status": {
+			{Type: "string", Start: 1000, End: 2000, Value: "c"},
+			{Type: "string", Start: 5000, End: 6000, Value: "d"},
+			{Type: "string", Start: 9000, End: 10000, Value: "c"},
+		},
+		"Reboot": {
+			{Type: "bool", Start: 3000, End: 4000, Value: "true"},
+		},
+		"Temperature": nil,
+	}
+	wantErrs := []error{
+		errors.New(`input 1: record 2: start: strconv.ParseInt: parsing "notanumber": invalid syntax`),
+	}
+
+	got, errs := ExtractEventsMulti(inputs, []string{"Charging status", "Reboot", "Temperature"}, 2)
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("ExtractEventsMulti(%v) generated unexpected errors\n got %v\n want %v", inputs, errs, wantErrs)
+	}
+	if !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("ExtractEventsMulti(%v) generated incorrect events:\n got: %v\n want: %v", inputs, got, wantEvents)
+	}
+}
+
 // TestMergeEvents test merging overlapping events.
 func TestMergeEvents(t *testing.T) {
 	tests := []struct {
@@ -265,3 +656,608 @@ func TestMergeEvents(t *testing.T) {
 		}
 	}
 }
+
+// TestMergeAppend tests that merging events in batches gives the same result as merging them all at once.
+func TestMergeAppend(t *testing.T) {
+	first := []Event{
+		{Start: 0, End: 1000},
+		{Start: 500, End: 2000},
+		{Start: 3000, End: 4000},
+		{Start: 6000, End: 7000},
+	}
+	tests := []struct {
+		desc   string
+		second []Event
+	}{
+		{
+			desc: "New events after the merged set",
+			second: []Event{
+				{Start: 9000, End: 9500},
+				{Start: 8000, End: 8500},
+			},
+		},
+		{
+			desc: "New events overlapping the merged set",
+			second: []Event{
+				{Start: 3500, End: 6500},
+				{Start: 1500, End: 2500},
+				{Start: 7000, End: 7200},
+			},
+		},
+		{
+			desc: "New event before the merged set",
+			second: []Event{
+				{Start: -500, End: -100},
+			},
+		},
+		{
+			desc: "No new events",
+		},
+	}
+	for _, test := range tests {
+		merged := MergeEvents(append([]Event(nil), first...))
+		orig := append([]Event(nil), merged...)
+		all := append(append([]Event(nil), first...), test.second...)
+		want := MergeEvents(all)
+
+		if got := MergeAppend(merged, test.second); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: MergeAppend(%v, %v) = %v, want %v", test.desc, merged, test.second, got, want)
+		}
+		if !reflect.DeepEqual(merged, orig) {
+			t.Errorf("%v: MergeAppend(%v, %v) modified the merged events to %v", test.desc, orig, test.second, merged)
+		}
+	}
+}
+
+// TestMergeEventsKeepLongest tests merging overlapping events, keeping the value of the longest one.
+func TestMergeEventsKeepLongest(t *testing.T) {
+	input := []Event{
+		{Type: "service", Start: 0, End: 1000, Value: "short", Opt: "10001"},
+		{Type: "service", Start: 500, End: 3000, Value: "long", Opt: "10002"},
+		{Type: "service", Start: 2500, End: 3500, Value: "shorter", Opt: "10003"},
+		{Type: "service", Start: 5000, End: 6000, Value: "b"},
+		{Type: "service", Start: 5500, End: 6500, Value: "a"},
+		{Type: "service", Start: 8000, End: 9000, Value: "alone"},
+	}
+	want := []Event{
+		{Type: "service", Start: 0, End: 3500, Value: "long", Opt: "10002"},
+		{Type: "service", Start: 5000, End: 6500, Value: "a"},
+		{Type: "service", Start: 8000, End: 9000, Value: "alone"},
+	}
+	if got := MergeEventsKeepLongest(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeEventsKeepLongest(%v) = %v, want %v", input, got, want)
+	}
+}
+
+// TestMergeRuns tests merging events into contiguous spans split at Value changes.
+func TestMergeRuns(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []Event
+		want  []Event
+	}{
+		{
+			desc: "A then B then A with overlapping boundaries",
+			input: []Event{
+				{Type: "string", Start: 0, End: 1000, Value: "A"},
+				{Type: "string", Start: 990, End: 2000, Value: "B"},
+				{Type: "string", Start: 1990, End: 3000, Value: "A"},
+			},
+			want: []Event{
+				{Type: "string", Start: 0, End: 990, Value: "A"},
+				{Type: "string", Start: 990, End: 1990, Value: "B"},
+				{Type: "string", Start: 1990, End: 3000, Value: "A"},
+			},
+		},
+		{
+			desc: "Same Value runs are merged",
+			input: []Event{
+				{Type: "string", Start: 1000, End: 1500, Value: "A", Opt: "10001"},
+				{Type: "string", Start: 0, End: 1000, Value: "A", Opt: "10001"},
+				{Type: "string", Start: 1400, End: 2000, Value: "A", Opt: "10001"},
+				{Type: "string", Start: 3000, End: 4000, Value: "B"},
+			},
+			want: []Event{
+				{Type: "string", Start: 0, End: 2000, Value: "A", Opt: "10001"},
+				{Type: "string", Start: 3000, End: 4000, Value: "B"},
+			},
+		},
+		{
+			desc: "Event starting at the same time replaces the earlier one",
+			input: []Event{
+				{Type: "string", Start: 0, End: 1000, Value: "A"},
+				{Type: "string", Start: 0, End: 500, Value: "B"},
+			},
+			want: []Event{
+				{Type: "string", Start: 0, End: 500, Value: "B"},
+			},
+		},
+		{
+			desc: "No events",
+		},
+	}
+	for _, test := range tests {
+		orig := append([]Event(nil), test.input...)
+		if got := MergeRuns(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: MergeRuns(%v) = %v, want %v", test.desc, test.input, got, test.want)
+		}
+		if !reflect.DeepEqual(test.input, orig) {
+			t.Errorf("%v: MergeRuns(%v) modified the input to %v", test.desc, orig, test.input)
+		}
+	}
+}
+
+// TestMergeEventsWithReducer tests that merged events combine the payloads of their constituent events.
+func TestMergeEventsWithReducer(t *testing.T) {
+	tests := []struct {
+		desc   string
+		input  []Event
+		reduce Reducer
+		want   []Event
+	}{
+		{
+			desc: "Sum numeric values",
+			input: []Event{
+				{Type: "int", Start: 1000, End: 3000, Value: "2"},
+				{Type: "int", Start: 0, End: 1500, Value: "1.5"},
+				{Type: "int", Start: 2000, End: 2500, Value: "x"},
+				{Type: "int", Start: 4000, End: 5000, Value: "7"},
+			},
+			reduce: SumValues,
+			want: []Event{
+				{Type: "int", Start: 0, End: 3000, Value: "3.5"},
+				{Type: "int", Start: 4000, End: 5000, Value: "7"},
+			},
+		},
+		{
+			desc: "Join distinct values and apps",
+			input: []Event{
+				{Type: "service", Start: 0, End: 2000, Value: "sync", Opt: "10001", AppName: "com.a"},
+				{Type: "service", Start: 500, End: 1000, Value: "job", Opt: "10002", AppName: "com.b"},
+				{Type: "service", Start: 1500, End: 2500, Value: "sync", Opt: "10001", AppName: "com.a"},
+			},
+			reduce: JoinDistinct("|"),
+			want: []Event{
+				{Type: "service", Start: 0, End: 2500, Value: "sync|job", Opt: "10001|10002", AppName: "com.a|com.b"},
+			},
+		},
+		{
+			desc:   "No events",
+			reduce: SumValues,
+		},
+	}
+	for _, test := range tests {
+		orig := append([]Event(nil), test.input...)
+		if got := MergeEventsWithReducer(test.input, test.reduce); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: MergeEventsWithReducer(%v) = %v, want %v", test.desc, test.input, got, test.want)
+		}
+		if !reflect.DeepEqual(test.input, orig) {
+			t.Errorf("%v: MergeEventsWithReducer(%v) modified the input to %v", test.desc, orig, test.input)
+		}
+	}
+}
+
+// TestMergeWithPriority tests that the higher priority metric claims the time it overlaps with others.
+func TestMergeWithPriority(t *testing.T) {
+	sets := map[string][]Event{
+		"Charging on": {
+			{Type: "bool", Start: 2000, End: 4000, Value: "true"},
+		},
+		"Discharging active": {
+			{Type: "bool", Start: 0, End: 3000, Value: "true", Opt: "a"},
+			{Type: "bool", Start: 5000, End: 6000, Value: "true", Opt: "b"},
+		},
+		"Screen": {
+			{Type: "bool", Start: 1000, End: 5500, Value: "true"},
+		},
+	}
+	want := []Event{
+		{Type: "bool", Start: 0, End: 1000, Value: "true", Opt: "a"},
+		{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+		{Type: "bool", Start: 2000, End: 4000, Value: "true"},
+		{Type: "bool", Start: 4000, End: 5500, Value: "true"},
+		{Type: "bool", Start: 5500, End: 6000, Value: "true", Opt: "b"},
+	}
+	// Screen isn't listed so has the lowest priority.
+	priority := []string{"Charging on", "Discharging active"}
+	wantNoScreen := []Event{
+		{Type: "bool", Start: 0, End: 2000, Value: "true", Opt: "a"},
+		{Type: "bool", Start: 2000, End: 4000, Value: "true"},
+		{Type: "bool", Start: 4000, End: 5000, Value: "true"},
+		{Type: "bool", Start: 5000, End: 6000, Value: "true", Opt: "b"},
+	}
+	if got := MergeWithPriority(sets, priority); !reflect.DeepEqual(got, wantNoScreen) {
+		t.Errorf("MergeWithPriority(%v, %v) = %v, want %v", sets, priority, got, wantNoScreen)
+	}
+
+	priority = []string{"Charging on", "Screen", "Discharging active"}
+	if got := MergeWithPriority(sets, priority); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeWithPriority(%v, %v) = %v, want %v", sets, priority, got, want)
+	}
+
+	// Events that haven't finished are ongoing until the latest time of any event.
+	open := map[string][]Event{
+		"Charging on": {
+			{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+		},
+		"Screen": {
+			{Type: "bool", Start: 0, End: -1, Value: "true"},
+		},
+		"Wakelock_in": {
+			{Type: "service", Start: 3000, End: 5000, Value: "*alarm*"},
+		},
+	}
+	priority = []string{"Charging on", "Wakelock_in"}
+	wantOpen := []Event{
+		{Type: "bool", Start: 0, End: 1000, Value: "true"},
+		{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+		{Type: "bool", Start: 2000, End: 3000, Value: "true"},
+		{Type: "service", Start: 3000, End: 5000, Value: "*alarm*"},
+	}
+	if got := MergeWithPriority(open, priority); !reflect.DeepEqual(got, wantOpen) {
+		t.Errorf("MergeWithPriority(%v, %v) = %v, want %v", open, priority, got, wantOpen)
+	}
+	priority = []string{"Charging on", "Screen"}
+	wantOpen = []Event{
+		{Type: "bool", Start: 0, End: 1000, Value: "true"},
+		{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+		{Type: "bool", Start: 2000, End: -1, Value: "true"},
+	}
+	if got := MergeWithPriority(open, priority); !reflect.DeepEqual(got, wantOpen) {
+		t.Errorf("MergeWithPriority(%v, %v) = %v, want %v", open, priority, got, wantOpen)
+	}
+}
+
+// TestMergeBy tests merging overlapping events grouped by app name.
+func TestMergeBy(t *testing.T) {
+	input := []Event{
+		{Start: 3000, End: 4000, AppName: "com.google.android.gms"},
+		{Start: 0, End: 1000, AppName: "com.google.android.gms"},
+		{Start: 500, End: 2000, AppName: "com.google.android.gms"},
+		{Start: 500, End: 1500, AppName: "com.android.chrome"},
+		{Start: 1500, End: 2500, AppName: "com.android.chrome"},
+	}
+	want := map[string][]Event{
+		"com.google.android.gms": {
+			{Start: 0, End: 2000},
+			{Start: 3000, End: 4000, AppName: "com.google.android.gms"},
+		},
+		"com.android.chrome": {
+			{Start: 500, End: 2500},
+		},
+	}
+	orig := append([]Event(nil), input...)
+	got := MergeBy(input, func(e Event) string { return e.AppName })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeBy(%v, AppName) = %v, want %v", input, got, want)
+	}
+	if !reflect.DeepEqual(input, orig) {
+		t.Errorf("MergeBy(%v, AppName) modified the input to %v", orig, input)
+	}
+}
+
+// TestMergeMaps tests combining two event maps with and without merging overlaps.
+func TestMergeMaps(t *testing.T) {
+	a := map[string][]Event{
+		"Screen":  {{Start: 2000, End: 3000}, {Start: 5000, End: 6000}},
+		"Wifi on": {{Start: 0, End: 10000}},
+	}
+	b := map[string][]Event{
+		"Screen":              {{Start: 0, End: 1000}, {Start: 2500, End: 4000}},
+		"Mobile radio active": {{Start: 100, End: 200}},
+	}
+	origA, origB := fmt.Sprint(a), fmt.Sprint(b)
+
+	tests := []struct {
+		desc          string
+		mergeOverlaps bool
+		want          map[string][]Event
+	}{
+		{
+			desc: "concatenate",
+			want: map[string][]Event{
+				"Screen":              {{Start: 0, End: 1000}, {Start: 2000, End: 3000}, {Start: 2500, End: 4000}, {Start: 5000, End: 6000}},
+				"Wifi on":             {{Start: 0, End: 10000}},
+				"Mobile radio active": {{Start: 100, End: 200}},
+			},
+		},
+		{
+			desc:          "merge overlaps",
+			mergeOverlaps: true,
+			want: map[string][]Event{
+				"Screen":              {{Start: 0, End: 1000}, {Start: 2000, End: 4000}, {Start: 5000, End: 6000}},
+				"Wifi on":             {{Start: 0, End: 10000}},
+				"Mobile radio active": {{Start: 100, End: 200}},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := MergeMaps(a, b, test.mergeOverlaps); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: MergeMaps(%v, %v, %v) = %v, want %v", test.desc, a, b, test.mergeOverlaps, got, test.want)
+		}
+		if fmt.Sprint(a) != origA || fmt.Sprint(b) != origB {
+			t.Errorf("%v: MergeMaps modified the input maps to %v and %v", test.desc, a, b)
+		}
+	}
+}
+
+// TestFlagProximate tests flagging events that are close to their neighbors without merging them.
+func TestFlagProximate(t *testing.T) {
+	tests := []struct {
+		desc          string
+		input         []Event
+		gapMs         int64
+		wantEvents    []Event
+		wantProximate []bool
+	}{
+		{
+			desc: "Two events 5ms apart",
+			input: []Event{
+				{Start: 1005, End: 2000},
+				{Start: 0, End: 1000},
+				{Start: 5000, End: 6000},
+			},
+			gapMs: 10,
+			wantEvents: []Event{
+				{Start: 0, End: 1000},
+				{Start: 1005, End: 2000},
+				{Start: 5000, End: 6000},
+			},
+			wantProximate: []bool{true, true, false},
+		},
+		{
+			desc: "Gap larger than threshold",
+			input: []Event{
+				{Start: 0, End: 1000},
+				{Start: 1005, End: 2000},
+			},
+			gapMs: 4,
+			wantEvents: []Event{
+				{Start: 0, End: 1000},
+				{Start: 1005, End: 2000},
+			},
+			wantProximate: []bool{false, false},
+		},
+		{
+			desc: "Overlapping events",
+			input: []Event{
+				{Start: 0, End: 1000},
+				{Start: 500, End: 2000},
+			},
+			wantEvents: []Event{
+				{Start: 0, End: 1000},
+				{Start: 500, End: 2000},
+			},
+			wantProximate: []bool{true, true},
+		},
+		{
+			desc: "Event close to the end of an earlier long event",
+			input: []Event{
+				{Start: 0, End: 10000},
+				{Start: 100, End: 200},
+				{Start: 10005, End: 11000},
+				{Start: 20000, End: 21000},
+			},
+			gapMs: 10,
+			wantEvents: []Event{
+				{Start: 0, End: 10000},
+				{Start: 100, End: 200},
+				{Start: 10005, End: 11000},
+				{Start: 20000, End: 21000},
+			},
+			wantProximate: []bool{true, true, true, false},
+		},
+		{
+			desc: "Event that hasn't finished",
+			input: []Event{
+				{Start: 0, End: -1},
+				{Start: 50000, End: 60000},
+			},
+			gapMs: 10,
+			wantEvents: []Event{
+				{Start: 0, End: -1},
+				{Start: 50000, End: 60000},
+			},
+			wantProximate: []bool{true, true},
+		},
+	}
+	for _, test := range tests {
+		gotEvents, gotProximate := FlagProximate(test.input, test.gapMs)
+		if !reflect.DeepEqual(gotEvents, test.wantEvents) || !reflect.DeepEqual(gotProximate, test.wantProximate) {
+			t.Errorf("%v: FlagProximate(%v, %d) = %v, %v, want %v, %v", test.desc, test.input, test.gapMs, gotEvents, gotProximate, test.wantEvents, test.wantProximate)
+		}
+	}
+}
+
+// TestDiffEvents tests comparing the events of two timelines.
+func TestDiffEvents(t *testing.T) {
+	a := []Event{
+		{Start: 8000, End: 9000, Value: "wl_c", Opt: "10001"},
+		{Start: 1000, End: 2000, Value: "wl_a", Opt: "10001"},
+		{Start: 5000, End: 6000, Value: "wl_b", Opt: "10002"},
+	}
+	b := []Event{
+		{Start: 1010, End: 1990, Value: "wl_a", Opt: "10001"},
+		{Start: 8300, End: 9300, Value: "wl_c", Opt: "10001"},
+		{Start: 5000, End: 6000, Value: "wl_b", Opt: "10003"},
+	}
+	wantAdded := []Event{
+		{Start: 5000, End: 6000, Value: "wl_b", Opt: "10003"},
+	}
+	wantRemoved := []Event{
+		{Start: 5000, End: 6000, Value: "wl_b", Opt: "10002"},
+	}
+	wantChanged := []Event{
+		{Start: 8300, End: 9300, Value: "wl_c", Opt: "10001"},
+	}
+
+	added, removed, changed := DiffEvents(a, b, 50)
+	if !reflect.DeepEqual(added, wantAdded) {
+		t.Errorf("DiffEvents(%v, %v, 50) added = %v, want %v", a, b, added, wantAdded)
+	}
+	if !reflect.DeepEqual(removed, wantRemoved) {
+		t.Errorf("DiffEvents(%v, %v, 50) removed = %v, want %v", a, b, removed, wantRemoved)
+	}
+	if !reflect.DeepEqual(changed, wantChanged) {
+		t.Errorf("DiffEvents(%v, %v, 50) changed = %v, want %v", a, b, changed, wantChanged)
+	}
+}
+
+// TestPairNearest tests pairing events with the nearest events of another set.
+func TestPairNearest(t *testing.T) {
+	a := []Event{
+		{Start: 5000, End: 5100, Value: "wakeup"},
+		{Start: 1000, End: 1100, Value: "wakeup"},
+		{Start: 3000, End: 3100, Value: "wakeup"},
+		// Equally near the alarms at 2000 and 4800.
+		{Start: 3400, End: 3500, Value: "wakeup"},
+	}
+	b := []Event{
+		{Start: 4800, End: 4900, Value: "alarm"},
+		{Start: 1300, End: 1400, Value: "alarm"},
+		{Start: 2000, End: 2100, Value: "alarm"},
+		{Start: 9000, End: 9100, Value: "alarm"},
+	}
+	want := []EventPair{
+		{A: a[0], B: b[0], DeltaMs: -200, Paired: true},
+		{A: a[1], B: b[1], DeltaMs: 300, Paired: true},
+		{A: a[2], B: b[2], DeltaMs: -1000, Paired: true},
+		{A: a[3], B: b[2], DeltaMs: -1400, Paired: true},
+	}
+	if got := PairNearest(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("PairNearest(%v, %v) = %v, want %v", a, b, got, want)
+	}
+
+	wantUnpaired := []EventPair{{A: a[0]}}
+	if got := PairNearest(a[:1], nil); !reflect.DeepEqual(got, wantUnpaired) {
+		t.Errorf("PairNearest(%v, nil) = %v, want %v", a[:1], got, wantUnpaired)
+	}
+}
+
+// TestParseValueKV tests splitting an event value into key value pairs.
+func TestParseValueKV(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]string
+	}{
+		{
+			value: "pkg=com.foo;reason=alarm",
+			want:  map[string]string{"pkg": "com.foo", "reason": "alarm"},
+		},
+		{
+			value: "pkg=com.foo;urgent;uri=content://a=b",
+			want:  map[string]string{"pkg": "com.foo", "urgent": "", "uri": "content://a=b"},
+		},
+		{
+			value: "standalone",
+			want:  map[string]string{"standalone": ""},
+		},
+		{
+			value: "",
+			want:  map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		e := Event{Value: test.value}
+		if got := ParseValueKV(e); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseValueKV(%v) = %v, want %v", e, got, test.want)
+		}
+	}
+}
+
+// TestWakeupReasons tests extracting the wakeup reasons of CPU running events and grouping them by reason.
+func TestWakeupReasons(t *testing.T) {
+	running := []Event{
+		{Type: "string", Start: 1000, End: 3000, Value: "1000~1200~57 qcom,smd-modem|2000~Abort:Pending Wakeup Sources: ipc000000b0"},
+		{Type: "string", Start: 5000, End: 6000, Value: "5000~5100~57 qcom,smd-modem"},
+		{Type: "string", Start: 7000, End: 8000, Value: "7000~bad~reason|x~Unknown wakeup reason"},
+	}
+	wantEvents := []Event{
+		{Type: "string", Start: 1000, End: 1200, Value: "57 qcom,smd-modem"},
+		{Type: "string", Start: 2000, End: 2000, Value: "Abort:Pending Wakeup Sources: ipc000000b0"},
+		{Type: "string", Start: 5000, End: 5100, Value: "57 qcom,smd-modem"},
+	}
+	wantErrs := []error{
+		errors.New(`invalid wakeup reason "7000~bad~reason" end: strconv.ParseInt: parsing "bad": invalid syntax`),
+		errors.New(`invalid wakeup reason "x~Unknown wakeup reason" start: strconv.ParseInt: parsing "x": invalid syntax`),
+	}
+	got, errs := WakeupReasons(running)
+	if !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("WakeupReasons(%v) = %v, want %v", running, got, wantEvents)
+	}
+	if fmt.Sprint(errs) != fmt.Sprint(wantErrs) {
+		t.Errorf("WakeupReasons(%v) errors = %v, want %v", running, errs, wantErrs)
+	}
+
+	want := map[string][]Event{
+		"57 qcom,smd-modem": {
+			{Type: "string", Start: 1000, End: 1200, Value: "57 qcom,smd-modem"},
+			{Type: "string", Start: 5000, End: 5100, Value: "57 qcom,smd-modem"},
+		},
+		"Abort:Pending Wakeup Sources: ipc000000b0": {
+			{Type: "string", Start: 2000, End: 2000, Value: "Abort:Pending Wakeup Sources: ipc000000b0"},
+		},
+	}
+	if grouped := GroupByReason(got); !reflect.DeepEqual(grouped, want) {
+		t.Errorf("GroupByReason(%v) = %v, want %v", got, grouped, want)
+	}
+}
+
+// TestFormatEvent tests printing events with wall clock times.
+func TestFormatEvent(t *testing.T) {
+	// 2015-01-30 12:20:51.417 UTC.
+	base := int64(1422620451417)
+	tests := []struct {
+		desc string
+		e    Event
+		want string
+	}{
+		{
+			desc: "Finished event",
+			e:    Event{Type: "service", Start: 1000, End: 3723005, Value: "com.google.android.gms"},
+			want: "[12:20:52.417 - 13:22:54.422] service com.google.android.gms",
+		},
+		{
+			desc: "Open event",
+			e:    Event{Type: "bool", Start: 0, End: -1, Value: "true"},
+			want: "[12:20:51.417 - ...] bool true",
+		},
+	}
+	for _, test := range tests {
+		if got := FormatEvent(test.e, base, time.UTC); got != test.want {
+			t.Errorf("%v: FormatEvent(%v, %d, UTC) = %q, want %q", test.desc, test.e, base, got, test.want)
+		}
+	}
+}
+
+// benchmarkCSV returns a CSV with n events of a few metrics.
+func benchmarkCSV(n int) string {
+	lines := []string{FileHeader}
+	for i := 0; i < n; i++ {
+		lines = append(lines,
+			fmt.Sprintf(`Wakelock_in,service,%d,%d,"com.google.android.gms, sync",10012`, i*1000, i*1000+500),
+			fmt.Sprintf(`Screen,bool,%d,%d,true,`, i*1000, i*1000+800))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// BenchmarkExtractEvents measures extracting events by splitting the CSV one record at a time.
+func BenchmarkExtractEvents(b *testing.B) {
+	input := benchmarkCSV(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ExtractEvents(input, []string{"Screen"})
+	}
+}
+
+// BenchmarkExtractEventsParseCSV measures extracting events from the fully parsed CSV, for comparison
+// with BenchmarkExtractEvents.
+func BenchmarkExtractEventsParseCSV(b *testing.B) {
+	input := benchmarkCSV(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extractRecords(parsedRecords(checkinutil.ParseCSV(input)), []string{"Screen"}, nil, false)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// export.go contains functions to export extracted events in formats used by other tools.
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+const (
+	// EventsSchema is the name of the schema of events exported as JSON.
+	EventsSchema = "battery-historian-events"
+	// EventsSchemaVersion is the version of the schema of events exported as JSON, incremented
+	// whenever fields are removed or change meaning.
+	EventsSchemaVersion = 1
+)
+
+// ganttBar is a single event in a Gantt chart row.
+type ganttBar struct {
+	Start int64 `json:"start"`
+	// End is nil for events that haven't finished, so it's exported as null.
+	End   *int64 `json:"end"`
+	Value string `json:"value"`
+	App   string `json:"app"`
+}
+
+// ganttRow is the Gantt chart row for a single metric.
+type ganttRow struct {
+	Metric string     `json:"metric"`
+	Bars   []ganttBar `json:"bars"`
+}
+
+// MarshalGantt encodes the map of metric to events, as returned by ExtractEvents, as JSON for Gantt
+// charts, with one row per metric in metric name order:
+//
+//	[{"metric": "Screen", "bars": [{"start": 1000, "end": 2000, "value": "true", "app": ""}]}]
+//
+// Events that haven't finished have a null end. The bars of each row are in the order of the events.
+func MarshalGantt(m map[string][]Event) ([]byte, error) {
+	var metrics []string
+	for metric := range m {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	rows := make([]ganttRow, 0, len(metrics))
+	for _, metric := range metrics {
+		bars := make([]ganttBar, 0, len(m[metric]))
+		for _, e := range m[metric] {
+			bar := ganttBar{Start: e.Start, Value: e.Value, App: e.AppName}
+			if e.End != -1 {
+				end := e.End
+				bar.End = &end
+			}
+			bars = append(bars, bar)
+		}
+		rows = append(rows, ganttRow{Metric: metric, Bars: bars})
+	}
+	return json.Marshal(rows)
+}
+
+// WriteEventsCSV writes the map of metric to events, as returned by ExtractEvents, to w as a Historian
+// CSV starting with FileHeader. Metrics are written in name order, and the events of each metric in
+// their original order.
+func WriteEventsCSV(w io.Writer, m map[string][]Event) {
+	var metrics []string
+	for metric := range m {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	s := NewState(w, true)
+	for _, metric := range metrics {
+		for _, e := range m[metric] {
+			s.PrintEvent(metric, e)
+		}
+	}
+}
+
+// jsonHeader identifies the schema of exported events.
+type jsonHeader struct {
+	Schema  string `json:"schema"`
+	Version int    `json:"version"`
+}
+
+// jsonEvent is a single exported event.
+type jsonEvent struct {
+	// Metric is only set for NDJSON, where events aren't grouped by metric.
+	Metric string `json:"metric,omitempty"`
+	Type   string `json:"type"`
+	Start  int64  `json:"start"`
+	// End is -1 for events that haven't finished.
+	End    int64  `json:"end"`
+	Value  string `json:"value"`
+	Opt    string `json:"opt"`
+	App    string `json:"app,omitempty"`
+	Marker bool   `json:"marker,omitempty"`
+}
+
+func newJSONEvent(metric string, e Event) jsonEvent {
+	return jsonEvent{
+		Metric: metric,
+		Type:   e.Type,
+		Start:  e.Start,
+		End:    e.End,
+		Value:  e.Value,
+		Opt:    e.Opt,
+		App:    e.AppName,
+		Marker: e.Marker,
+	}
+}
+
+// MarshalEventsJSON encodes the map of metric to events, as returned by ExtractEvents, as a JSON
+// object with the schema and version, and the events of each metric in their original order:
+//
+//	{"schema": "battery-historian-events", "version": 1, "metrics": {"Screen": [{"type": "bool",
+//	"start": 1000, "end": 2000, "value": "true", "opt": ""}]}}
+func MarshalEventsJSON(m map[string][]Event) ([]byte, error) {
+	metrics := make(map[string][]jsonEvent, len(m))
+	for metric, events := range m {
+		es := make([]jsonEvent, 0, len(events))
+		for _, e := range events {
+			es = append(es, newJSONEvent("", e))
+		}
+		metrics[metric] = es
+	}
+	return json.Marshal(struct {
+		jsonHeader
+		Metrics map[string][]jsonEvent `json:"metrics"`
+	}{jsonHeader{EventsSchema, EventsSchemaVersion}, metrics})
+}
+
+// WriteEventsNDJSON writes the map of metric to events, as returned by ExtractEvents, to w as
+// newline delimited JSON. The first line holds the schema and version, followed by one line per
+// event with the same fields as MarshalEventsJSON plus the metric. Metrics are written in name
+// order, and the events of each metric in their original order. If w has a Flush method, such as an
+// http.ResponseWriter, it is called after the events of each metric, so large reports can be
+// rendered progressively.
+func WriteEventsNDJSON(w io.Writer, m map[string][]Event) error {
+	flusher, _ := w.(interface {
+		Flush()
+	})
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(jsonHeader{EventsSchema, EventsSchemaVersion}); err != nil {
+		return err
+	}
+	var metrics []string
+	for metric := range m {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		for _, e := range m[metric] {
+			if err := enc.Encode(newJSONEvent(metric, e)); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
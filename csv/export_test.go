@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMarshalGantt tests the JSON shape of the Gantt export of two metrics.
+func TestMarshalGantt(t *testing.T) {
+	input := map[string][]Event{
+		"Wakelock_in": {
+			{Type: "service", Start: 1000, End: 2000, Value: "com.google.android.gms", Opt: "10041", AppName: "com.google.android.gms"},
+			{Type: "service", Start: 3000, End: -1, Value: "*alarm*", Opt: "1000"},
+		},
+		"Screen": {
+			{Type: "bool", Start: 500, End: 1500, Value: "true"},
+		},
+	}
+	want := []interface{}{
+		map[string]interface{}{
+			"metric": "Screen",
+			"bars": []interface{}{
+				map[string]interface{}{"start": 500.0, "end": 1500.0, "value": "true", "app": ""},
+			},
+		},
+		map[string]interface{}{
+			"metric": "Wakelock_in",
+			"bars": []interface{}{
+				map[string]interface{}{"start": 1000.0, "end": 2000.0, "value": "com.google.android.gms", "app": "com.google.android.gms"},
+				map[string]interface{}{"start": 3000.0, "end": nil, "value": "*alarm*", "app": ""},
+			},
+		},
+	}
+
+	b, err := MarshalGantt(input)
+	if err != nil {
+		t.Fatalf("MarshalGantt(%v) unexpected error: %v", input, err)
+	}
+	var got interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("MarshalGantt(%v) returned invalid JSON %q: %v", input, b, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MarshalGantt(%v) = %s, want %v", input, b, want)
+	}
+}
+
+// TestMarshalEventsJSON tests the JSON export includes the schema header and all event fields.
+func TestMarshalEventsJSON(t *testing.T) {
+	input := map[string][]Event{
+		"Wakelock_in": {
+			{Type: "service", Start: 1000, End: -1, Value: "*alarm*", Opt: "1000", AppName: "android"},
+		},
+	}
+	want := `{"schema":"battery-historian-events","version":1,"metrics":{"Wakelock_in":[{"type":"service","start":1000,"end":-1,"value":"*alarm*","opt":"1000","app":"android"}]}}`
+
+	b, err := MarshalEventsJSON(input)
+	if err != nil {
+		t.Fatalf("MarshalEventsJSON(%v) unexpected error: %v", input, err)
+	}
+	if string(b) != want {
+		t.Errorf("MarshalEventsJSON(%v) = %s, want %s", input, b, want)
+	}
+}
+
+// TestWriteEventsNDJSON tests the NDJSON export writes a header line followed by one line per event.
+func TestWriteEventsNDJSON(t *testing.T) {
+	input := map[string][]Event{
+		"Wakelock_in": {
+			{Type: "service", Start: 1000, End: 2000, Value: "*alarm*", Opt: "1000"},
+		},
+		"Screen": {
+			{Type: "bool", Start: 500, End: 1500, Value: "true"},
+			NewMarker(1500, "RESET"),
+		},
+	}
+	want := strings.Join([]string{
+		`{"schema":"battery-historian-events","version":1}`,
+		`{"metric":"Screen","type":"bool","start":500,"end":1500,"value":"true","opt":""}`,
+		`{"metric":"Screen","type":"marker","start":1500,"end":1500,"value":"RESET","opt":"","marker":true}`,
+		`{"metric":"Wakelock_in","type":"service","start":1000,"end":2000,"value":"*alarm*","opt":"1000"}`,
+		``,
+	}, "\n")
+
+	var b bytes.Buffer
+	if err := WriteEventsNDJSON(&b, input); err != nil {
+		t.Fatalf("WriteEventsNDJSON(%v) unexpected error: %v", input, err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("WriteEventsNDJSON(%v) = %s, want %s", input, got, want)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// query.go contains a small expression language for filtering extracted events.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chenjiacun35/battery-historian/historianutils"
+)
+
+// predicate reports whether the event of the given metric matches. Events that haven't finished are
+// ongoing until reportEndMs.
+type predicate func(metric string, e Event, reportEndMs int64) bool
+
+// Query is a compiled filter expression over events, as created by CompileQuery.
+type Query struct {
+	expr  string
+	match predicate
+}
+
+// stringFields are the event fields that are compared as strings.
+var stringFields = map[string]func(metric string, e Event) string{
+	"metric": func(metric string, e Event) string { return metric },
+	"type":   func(metric string, e Event) string { return e.Type },
+	"value":  func(metric string, e Event) string { return e.Value },
+	"opt":    func(metric string, e Event) string { return e.Opt },
+	"app":    func(metric string, e Event) string { return e.AppName },
+}
+
+// intFields are the event fields that are compared as milliseconds.
+var intFields = map[string]func(e Event, reportEndMs int64) int64{
+	"start": func(e Event, reportEndMs int64) int64 { return e.Start },
+	"end":   func(e Event, reportEndMs int64) int64 { return e.End },
+	"duration": func(e Event, reportEndMs int64) int64 {
+		if e.End == -1 {
+			return historianutils.MaxInt64(reportEndMs-e.Start, 0)
+		}
+		return e.End - e.Start
+	},
+}
+
+// CompileQuery compiles a filter expression such as
+//
+//	metric == "Wakelock_in" && value contains "gms" && duration > 5s
+//
+// Comparisons are of a field, one of metric, type, value, opt, app, start, end and duration, with a
+// literal. The string fields support ==, !=, contains and matches, which takes a regular expression,
+// and are compared with double quoted strings. The start, end and duration fields, in milliseconds,
+// support ==, !=, <, <=, > and >=, and are compared with integers in milliseconds or durations as
+// accepted by time.ParseDuration. Comparisons can be combined with &&, || and !, and grouped with
+// parentheses. Events that haven't finished have an end of -1, and their duration is how long they
+// have been ongoing at the end of the report, so duration > 5s finds wakelocks still held.
+func CompileQuery(expr string) (*Query, error) {
+	toks, err := tokenizeQuery(expr)
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %v", expr, err)
+	}
+	p := &queryParser{toks: toks}
+	match, err := p.parseOr()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %v", expr, err)
+	}
+	return &Query{expr: expr, match: match}, nil
+}
+
+// String returns the expression the query was compiled from.
+func (q *Query) String() string {
+	return q.expr
+}
+
+// Match reports whether the event of the given metric matches the query. If the event hasn't
+// finished, it is ongoing until reportEndMs.
+func (q *Query) Match(metric string, e Event, reportEndMs int64) bool {
+	return q.match(metric, e, reportEndMs)
+}
+
+// Filter returns the events in the map of metric to events, as returned by ExtractEvents, matching
+// the query. Events that haven't finished are ongoing until the latest time of any event. Metrics
+// without any matching events are not included. The given map is not modified.
+func (q *Query) Filter(m map[string][]Event) map[string][]Event {
+	reportEnd := latestTime(m)
+	res := make(map[string][]Event)
+	for metric, events := range m {
+		for _, e := range events {
+			if q.match(metric, e, reportEnd) {
+				res[metric] = append(res[metric], e)
+			}
+		}
+	}
+	return res
+}
+
+// Filter compiles the filter expression, as described for CompileQuery, and returns the events in
+// the map of metric to events matching it.
+func Filter(m map[string][]Event, expr string) (map[string][]Event, error) {
+	q, err := CompileQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	return q.Filter(m), nil
+}
+
+// tokenKind is the kind of a query token.
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+// queryToken is a single token of a query.
+type queryToken struct {
+	kind tokenKind
+	// text is the token as it appears in the query, except for strings, which are unquoted.
+	text string
+}
+
+// queryOps are the operator tokens, with longer operators before their prefixes.
+var queryOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// tokenizeQuery splits the query into tokens.
+func tokenizeQuery(s string) ([]queryToken, error) {
+	var toks []queryToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %v", s[i:j+1], err)
+			}
+			toks = append(toks, queryToken{tokenString, str})
+			i = j + 1
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == '_') {
+				j++
+			}
+			kind := tokenIdent
+			if !unicode.IsLetter(c) {
+				kind = tokenNumber
+			}
+			toks = append(toks, queryToken{kind, s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range queryOps {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, queryToken{tokenOp, op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+// queryParser is a recursive descent parser building a predicate from query tokens.
+type queryParser struct {
+	toks []queryToken
+	pos  int
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (p *queryParser) accept(text string) bool {
+	if p.pos < len(p.toks) && p.toks[p.pos].kind != tokenString && p.toks[p.pos].text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// next consumes and returns the next token.
+func (p *queryParser) next() (queryToken, error) {
+	if p.pos >= len(p.toks) {
+		return queryToken{}, fmt.Errorf("unexpected end of query")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *queryParser) parseOr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(metric string, e Event, end int64) bool { return l(metric, e, end) || right(metric, e, end) }
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (predicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(metric string, e Event, end int64) bool { return l(metric, e, end) && right(metric, e, end) }
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (predicate, error) {
+	if p.accept("!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(metric string, e Event, end int64) bool { return !inner(metric, e, end) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses a comparison of a field with a literal.
+func (p *queryParser) parseComparison() (predicate, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if field.kind != tokenIdent {
+		return nil, fmt.Errorf("expected field, got %q", field.text)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	lit, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if get, ok := stringFields[field.text]; ok {
+		if lit.kind != tokenString {
+			return nil, fmt.Errorf("field %s must be compared with a string, got %q", field.text, lit.text)
+		}
+		return stringComparison(get, op.text, lit.text)
+	}
+	if get, ok := intFields[field.text]; ok {
+		if lit.kind != tokenNumber {
+			return nil, fmt.Errorf("field %s must be compared with a number or duration, got %q", field.text, lit.text)
+		}
+		ms, err := parseQueryMs(lit.text)
+		if err != nil {
+			return nil, err
+		}
+		return intComparison(get, op.text, ms)
+	}
+	return nil, fmt.Errorf("unknown field %q", field.text)
+}
+
+func stringComparison(get func(metric string, e Event) string, op, lit string) (predicate, error) {
+	switch op {
+	case "==":
+		return func(metric string, e Event, _ int64) bool { return get(metric, e) == lit }, nil
+	case "!=":
+		return func(metric string, e Event, _ int64) bool { return get(metric, e) != lit }, nil
+	case "contains":
+		return func(metric string, e Event, _ int64) bool { return strings.Contains(get(metric, e), lit) }, nil
+	case "matches":
+		re, err := regexp.Compile(lit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", lit, err)
+		}
+		return func(metric string, e Event, _ int64) bool { return re.MatchString(get(metric, e)) }, nil
+	}
+	return nil, fmt.Errorf("unsupported string operator %q", op)
+}
+
+func intComparison(get func(e Event, reportEndMs int64) int64, op string, lit int64) (predicate, error) {
+	var cmp func(v int64) bool
+	switch op {
+	case "==":
+		cmp = func(v int64) bool { return v == lit }
+	case "!=":
+		cmp = func(v int64) bool { return v != lit }
+	case "<":
+		cmp = func(v int64) bool { return v < lit }
+	case "<=":
+		cmp = func(v int64) bool { return v <= lit }
+	case ">":
+		cmp = func(v int64) bool { return v > lit }
+	case ">=":
+		cmp = func(v int64) bool { return v >= lit }
+	default:
+		return nil, fmt.Errorf("unsupported numeric operator %q", op)
+	}
+	return func(metric string, e Event, reportEndMs int64) bool { return cmp(get(e, reportEndMs)) }, nil
+}
+
+// parseQueryMs parses an integer number of milliseconds, or a duration such as 5s.
+func parseQueryMs(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number or duration %q", s)
+	}
+	return int64(d / time.Millisecond), nil
+}
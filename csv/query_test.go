@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestFilter tests filtering events with query expressions.
+func TestFilter(t *testing.T) {
+	events := map[string][]Event{
+		"Wakelock_in": {
+			{Type: "service", Start: 0, End: 10000, Value: "com.google.android.gms", Opt: "10041"},
+			{Type: "service", Start: 20000, End: 21000, Value: "com.google.android.gms", Opt: "10041"},
+			{Type: "service", Start: 30000, End: 40000, Value: "*alarm*", Opt: "1000"},
+			{Type: "service", Start: 50000, End: -1, Value: "com.google.android.gms", Opt: "10041"},
+		},
+		"Screen": {
+			{Type: "bool", Start: 0, End: 60000, Value: "true"},
+		},
+	}
+	tests := []struct {
+		expr string
+		want map[string][]Event
+	}{
+		{
+			expr: `metric == "Wakelock_in" && value contains "gms" && duration > 5s`,
+			want: map[string][]Event{
+				// The wakelock still held at the end of the report has been held for 10s.
+				"Wakelock_in": {events["Wakelock_in"][0], events["Wakelock_in"][3]},
+			},
+		},
+		{
+			expr: `duration > 15s`,
+			want: map[string][]Event{
+				"Screen": events["Screen"],
+			},
+		},
+		{
+			expr: `end == -1`,
+			want: map[string][]Event{
+				"Wakelock_in": {events["Wakelock_in"][3]},
+			},
+		},
+		{
+			expr: `type == "bool" || (opt != "10041" && start >= 30000)`,
+			want: map[string][]Event{
+				"Wakelock_in": {events["Wakelock_in"][2]},
+				"Screen":      events["Screen"],
+			},
+		},
+		{
+			expr: `!(value matches "^com\\.") && duration < 1m`,
+			want: map[string][]Event{
+				"Wakelock_in": {events["Wakelock_in"][2]},
+			},
+		},
+		{
+			expr: `app == "none"`,
+			want: map[string][]Event{},
+		},
+	}
+	for _, test := range tests {
+		got, err := Filter(events, test.expr)
+		if err != nil {
+			t.Errorf("Filter(%q) unexpected error: %v", test.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Filter(%q) = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+// TestCompileQueryErrors tests that invalid queries are rejected when compiled.
+func TestCompileQueryErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`metric ==`,
+		`metric == 5`,
+		`duration > "5s"`,
+		`duration contains 5`,
+		`color == "red"`,
+		`value == "unterminated`,
+		`value matches "("`,
+		`(metric == "Screen"`,
+		`metric == "Screen" metric`,
+		`start > 5 parsecs`,
+	} {
+		if q, err := CompileQuery(expr); err == nil {
+			t.Errorf("CompileQuery(%q) = %v, want error", expr, q)
+		}
+	}
+}
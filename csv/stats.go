@@ -0,0 +1,488 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// stats.go contains functions that compute summary statistics over extracted events.
+// None of these functions modify the given slices.
+
+import (
+	"math"
+	"sort"
+
+	"github.com/chenjiacun35/battery-historian/historianutils"
+)
+
+// coveredFunc returns a function giving the total event time before a timestamp,
+// for the given sorted and non overlapping events.
+func coveredFunc(merged []Event) func(t int64) int64 {
+	// prefix[i] is the total duration of the merged events before merged[i].
+	prefix := make([]int64, len(merged)+1)
+	for i, e := range merged {
+		prefix[i+1] = prefix[i] + e.End - e.Start
+	}
+	return func(t int64) int64 {
+		// Index of the first event ending after t.
+		i := sort.Search(len(merged), func(i int) bool { return merged[i].End > t })
+		total := prefix[i]
+		if i < len(merged) && merged[i].Start < t {
+			total += t - merged[i].Start
+		}
+		return total
+	}
+}
+
+// BusiestWindow returns the start of the window of length windowMs containing the most event
+// time, along with that total. Overlapping events are merged first so time isn't double counted.
+// If there are several such windows, the earliest is returned. If there are no events or
+// windowMs is not positive, 0, 0 is returned.
+func BusiestWindow(events []Event, windowMs int64) (startMs int64, totalMs int64) {
+	if len(events) == 0 || windowMs <= 0 {
+		return 0, 0
+	}
+	merged := MergeEvents(append([]Event(nil), events...))
+	covered := coveredFunc(merged)
+
+	// The busiest window either starts at the start of an event, or ends at the end of one.
+	// No window starting before the first event contains more than one starting at it.
+	var candidates []int64
+	for _, e := range merged {
+		candidates = append(candidates, e.Start, historianutils.MaxInt64(e.End-windowMs, merged[0].Start))
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	startMs, totalMs = candidates[0], int64(-1)
+	for _, s := range candidates {
+		if t := covered(s+windowMs) - covered(s); t > totalMs {
+			startMs, totalMs = s, t
+		}
+	}
+	return startMs, totalMs
+}
+
+// DutyCycle returns the fraction of each window of length windowMs that the events are active,
+// with the windows starting at the first event and sliding by stepMs until the end of the last event.
+// Overlapping events are merged first so time isn't double counted. If there are no events, or
+// windowMs or stepMs is not positive, nil is returned.
+func DutyCycle(events []Event, windowMs, stepMs int64) []float64 {
+	if len(events) == 0 || windowMs <= 0 || stepMs <= 0 {
+		return nil
+	}
+	merged := MergeEvents(append([]Event(nil), events...))
+	covered := coveredFunc(merged)
+
+	var res []float64
+	for s := merged[0].Start; s < merged[len(merged)-1].End; s += stepMs {
+		res = append(res, float64(covered(s+windowMs)-covered(s))/float64(windowMs))
+	}
+	return res
+}
+
+// MatrixByAppAndType returns the total duration of the events for each app and event type,
+// indexed by AppName and then Type. Overlapping events for the same app and type are merged
+// first so time isn't double counted. Events without an AppName are counted under "unknown".
+func MatrixByAppAndType(events []Event) map[string]map[string]int64 {
+	grouped := make(map[string]map[string][]Event)
+	for _, e := range events {
+		app := e.AppName
+		if app == "" {
+			app = "unknown"
+		}
+		if grouped[app] == nil {
+			grouped[app] = make(map[string][]Event)
+		}
+		grouped[app][e.Type] = append(grouped[app][e.Type], e)
+	}
+
+	res := make(map[string]map[string]int64, len(grouped))
+	for app, types := range grouped {
+		res[app] = make(map[string]int64, len(types))
+		for t, es := range types {
+			var total int64
+			for _, e := range MergeEvents(es) {
+				total += e.End - e.Start
+			}
+			res[app][t] = total
+		}
+	}
+	return res
+}
+
+// AttributeShared splits the awake time between the apps in perApp, returning the milliseconds
+// attributed to each app. Each part of an awake interval is divided equally among the apps that
+// are active during it, and awake time with no active apps is not attributed to any app.
+// The events for each app are merged first so an app isn't counted twice.
+func AttributeShared(awake []Event, perApp map[string][]Event) map[string]int64 {
+	merged := make(map[string][]Event, len(perApp))
+	bounds := make(map[int64]bool)
+	for _, e := range awake {
+		bounds[e.Start] = true
+		bounds[e.End] = true
+	}
+	for app, events := range perApp {
+		merged[app] = MergeEvents(append([]Event(nil), events...))
+		for _, e := range merged[app] {
+			bounds[e.Start] = true
+			bounds[e.End] = true
+		}
+	}
+	var times []int64
+	for t := range bounds {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	awakeMerged := MergeEvents(append([]Event(nil), awake...))
+
+	// active returns whether t is within one of the sorted, non overlapping events.
+	active := func(events []Event, t int64) bool {
+		i := sort.Search(len(events), func(i int) bool { return events[i].End > t })
+		return i < len(events) && events[i].Start <= t
+	}
+
+	shares := make(map[string]float64)
+	for i := 1; i < len(times); i++ {
+		start, end := times[i-1], times[i]
+		// No event starts or ends within a segment, so checking the start is enough.
+		if !active(awakeMerged, start) {
+			continue
+		}
+		var apps []string
+		for app, events := range merged {
+			if active(events, start) {
+				apps = append(apps, app)
+			}
+		}
+		for _, app := range apps {
+			shares[app] += float64(end-start) / float64(len(apps))
+		}
+	}
+
+	res := make(map[string]int64, len(perApp))
+	for app := range perApp {
+		res[app] = int64(math.Round(shares[app]))
+	}
+	return res
+}
+
+// AppsDuring returns the unique apps of the candidate events that overlap e, such as the apps
+// active during a wakeup. An event is identified by its AppName, or its Opt if AppName is empty,
+// and candidates with neither are ignored. Events that start or end exactly at e's boundaries
+// count as overlapping, so instant events are handled. Apps are ordered by the time they first
+// overlap e.
+func AppsDuring(e Event, candidates []Event) []string {
+	first := make(map[string]int64)
+	var apps []string
+	for _, c := range candidates {
+		if c.Start > e.End || c.End < e.Start {
+			continue
+		}
+		app := c.AppName
+		if app == "" {
+			app = c.Opt
+		}
+		if app == "" {
+			continue
+		}
+		start := c.Start
+		if start < e.Start {
+			start = e.Start
+		}
+		if t, ok := first[app]; ok {
+			if start < t {
+				first[app] = start
+			}
+			continue
+		}
+		first[app] = start
+		apps = append(apps, app)
+	}
+	sort.SliceStable(apps, func(i, j int) bool {
+		return first[apps[i]] < first[apps[j]]
+	})
+	return apps
+}
+
+// StackedHistogram splits the time from startMs to endMs into bins of binMs, and returns the active
+// duration of the events in each bin, keyed by Value. The last bin is cut short at endMs if needed.
+// Events crossing bin boundaries are split between the bins, and overlapping events with the same
+// Value are merged first so time isn't double counted. If binMs is not positive or endMs is not
+// after startMs, nil is returned.
+func StackedHistogram(events []Event, startMs, endMs, binMs int64) map[string][]int64 {
+	if binMs <= 0 || endMs <= startMs {
+		return nil
+	}
+	n := (endMs - startMs + binMs - 1) / binMs
+	res := make(map[string][]int64)
+	for value, merged := range MergeBy(events, func(e Event) string { return e.Value }) {
+		covered := coveredFunc(merged)
+		bins := make([]int64, n)
+		for i := range bins {
+			s := startMs + int64(i)*binMs
+			e := minInt64(s+binMs, endMs)
+			bins[i] = covered(e) - covered(s)
+		}
+		res[value] = bins
+	}
+	return res
+}
+
+// CountHistogram splits the time from startMs to endMs into bins of binMs like StackedHistogram, and
+// returns the number of events overlapping each bin. An event counts once in every bin it overlaps,
+// and an instant event counts in the bin containing it. Overlapping events are counted separately.
+// If binMs is not positive or endMs is not after startMs, nil is returned.
+func CountHistogram(events []Event, startMs, endMs, binMs int64) []int {
+	if binMs <= 0 || endMs <= startMs {
+		return nil
+	}
+	bins := make([]int, (endMs-startMs+binMs-1)/binMs)
+	for _, e := range events {
+		first, last, ok := binRange(e, startMs, endMs, binMs)
+		if !ok {
+			continue
+		}
+		for i := first; i <= last; i++ {
+			bins[i]++
+		}
+	}
+	return bins
+}
+
+// binRange returns the indexes of the first and last bins of binMs from startMs to endMs that the
+// event overlaps, as described for CountHistogram, and false if the event doesn't overlap any bin.
+func binRange(e Event, startMs, endMs, binMs int64) (first, last int64, ok bool) {
+	if e.Start >= endMs || e.End < startMs || (e.End == startMs && e.Start != e.End) {
+		return 0, 0, false
+	}
+	first = (historianutils.MaxInt64(e.Start, startMs) - startMs) / binMs
+	last = first
+	if e.End > e.Start {
+		// The event covers up to, but not including, its end.
+		last = (minInt64(e.End, endMs) - 1 - startMs) / binMs
+	}
+	return first, last, true
+}
+
+// Bucket summarizes the events of a metric within a fixed window of time.
+type Bucket struct {
+	StartMs, EndMs int64
+	// Count is the number of events overlapping the bucket.
+	Count int
+	// TotalMs is the time within the bucket covered by the events. Overlapping events are counted separately.
+	TotalMs int64
+	// Values is the number of events overlapping the bucket with each distinct Value.
+	Values map[string]int
+}
+
+// Aggregate splits the time from startMs to endMs into buckets of bucketMs like CountHistogram, such
+// as one per minute or hour, and returns the buckets for each metric in the map of metric to events,
+// as returned by ExtractEvents. Events crossing bucket boundaries are counted in every bucket they
+// overlap, with their duration split between them. Every metric has all the buckets, even if some are
+// empty. If bucketMs is not positive or endMs is not after startMs, nil is returned.
+func Aggregate(m map[string][]Event, startMs, endMs, bucketMs int64) map[string][]Bucket {
+	if bucketMs <= 0 || endMs <= startMs {
+		return nil
+	}
+	n := (endMs - startMs + bucketMs - 1) / bucketMs
+	res := make(map[string][]Bucket, len(m))
+	for metric, events := range m {
+		buckets := make([]Bucket, n)
+		for i := range buckets {
+			buckets[i].StartMs = startMs + int64(i)*bucketMs
+			buckets[i].EndMs = minInt64(buckets[i].StartMs+bucketMs, endMs)
+			buckets[i].Values = make(map[string]int)
+		}
+		for _, e := range events {
+			first, last, ok := binRange(e, startMs, endMs, bucketMs)
+			if !ok {
+				continue
+			}
+			for i := first; i <= last; i++ {
+				b := &buckets[i]
+				b.Count++
+				b.Values[e.Value]++
+				if e.End > e.Start {
+					b.TotalMs += minInt64(e.End, b.EndMs) - historianutils.MaxInt64(e.Start, b.StartMs)
+				}
+			}
+		}
+		res[metric] = buckets
+	}
+	return res
+}
+
+// MetricSummary summarizes a set of events.
+type MetricSummary struct {
+	Count   int
+	TotalMs int64
+	MaxMs   int64
+	// FirstStartMs and LastEndMs are the start of the earliest event and the end of the latest event.
+	FirstStartMs, LastEndMs int64
+}
+
+// add includes the event in the summary.
+func (s *MetricSummary) add(e Event) {
+	d := e.End - e.Start
+	if s.Count == 0 || e.Start < s.FirstStartMs {
+		s.FirstStartMs = e.Start
+	}
+	if s.Count == 0 || e.End > s.LastEndMs {
+		s.LastEndMs = e.End
+	}
+	if d > s.MaxMs {
+		s.MaxMs = d
+	}
+	s.TotalMs += d
+	s.Count++
+}
+
+// Summarize returns the summary of the events. Overlapping events are counted separately.
+func Summarize(events []Event) MetricSummary {
+	var s MetricSummary
+	for _, e := range events {
+		s.add(e)
+	}
+	return s
+}
+
+// CoalesceAndSummarize merges events separated by at most gapMs, and summarizes the merged events,
+// in a single pass. It is the same as calling MergeEventsWithGap then Summarize, but doesn't modify
+// the given slice. Marker events are never merged, and are returned as is, ordered by start time with
+// the merged events.
+func CoalesceAndSummarize(events []Event, gapMs int64) (merged []Event, summary MetricSummary) {
+	if len(events) == 0 {
+		return nil, summary
+	}
+	if markers, others := splitMarkers(events); len(markers) > 0 {
+		merged, summary = CoalesceAndSummarize(others, gapMs)
+		for _, m := range markers {
+			summary.add(m)
+		}
+		return withMarkers(merged, markers), summary
+	}
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.Sort(sortByStartTime(sorted))
+
+	prev := sorted[0]
+	for _, cur := range sorted[1:] {
+		if prev.End+gapMs < cur.Start {
+			merged = append(merged, prev)
+			summary.add(prev)
+			prev = cur
+		} else {
+			prev = Event{Start: prev.Start, End: historianutils.MaxInt64(prev.End, cur.End), Index: prev.Index}
+		}
+	}
+	merged = append(merged, prev)
+	summary.add(prev)
+	return merged, summary
+}
+
+// Reduce folds the events into a single value, calling fn with the accumulated value and each event
+// in order, starting from init. It can be used to compute several aggregations in one pass.
+func Reduce[T any](events []Event, init T, fn func(acc T, e Event) T) T {
+	acc := init
+	for _, e := range events {
+		acc = fn(acc, e)
+	}
+	return acc
+}
+
+// ReportBounds returns the earliest start and the latest end of the events across all metrics,
+// such as for computing the duration of a report. Events that haven't finished (End -1) are taken
+// to last at least until their Start. It returns (0, 0) if there are no events.
+func ReportBounds(events map[string][]Event) (startMs, endMs int64) {
+	found := false
+	for _, es := range events {
+		for _, e := range es {
+			if !found || e.Start < startMs {
+				startMs = e.Start
+			}
+			end := e.End
+			if end == -1 {
+				end = e.Start
+			}
+			if !found || end > endMs {
+				endMs = end
+			}
+			found = true
+		}
+	}
+	return startMs, endMs
+}
+
+// Similarity returns the Jaccard index of the active time of two timelines: the duration covered by
+// both divided by the duration covered by either, in [0, 1]. Overlapping events within each
+// timeline are merged first. Identical timelines give 1 and disjoint timelines give 0. If neither
+// timeline has any active time, they are considered identical.
+func Similarity(a, b []Event) float64 {
+	ma := MergeEvents(CloneEvents(a))
+	mb := MergeEvents(CloneEvents(b))
+	var intersection int64
+	for i, j := 0, 0; i < len(ma) && j < len(mb); {
+		start := historianutils.MaxInt64(ma[i].Start, mb[j].Start)
+		end := minInt64(ma[i].End, mb[j].End)
+		if end > start {
+			intersection += end - start
+		}
+		// Advance past whichever event ends first, as it can't overlap any later events of the other.
+		if ma[i].End < mb[j].End {
+			i++
+		} else {
+			j++
+		}
+	}
+	union := Summarize(ma).TotalMs + Summarize(mb).TotalMs - intersection
+	if union == 0 {
+		return 1
+	}
+	return float64(intersection) / float64(union)
+}
+
+// DetectPeriod estimates whether the events start at a regular interval, such as for polling or
+// heartbeats. The period is the median of the intervals between consecutive event starts, and the
+// confidence is 1 minus the coefficient of variation of the intervals, clamped to [0, 1]. Evenly
+// spaced events give a confidence of 1, and a low confidence means the events are aperiodic.
+// At least 3 events are needed; otherwise 0, 0 is returned.
+func DetectPeriod(events []Event) (periodMs int64, confidence float64) {
+	if len(events) < 3 {
+		return 0, 0
+	}
+	starts := make([]int64, len(events))
+	for i, e := range events {
+		starts[i] = e.Start
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	intervals := make([]int64, len(starts)-1)
+	var sum float64
+	for i := 1; i < len(starts); i++ {
+		intervals[i-1] = starts[i] - starts[i-1]
+		sum += float64(intervals[i-1])
+	}
+	mean := sum / float64(len(intervals))
+	if mean == 0 {
+		return 0, 0
+	}
+	var variance float64
+	for _, d := range intervals {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	variance /= float64(len(intervals))
+
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	periodMs = intervals[len(intervals)/2]
+	confidence = math.Max(0, 1-math.Sqrt(variance)/mean)
+	return periodMs, confidence
+}
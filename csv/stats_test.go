@@ -0,0 +1,567 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/chenjiacun35/battery-historian/historianutils"
+)
+
+// TestBusiestWindow tests finding the window with the most event time.
+func TestBusiestWindow(t *testing.T) {
+	tests := []struct {
+		desc      string
+		events    []Event
+		windowMs  int64
+		wantStart int64
+		wantTotal int64
+	}{
+		{
+			desc: "Activity cluster",
+			events: []Event{
+				{Start: 0, End: 100},
+				{Start: 5000, End: 5600},
+				{Start: 5500, End: 6000},
+				{Start: 6500, End: 7000},
+				{Start: 20000, End: 20900},
+			},
+			windowMs:  2000,
+			wantStart: 5000,
+			wantTotal: 1500,
+		},
+		{
+			desc: "Window ending at an event end",
+			events: []Event{
+				{Start: 0, End: 300},
+				{Start: 1000, End: 1500},
+				{Start: 1600, End: 2000},
+			},
+			windowMs:  1200,
+			wantStart: 800,
+			wantTotal: 900,
+		},
+		{
+			desc: "Window longer than all events",
+			events: []Event{
+				{Start: 1000, End: 1500},
+				{Start: 1600, End: 2000},
+			},
+			windowMs:  5000,
+			wantStart: 1000,
+			wantTotal: 900,
+		},
+		{
+			desc: "Window shorter than an event",
+			events: []Event{
+				{Start: 100, End: 10000},
+			},
+			windowMs:  1000,
+			wantStart: 100,
+			wantTotal: 1000,
+		},
+		{
+			desc:     "No events",
+			windowMs: 1000,
+		},
+		{
+			desc: "Invalid window",
+			events: []Event{
+				{Start: 100, End: 10000},
+			},
+		},
+	}
+	for _, test := range tests {
+		start, total := BusiestWindow(test.events, test.windowMs)
+		if start != test.wantStart || total != test.wantTotal {
+			t.Errorf("%v: BusiestWindow(%v, %d) = %d, %d, want %d, %d", test.desc, test.events, test.windowMs, start, total, test.wantStart, test.wantTotal)
+		}
+	}
+}
+
+// TestDutyCycle tests computing the active fraction of sliding windows.
+func TestDutyCycle(t *testing.T) {
+	tests := []struct {
+		desc     string
+		events   []Event
+		windowMs int64
+		stepMs   int64
+		want     []float64
+	}{
+		{
+			desc: "Active half of each window",
+			events: []Event{
+				{Start: 0, End: 500},
+				{Start: 1000, End: 1500},
+				{Start: 2000, End: 2200},
+				{Start: 2100, End: 2500},
+				{Start: 3000, End: 3500},
+			},
+			windowMs: 1000,
+			stepMs:   500,
+			want:     []float64{0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5},
+		},
+		{
+			desc: "Window longer than step",
+			events: []Event{
+				{Start: 0, End: 1000},
+				{Start: 3000, End: 4000},
+			},
+			windowMs: 2000,
+			stepMs:   1000,
+			want:     []float64{0.5, 0, 0.5, 0.5},
+		},
+		{
+			desc:     "No events",
+			windowMs: 1000,
+			stepMs:   500,
+		},
+		{
+			desc: "Invalid step",
+			events: []Event{
+				{Start: 0, End: 1000},
+			},
+			windowMs: 1000,
+		},
+	}
+	for _, test := range tests {
+		if got := DutyCycle(test.events, test.windowMs, test.stepMs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: DutyCycle(%v, %d, %d) = %v, want %v", test.desc, test.events, test.windowMs, test.stepMs, got, test.want)
+		}
+	}
+}
+
+// TestMatrixByAppAndType tests totalling event durations by app and type.
+func TestMatrixByAppAndType(t *testing.T) {
+	events := []Event{
+		{Type: "service", Start: 0, End: 1000, AppName: "com.google.android.gms"},
+		{Type: "service", Start: 500, End: 1500, AppName: "com.google.android.gms"},
+		{Type: "bool", Start: 2000, End: 2300, AppName: "com.google.android.gms"},
+		{Type: "service", Start: 100, End: 200, AppName: "com.android.chrome"},
+		{Type: "string", Start: 300, End: 700, AppName: "com.android.chrome"},
+		{Type: "string", Start: 1000, End: 1100, AppName: "com.android.chrome"},
+		{Type: "bool", Start: 0, End: 50},
+	}
+	want := map[string]map[string]int64{
+		"com.google.android.gms": {"service": 1500, "bool": 300},
+		"com.android.chrome":     {"service": 100, "string": 500},
+		"unknown":                {"bool": 50},
+	}
+	if got := MatrixByAppAndType(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("MatrixByAppAndType(%v) = %v, want %v", events, got, want)
+	}
+}
+
+// TestAttributeShared tests splitting awake time between the apps active during it.
+func TestAttributeShared(t *testing.T) {
+	tests := []struct {
+		desc   string
+		awake  []Event
+		perApp map[string][]Event
+		want   map[string]int64
+	}{
+		{
+			desc:  "Two apps share an interval",
+			awake: []Event{{Start: 0, End: 1000}},
+			perApp: map[string][]Event{
+				"com.google.android.gms": {{Start: 0, End: 1000}},
+				"com.android.chrome":     {{Start: 0, End: 1000}},
+			},
+			want: map[string]int64{
+				"com.google.android.gms": 500,
+				"com.android.chrome":     500,
+			},
+		},
+		{
+			desc: "Partial overlap",
+			awake: []Event{
+				{Start: 0, End: 1000},
+				{Start: 2000, End: 3000},
+			},
+			perApp: map[string][]Event{
+				// Overlapping events of one app are only counted once.
+				"com.google.android.gms": {{Start: 0, End: 600}, {Start: 200, End: 800}, {Start: 2500, End: 4000}},
+				"com.android.chrome":     {{Start: 400, End: 1500}},
+				"com.whatsapp":           {{Start: 1200, End: 1800}},
+			},
+			want: map[string]int64{
+				// 0-400 alone, 400-800 shared, 2500-3000 alone.
+				"com.google.android.gms": 400 + 200 + 500,
+				// 400-800 shared, 800-1000 alone.
+				"com.android.chrome": 200 + 200,
+				// Not active while the device was awake.
+				"com.whatsapp": 0,
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := AttributeShared(test.awake, test.perApp); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: AttributeShared(%v, %v) = %v, want %v", test.desc, test.awake, test.perApp, got, test.want)
+		}
+	}
+}
+
+// TestAppsDuring tests finding the apps with events overlapping a wakeup.
+func TestAppsDuring(t *testing.T) {
+	wakeup := Event{Type: "service", Start: 1000, End: 2000, Value: "wakeup"}
+	tests := []struct {
+		desc       string
+		candidates []Event
+		want       []string
+	}{
+		{
+			desc: "Wakeup overlaps two app events",
+			candidates: []Event{
+				{Start: 1500, End: 3000, AppName: "com.android.chrome"},
+				{Start: 500, End: 1200, AppName: "com.google.android.gms"},
+				{Start: 2500, End: 2600, AppName: "com.android.vending"},
+			},
+			want: []string{"com.google.android.gms", "com.android.chrome"},
+		},
+		{
+			desc: "Duplicate apps and Opt fallback",
+			candidates: []Event{
+				{Start: 1800, End: 1900, AppName: "com.android.chrome"},
+				{Start: 1300, End: 1400, Opt: "10041"},
+				{Start: 1100, End: 1200, AppName: "com.android.chrome"},
+				{Start: 1000, End: 1000},
+				{Start: 2000, End: 2000, AppName: "com.google.android.gms"},
+			},
+			want: []string{"com.android.chrome", "10041", "com.google.android.gms"},
+		},
+		{
+			desc: "No overlap",
+			candidates: []Event{
+				{Start: 0, End: 999, AppName: "com.android.chrome"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := AppsDuring(wakeup, test.candidates); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: AppsDuring(%v, %v) = %v, want %v", test.desc, wakeup, test.candidates, got, test.want)
+		}
+	}
+}
+
+// TestStackedHistogram tests splitting the active time of each Value into bins.
+func TestStackedHistogram(t *testing.T) {
+	events := []Event{
+		{Start: 500, End: 1500, Value: "com.android.chrome"},
+		{Start: 1200, End: 1400, Value: "com.android.chrome"},
+		{Start: 1800, End: 2500, Value: "com.google.android.gms"},
+		{Start: 100, End: 200, Value: "com.google.android.gms"},
+	}
+	tests := []struct {
+		desc                  string
+		startMs, endMs, binMs int64
+		want                  map[string][]int64
+	}{
+		{
+			desc:    "Adjacent bins",
+			startMs: 0,
+			endMs:   3000,
+			binMs:   1000,
+			want: map[string][]int64{
+				"com.android.chrome":     {500, 500, 0},
+				"com.google.android.gms": {100, 200, 500},
+			},
+		},
+		{
+			desc:    "Last bin cut short",
+			startMs: 1000,
+			endMs:   2200,
+			binMs:   1000,
+			want: map[string][]int64{
+				"com.android.chrome":     {500, 0},
+				"com.google.android.gms": {200, 200},
+			},
+		},
+		{
+			desc:    "Invalid bin size",
+			startMs: 0,
+			endMs:   3000,
+		},
+	}
+	for _, test := range tests {
+		if got := StackedHistogram(events, test.startMs, test.endMs, test.binMs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: StackedHistogram(%v, %d, %d, %d) = %v, want %v", test.desc, events, test.startMs, test.endMs, test.binMs, got, test.want)
+		}
+	}
+}
+
+// TestCountHistogram tests counting the events overlapping each bin.
+func TestCountHistogram(t *testing.T) {
+	events := []Event{
+		// Long event overlapping the first three bins.
+		{Start: 500, End: 2500},
+		// Short event within a single bin.
+		{Start: 1200, End: 1400},
+		// Ends exactly at a bin boundary, so doesn't count in the next bin.
+		{Start: 3500, End: 4000},
+		{Start: 4200, End: 4200},
+		// Outside the range.
+		{Start: 6000, End: 7000},
+	}
+	tests := []struct {
+		desc                  string
+		startMs, endMs, binMs int64
+		want                  []int
+	}{
+		{
+			desc:    "Adjacent bins",
+			startMs: 0,
+			endMs:   5000,
+			binMs:   1000,
+			want:    []int{1, 2, 1, 1, 1},
+		},
+		{
+			desc:    "Last bin cut short",
+			startMs: 1000,
+			endMs:   4100,
+			binMs:   2000,
+			want:    []int{2, 1},
+		},
+		{
+			desc:    "Invalid bin size",
+			startMs: 0,
+			endMs:   5000,
+		},
+	}
+	for _, test := range tests {
+		if got := CountHistogram(events, test.startMs, test.endMs, test.binMs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: CountHistogram(%v, %d, %d, %d) = %v, want %v", test.desc, events, test.startMs, test.endMs, test.binMs, got, test.want)
+		}
+	}
+}
+
+// TestAggregate tests bucketing the events of each metric into fixed windows.
+func TestAggregate(t *testing.T) {
+	input := map[string][]Event{
+		"Wakelock_in": {
+			// Crosses the boundary between the first two buckets.
+			{Start: 30000, End: 90000, Value: "a"},
+			{Start: 40000, End: 50000, Value: "b"},
+			{Start: 100000, End: 100000, Value: "a"},
+		},
+		"Screen": nil,
+	}
+	want := map[string][]Bucket{
+		"Wakelock_in": {
+			{StartMs: 0, EndMs: 60000, Count: 2, TotalMs: 40000, Values: map[string]int{"a": 1, "b": 1}},
+			{StartMs: 60000, EndMs: 120000, Count: 2, TotalMs: 30000, Values: map[string]int{"a": 2}},
+			{StartMs: 120000, EndMs: 150000, Values: map[string]int{}},
+		},
+		"Screen": {
+			{StartMs: 0, EndMs: 60000, Values: map[string]int{}},
+			{StartMs: 60000, EndMs: 120000, Values: map[string]int{}},
+			{StartMs: 120000, EndMs: 150000, Values: map[string]int{}},
+		},
+	}
+	if got := Aggregate(input, 0, 150000, 60000); !reflect.DeepEqual(got, want) {
+		t.Errorf("Aggregate(%v, 0, 150000, 60000) = %v, want %v", input, got, want)
+	}
+	if got := Aggregate(input, 0, 150000, 0); got != nil {
+		t.Errorf("Aggregate(%v, 0, 150000, 0) = %v, want nil", input, got)
+	}
+}
+
+// TestCoalesceAndSummarize tests that coalescing and summarizing in one pass matches the separate calls.
+func TestCoalesceAndSummarize(t *testing.T) {
+	input := []Event{
+		{Type: "service", Start: 5000, End: 5500, Value: "c"},
+		{Type: "service", Start: 0, End: 1000, Value: "a"},
+		{Type: "service", Start: 1200, End: 2000, Value: "b"},
+		{Type: "service", Start: 1500, End: 1800, Value: "b"},
+		{Type: "service", Start: 9000, End: 9000, Value: "d"},
+	}
+	for _, gapMs := range []int64{0, 300, 3000, 10000} {
+		wantMerged := MergeEventsWithGap(append([]Event(nil), input...), gapMs)
+		wantSummary := Summarize(wantMerged)
+		orig := append([]Event(nil), input...)
+
+		merged, summary := CoalesceAndSummarize(input, gapMs)
+		if !reflect.DeepEqual(merged, wantMerged) {
+			t.Errorf("CoalesceAndSummarize(%v, %d) merged = %v, want %v", input, gapMs, merged, wantMerged)
+		}
+		if summary != wantSummary {
+			t.Errorf("CoalesceAndSummarize(%v, %d) summary = %+v, want %+v", input, gapMs, summary, wantSummary)
+		}
+		if !reflect.DeepEqual(input, orig) {
+			t.Errorf("CoalesceAndSummarize(%v, %d) modified the input to %v", orig, gapMs, input)
+		}
+	}
+
+	want := MetricSummary{Count: 3, TotalMs: 2500, MaxMs: 2000, FirstStartMs: 0, LastEndMs: 9000}
+	if _, got := CoalesceAndSummarize(input, 300); got != want {
+		t.Errorf("CoalesceAndSummarize(%v, 300) summary = %+v, want %+v", input, got, want)
+	}
+}
+
+// TestReduce tests computing the total duration and latest end of the events in a single pass.
+func TestReduce(t *testing.T) {
+	type totals struct {
+		durationMs, maxEndMs int64
+	}
+	events := []Event{
+		{Start: 1000, End: 3000},
+		{Start: 500, End: 1500},
+		{Start: 4000, End: 4000},
+		{Start: 2000, End: 2500},
+	}
+	want := totals{durationMs: 3500, maxEndMs: 4000}
+	got := Reduce(events, totals{}, func(acc totals, e Event) totals {
+		acc.durationMs += e.End - e.Start
+		acc.maxEndMs = historianutils.MaxInt64(acc.maxEndMs, e.End)
+		return acc
+	})
+	if got != want {
+		t.Errorf("Reduce(%v, totals{}, ...) = %+v, want %+v", events, got, want)
+	}
+
+	if got := Reduce(nil, 7, func(acc int, e Event) int { return acc + 1 }); got != 7 {
+		t.Errorf("Reduce(nil, 7, ...) = %d, want 7", got)
+	}
+}
+
+// TestReportBounds tests finding the global bounds of the events of several metrics.
+func TestReportBounds(t *testing.T) {
+	tests := []struct {
+		desc               string
+		events             map[string][]Event
+		wantStart, wantEnd int64
+	}{
+		{
+			desc: "no events",
+		},
+		{
+			desc: "empty metrics",
+			events: map[string][]Event{
+				"Screen": nil,
+			},
+		},
+		{
+			desc: "several metrics",
+			events: map[string][]Event{
+				"Screen":              {{Start: 2000, End: 3000}, {Start: 5000, End: 6000}},
+				"Wifi on":             {{Start: 1500, End: 4000}},
+				"Mobile radio active": {{Start: 3000, End: 8000}, {Start: 7000, End: 7500}},
+			},
+			wantStart: 1500,
+			wantEnd:   8000,
+		},
+		{
+			desc: "open event starting last",
+			events: map[string][]Event{
+				"Screen":      {{Start: 2000, End: 3000}},
+				"Wakelock_in": {{Start: 4000, End: -1}},
+			},
+			wantStart: 2000,
+			wantEnd:   4000,
+		},
+	}
+	for _, test := range tests {
+		start, end := ReportBounds(test.events)
+		if start != test.wantStart || end != test.wantEnd {
+			t.Errorf("%v: ReportBounds(%v) = (%d, %d), want (%d, %d)", test.desc, test.events, start, end, test.wantStart, test.wantEnd)
+		}
+	}
+}
+
+// TestSimilarity tests the Jaccard index of the active time of two timelines.
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		desc string
+		a, b []Event
+		want float64
+	}{
+		{
+			desc: "identical",
+			a:    []Event{{Start: 0, End: 1000}, {Start: 2000, End: 3000}},
+			b:    []Event{{Start: 2000, End: 3000}, {Start: 0, End: 1000}},
+			want: 1,
+		},
+		{
+			desc: "disjoint",
+			a:    []Event{{Start: 0, End: 1000}},
+			b:    []Event{{Start: 1000, End: 2000}},
+			want: 0,
+		},
+		{
+			// Intersection is [500, 1000) and [2000, 2500), union is [0, 1500) and [2000, 3000).
+			desc: "partially overlapping",
+			a:    []Event{{Start: 0, End: 1000}, {Start: 2000, End: 2500}},
+			b:    []Event{{Start: 500, End: 1500}, {Start: 1800, End: 3000}, {Start: 2200, End: 2300}},
+			want: 1000.0 / 2700.0,
+		},
+		{
+			desc: "one empty",
+			a:    []Event{{Start: 0, End: 1000}},
+			want: 0,
+		},
+		{
+			desc: "both empty",
+			want: 1,
+		},
+	}
+	for _, test := range tests {
+		if got := Similarity(test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%v: Similarity(%v, %v) = %v, want %v", test.desc, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestDetectPeriod tests estimating the interval of periodic events.
+func TestDetectPeriod(t *testing.T) {
+	var even, jittered []Event
+	for i := int64(0); i < 20; i++ {
+		even = append(even, Event{Start: i * 60000, End: i*60000 + 500})
+		// Alternate starting 1s early and late.
+		jitter := int64(1000)
+		if i%2 == 0 {
+			jitter = -1000
+		}
+		jittered = append(jittered, Event{Start: 100000 + i*60000 + jitter, End: 100000 + i*60000 + jitter + 500})
+	}
+	// Shuffle the even events, as the order shouldn't matter.
+	even[3], even[17] = even[17], even[3]
+
+	aperiodic := []Event{
+		{Start: 0}, {Start: 1000}, {Start: 50000}, {Start: 52000}, {Start: 200000}, {Start: 201000}, {Start: 900000},
+	}
+
+	tests := []struct {
+		desc          string
+		events        []Event
+		wantPeriod    int64
+		minConfidence float64
+		maxConfidence float64
+	}{
+		{desc: "evenly spaced", events: even, wantPeriod: 60000, minConfidence: 1, maxConfidence: 1},
+		{desc: "jittered", events: jittered, wantPeriod: 62000, minConfidence: 0.9, maxConfidence: 1},
+		{desc: "aperiodic", events: aperiodic, wantPeriod: 49000, maxConfidence: 0.5},
+		{desc: "too few events", events: even[:2]},
+	}
+	for _, test := range tests {
+		period, confidence := DetectPeriod(test.events)
+		if period != test.wantPeriod {
+			t.Errorf("%v: DetectPeriod(%v) period = %d, want %d", test.desc, test.events, period, test.wantPeriod)
+		}
+		if confidence < test.minConfidence || confidence > test.maxConfidence {
+			t.Errorf("%v: DetectPeriod(%v) confidence = %v, want in [%v, %v]", test.desc, test.events, confidence, test.minConfidence, test.maxConfidence)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+// transform.go contains functions that return modified copies of extracted events.
+// None of these functions modify the given slices.
+
+import (
+	"sort"
+
+	"github.com/chenjiacun35/battery-historian/historianutils"
+)
+
+// floorToGrid rounds t down to the nearest multiple of gridMs.
+func floorToGrid(t, gridMs int64) int64 {
+	r := t % gridMs
+	if r < 0 {
+		r += gridMs
+	}
+	return t - r
+}
+
+// ceilToGrid rounds t up to the nearest multiple of gridMs.
+func ceilToGrid(t, gridMs int64) int64 {
+	f := floorToGrid(t, gridMs)
+	if f == t {
+		return t
+	}
+	return f + gridMs
+}
+
+// Quantize snaps event boundaries to a grid of gridMs, rounding Start down and End up so that
+// no active time is lost. Events that are zero width after quantizing (instant events lying on
+// a grid line) are only kept if keepEmpty is true. The End of events that haven't finished (-1)
+// is left as is. If gridMs is not positive, the events are returned unchanged, including any zero
+// width events. Markers are snapped to the grid line before them, and are always kept.
+func Quantize(events []Event, gridMs int64, keepEmpty bool) []Event {
+	if gridMs <= 0 {
+		return append([]Event(nil), events...)
+	}
+	var res []Event
+	for _, e := range events {
+		if e.Marker {
+			e.Start = floorToGrid(e.Start, gridMs)
+			e.End = e.Start
+			res = append(res, e)
+			continue
+		}
+		e.Start = floorToGrid(e.Start, gridMs)
+		if e.End != -1 {
+			e.End = ceilToGrid(e.End, gridMs)
+		}
+		if e.Start == e.End && !keepEmpty {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// TrimShort returns the events that last at least minMs. Instant events (zero duration) are
+// often meaningful markers, so they are only dropped if dropInstant is true. Marker events, and
+// events that haven't finished (End -1), are always kept.
+func TrimShort(events []Event, minMs int64, dropInstant bool) []Event {
+	var res []Event
+	for _, e := range events {
+		if e.End == -1 {
+			// Events that haven't finished are still ongoing, however short they are so far.
+			res = append(res, e)
+			continue
+		}
+		d := e.End - e.Start
+		if d == 0 {
+			if dropInstant && !e.Marker {
+				continue
+			}
+		} else if d < minMs {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// CloneEvents returns a copy of the events that can be modified without affecting the original.
+func CloneEvents(events []Event) []Event {
+	if events == nil {
+		return nil
+	}
+	return append([]Event(nil), events...)
+}
+
+// CloneEventMap returns a copy of the map of metric to events, as returned by ExtractEvents,
+// that can be modified without affecting the original.
+func CloneEventMap(m map[string][]Event) map[string][]Event {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string][]Event, len(m))
+	for metric, events := range m {
+		res[metric] = CloneEvents(events)
+	}
+	return res
+}
+
+// RebaseToZero returns a copy of the events shifted so that the earliest event starts at 0.
+// Durations and the order of the events are preserved, and events that haven't finished keep
+// their End of -1.
+func RebaseToZero(events []Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	base := events[0].Start
+	for _, e := range events[1:] {
+		base = minInt64(base, e.Start)
+	}
+	res := make([]Event, len(events))
+	for i, e := range events {
+		e.Start -= base
+		if e.End != -1 {
+			e.End -= base
+		}
+		res[i] = e
+	}
+	return res
+}
+
+// SnapOpenEnds returns a copy of the events with each open event's End capped at the latest End in
+// reference, so that events still in progress at the end of the report don't pad charts past the
+// last real activity. The report end is taken to be the latest End of any event in events or
+// reference, and an event is open if it ends at the report end. Open events are never snapped to
+// before their Start, and are left unchanged if no reference event ends after their Start.
+func SnapOpenEnds(events, reference []Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	var reportEnd int64
+	for _, e := range events {
+		reportEnd = historianutils.MaxInt64(reportEnd, e.End)
+	}
+	for _, e := range reference {
+		reportEnd = historianutils.MaxInt64(reportEnd, e.End)
+	}
+	res := CloneEvents(events)
+	for i, e := range res {
+		if e.End != reportEnd {
+			continue
+		}
+		snap := int64(-1)
+		for _, r := range reference {
+			if r.End >= e.Start {
+				snap = historianutils.MaxInt64(snap, r.End)
+			}
+		}
+		if snap >= 0 {
+			res[i].End = snap
+		}
+	}
+	return res
+}
+
+// RemoveContained returns the events without those fully contained within another event with the
+// same Type and Value, as they add nothing to the coverage of that event. Partially overlapping
+// events are kept. Of several identical events, only the first is kept. The order of the remaining
+// events is preserved.
+func RemoveContained(events []Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+	groups := make(map[[2]string][]int)
+	for i, e := range events {
+		if e.Marker {
+			// Markers are points, and are always kept.
+			continue
+		}
+		k := [2]string{e.Type, e.Value}
+		groups[k] = append(groups[k], i)
+	}
+	contained := make([]bool, len(events))
+	for _, idx := range groups {
+		// Sort so that any event containing another comes before it.
+		sort.SliceStable(idx, func(i, j int) bool {
+			a, b := events[idx[i]], events[idx[j]]
+			if a.Start != b.Start {
+				return a.Start < b.Start
+			}
+			return a.End > b.End
+		})
+		maxEnd := events[idx[0]].End
+		for _, i := range idx[1:] {
+			if events[i].End <= maxEnd {
+				contained[i] = true
+				continue
+			}
+			maxEnd = events[i].End
+		}
+	}
+	var res []Event
+	for i, e := range events {
+		if !contained[i] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// CapEvents returns at most max events covering at least the same time as the given events, for
+// metrics with too many events to render. Overlapping events are merged first, then the events
+// separated by the smallest gaps, until there are no more than max. Each merged event keeps the
+// fields of its earliest starting constituent event, with End extended to cover the others.
+// Events that haven't finished (End -1) cover all the events after them, and an event merged with
+// one keeps an End of -1. The result is sorted by start time. If there are already no more than max events, or max is not
+// positive, the given events are returned as is. Marker events are never merged, and don't count
+// towards max.
+func CapEvents(events []Event, max int) []Event {
+	markers, others := splitMarkers(events)
+	if max <= 0 || len(others) <= max {
+		return events
+	}
+	if len(markers) > 0 {
+		return withMarkers(CapEvents(others, max), markers)
+	}
+	sorted := CloneEvents(events)
+	sort.Stable(sortByStartTime(sorted))
+
+	// gaps[i] is the gap between sorted[i] and the latest end of the events before it.
+	// Each boundary can be merged independently of the others, once all overlaps are merged.
+	gaps := make([]int64, len(sorted))
+	maxEnd := sorted[0].End
+	for i := 1; i < len(sorted); i++ {
+		if maxEnd == -1 {
+			// An earlier event is still ongoing, so this one overlaps it.
+			gaps[i] = -1
+			continue
+		}
+		gaps[i] = sorted[i].Start - maxEnd
+		maxEnd = openMaxEnd(maxEnd, sorted[i].End)
+	}
+	boundaries := make([]int, 0, len(sorted)-1)
+	for i := 1; i < len(sorted); i++ {
+		boundaries = append(boundaries, i)
+	}
+	sort.SliceStable(boundaries, func(i, j int) bool { return gaps[boundaries[i]] < gaps[boundaries[j]] })
+	merge := make([]bool, len(sorted))
+	for n, i := range boundaries {
+		if n >= len(sorted)-max && gaps[i] > 0 {
+			break
+		}
+		merge[i] = true
+	}
+
+	var res []Event
+	for i, e := range sorted {
+		if merge[i] {
+			last := &res[len(res)-1]
+			last.End = openMaxEnd(last.End, e.End)
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// openMaxEnd returns the later of the two ends, where an End of -1 (still ongoing) is later than any other.
+func openMaxEnd(a, b int64) int64 {
+	if a == -1 || b == -1 {
+		return -1
+	}
+	return historianutils.MaxInt64(a, b)
+}
+
+// PadToWindow returns a copy of the events with zero duration sentinel events added at 0 and at
+// windowMs, so that timelines of different reports rendered one above the other span the same
+// [0, windowMs] window. A sentinel is only added if no event already reaches that edge of the
+// window. The leading sentinel is first and the trailing sentinel is last, and the order of the
+// other events is preserved. Sentinels have no Type or Value.
+func PadToWindow(events []Event, windowMs int64) []Event {
+	hasStart, hasEnd := false, false
+	for _, e := range events {
+		if e.Start <= 0 {
+			hasStart = true
+		}
+		if e.End >= windowMs {
+			hasEnd = true
+		}
+	}
+	res := make([]Event, 0, len(events)+2)
+	if !hasStart {
+		res = append(res, Event{Start: 0, End: 0})
+	}
+	res = append(res, events...)
+	if !hasEnd {
+		res = append(res, Event{Start: windowMs, End: windowMs})
+	}
+	return res
+}
+
+// CropToActive returns a copy of the events rebased as in RebaseToZero, so the first activity is at 0,
+// along with the original start of the first event and end of the last event. The cropped timeline
+// runs from 0 to endMs-startMs, without the idle time before and after the events. If there are no
+// events, nil and (0, 0) are returned.
+func CropToActive(events []Event) (cropped []Event, startMs, endMs int64) {
+	startMs, endMs = ReportBounds(map[string][]Event{"": events})
+	return RebaseToZero(events), startMs, endMs
+}
+
+// FilterByWindow returns the events overlapping the window from startMs to endMs, with any parts
+// outside the window cut off. Instant events are kept if they are within the window, including at
+// its edges. Marker events in the window are kept as is. Events with an End of -1 are treated as
+// still ongoing at endMs. The order of the events is preserved.
+func FilterByWindow(events []Event, startMs, endMs int64) []Event {
+	var res []Event
+	for _, e := range events {
+		if e, ok := clipToWindow(e, startMs, endMs); ok {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// clipToWindow returns the part of the event within the window from startMs to endMs, as described
+// for FilterByWindow, and whether the event overlaps the window at all.
+func clipToWindow(e Event, startMs, endMs int64) (Event, bool) {
+	if e.End == -1 {
+		e.End = endMs
+	}
+	if e.Start == e.End {
+		return e, e.Start >= startMs && e.Start <= endMs
+	}
+	if e.End <= startMs || e.Start >= endMs {
+		return e, false
+	}
+	e.Start = historianutils.MaxInt64(e.Start, startMs)
+	e.End = minInt64(e.End, endMs)
+	return e, true
+}
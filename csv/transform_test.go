@@ -0,0 +1,525 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csv
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestQuantize tests snapping event boundaries to a grid.
+func TestQuantize(t *testing.T) {
+	input := []Event{
+		{Start: 1200, End: 2800, Value: "a"},
+		{Start: 3000, End: 4000, Value: "b"},
+		{Start: 5000, End: 5000, Value: "c"},
+		{Start: 6500, End: 6500, Value: "d"},
+		{Start: -1500, End: -200, Value: "e"},
+		{Start: 7200, End: -1, Value: "f"},
+	}
+	tests := []struct {
+		desc      string
+		gridMs    int64
+		keepEmpty bool
+		want      []Event
+	}{
+		{
+			desc:   "1000ms grid, dropping empty events",
+			gridMs: 1000,
+			want: []Event{
+				{Start: 1000, End: 3000, Value: "a"},
+				{Start: 3000, End: 4000, Value: "b"},
+				{Start: 6000, End: 7000, Value: "d"},
+				{Start: -2000, End: 0, Value: "e"},
+				{Start: 7000, End: -1, Value: "f"},
+			},
+		},
+		{
+			desc:      "1000ms grid, keeping empty events",
+			gridMs:    1000,
+			keepEmpty: true,
+			want: []Event{
+				{Start: 1000, End: 3000, Value: "a"},
+				{Start: 3000, End: 4000, Value: "b"},
+				{Start: 5000, End: 5000, Value: "c"},
+				{Start: 6000, End: 7000, Value: "d"},
+				{Start: -2000, End: 0, Value: "e"},
+				{Start: 7000, End: -1, Value: "f"},
+			},
+		},
+		{
+			desc:      "Invalid grid",
+			gridMs:    0,
+			keepEmpty: true,
+			want:      input,
+		},
+		{
+			desc:   "Invalid grid, dropping empty events",
+			gridMs: 0,
+			want:   input,
+		},
+	}
+	for _, test := range tests {
+		if got := Quantize(input, test.gridMs, test.keepEmpty); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: Quantize(%v, %d, %v) = %v, want %v", test.desc, input, test.gridMs, test.keepEmpty, got, test.want)
+		}
+	}
+}
+
+// TestTrimShort tests dropping events shorter than a threshold.
+func TestTrimShort(t *testing.T) {
+	input := []Event{
+		{Start: 1000, End: 1001, Value: "a"},
+		{Start: 2000, End: 2500, Value: "b"},
+		{Start: 3000, End: 3000, Value: "c"},
+		{Start: 4000, End: 4100, Value: "d"},
+		{Start: 5000, End: 5099, Value: "e"},
+		{Start: 6000, End: -1, Value: "f"},
+	}
+	tests := []struct {
+		desc        string
+		minMs       int64
+		dropInstant bool
+		want        []Event
+	}{
+		{
+			desc:  "Keep instant events",
+			minMs: 100,
+			want: []Event{
+				{Start: 2000, End: 2500, Value: "b"},
+				{Start: 3000, End: 3000, Value: "c"},
+				{Start: 4000, End: 4100, Value: "d"},
+				{Start: 6000, End: -1, Value: "f"},
+			},
+		},
+		{
+			desc:        "Drop instant events",
+			minMs:       100,
+			dropInstant: true,
+			want: []Event{
+				{Start: 2000, End: 2500, Value: "b"},
+				{Start: 4000, End: 4100, Value: "d"},
+				{Start: 6000, End: -1, Value: "f"},
+			},
+		},
+		{
+			desc:  "No threshold",
+			minMs: 0,
+			want:  input,
+		},
+	}
+	for _, test := range tests {
+		if got := TrimShort(input, test.minMs, test.dropInstant); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: TrimShort(%v, %d, %v) = %v, want %v", test.desc, input, test.minMs, test.dropInstant, got, test.want)
+		}
+	}
+}
+
+// TestCloneEventMap tests that modifying a cloned map does not affect the original.
+func TestCloneEventMap(t *testing.T) {
+	orig := map[string][]Event{
+		"Screen": {
+			{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+			{Type: "bool", Start: 3000, End: 4000, Value: "true"},
+		},
+		"Wakelock": nil,
+	}
+	want := map[string][]Event{
+		"Screen": {
+			{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+			{Type: "bool", Start: 3000, End: 4000, Value: "true"},
+		},
+		"Wakelock": nil,
+	}
+
+	got := CloneEventMap(orig)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("CloneEventMap(%v) = %v, want %v", orig, got, want)
+	}
+	got["Screen"][0].End = 5000
+	got["Screen"] = append(got["Screen"][:1], Event{Start: 6000, End: 7000})
+	got["Wakelock"] = append(got["Wakelock"], Event{Start: 0, End: 100})
+	delete(got, "Screen")
+	got["Camera"] = []Event{{Start: 0, End: 100}}
+
+	if !reflect.DeepEqual(orig, want) {
+		t.Errorf("CloneEventMap(%v) modifying the copy changed the original to %v", want, orig)
+	}
+}
+
+func TestRebaseToZero(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []Event
+		want  []Event
+	}{
+		{
+			desc: "Earliest event is not first",
+			input: []Event{
+				{Start: 5000, End: 7000, Value: "a"},
+				{Start: 3000, End: 3000, Value: "b"},
+				{Start: 4000, End: 9000, Value: "c"},
+			},
+			want: []Event{
+				{Start: 2000, End: 4000, Value: "a"},
+				{Start: 0, End: 0, Value: "b"},
+				{Start: 1000, End: 6000, Value: "c"},
+			},
+		},
+		{
+			desc: "Already at zero",
+			input: []Event{
+				{Start: 0, End: 100, Value: "a"},
+			},
+			want: []Event{
+				{Start: 0, End: 100, Value: "a"},
+			},
+		},
+		{
+			desc: "Open event",
+			input: []Event{
+				{Start: 2000, End: 3000, Value: "a"},
+				{Start: 2500, End: -1, Value: "b"},
+			},
+			want: []Event{
+				{Start: 0, End: 1000, Value: "a"},
+				{Start: 500, End: -1, Value: "b"},
+			},
+		},
+		{
+			desc: "No events",
+		},
+	}
+	for _, test := range tests {
+		if got := RebaseToZero(test.input); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: RebaseToZero(%v) = %v, want %v", test.desc, test.input, got, test.want)
+		}
+	}
+}
+
+func TestSnapOpenEnds(t *testing.T) {
+	reference := []Event{
+		{Start: 1000, End: 2000, Value: "cpu"},
+		{Start: 3000, End: 4500, Value: "cpu"},
+		{Start: 9000, End: 10000, Value: "last"},
+	}
+	tests := []struct {
+		desc      string
+		events    []Event
+		reference []Event
+		want      []Event
+	}{
+		{
+			desc: "Open event snapped to last reference activity",
+			events: []Event{
+				{Start: 500, End: 1500, Value: "closed"},
+				{Start: 2500, End: 10000, Value: "open"},
+			},
+			reference: reference[:2],
+			want: []Event{
+				{Start: 500, End: 1500, Value: "closed"},
+				{Start: 2500, End: 4500, Value: "open"},
+			},
+		},
+		{
+			desc: "Reference active until the report end",
+			events: []Event{
+				{Start: 2500, End: 10000, Value: "open"},
+				{Start: 5000, End: 8000, Value: "closed"},
+			},
+			reference: reference,
+			want: []Event{
+				{Start: 2500, End: 10000, Value: "open"},
+				{Start: 5000, End: 8000, Value: "closed"},
+			},
+		},
+		{
+			desc: "No reference activity after open event starts",
+			events: []Event{
+				{Start: 5000, End: 10000, Value: "open"},
+			},
+			reference: reference[:2],
+			want: []Event{
+				{Start: 5000, End: 10000, Value: "open"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := SnapOpenEnds(test.events, test.reference); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: SnapOpenEnds(%v, %v) = %v, want %v", test.desc, test.events, test.reference, got, test.want)
+		}
+	}
+}
+
+func TestRemoveContained(t *testing.T) {
+	input := []Event{
+		{Type: "service", Start: 2000, End: 2500, Value: "a"},
+		{Type: "service", Start: 1000, End: 5000, Value: "a"},
+		{Type: "service", Start: 4000, End: 6000, Value: "a"},
+		{Type: "service", Start: 2000, End: 2500, Value: "b"},
+		{Type: "service", Start: 7000, End: 8000, Value: "c"},
+		{Type: "service", Start: 7000, End: 8000, Value: "c"},
+		{Type: "bool", Start: 1500, End: 1600, Value: "a"},
+	}
+	want := []Event{
+		{Type: "service", Start: 1000, End: 5000, Value: "a"},
+		{Type: "service", Start: 4000, End: 6000, Value: "a"},
+		{Type: "service", Start: 2000, End: 2500, Value: "b"},
+		{Type: "service", Start: 7000, End: 8000, Value: "c"},
+		{Type: "bool", Start: 1500, End: 1600, Value: "a"},
+	}
+	if got := RemoveContained(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("RemoveContained(%v) = %v, want %v", input, got, want)
+	}
+}
+
+// TestCapEvents tests reducing the number of events by merging those separated by the smallest gaps.
+func TestCapEvents(t *testing.T) {
+	// 1000 contiguous events, so merging any of them preserves the total duration.
+	var contiguous []Event
+	for i := int64(0); i < 1000; i++ {
+		contiguous = append(contiguous, Event{Type: "bool", Start: i * 10, End: i*10 + 10, Value: "true"})
+	}
+	capped := CapEvents(contiguous, 100)
+	if len(capped) > 100 {
+		t.Errorf("CapEvents(%d events, 100) returned %d events, want at most 100", len(contiguous), len(capped))
+	}
+	if got, want := Summarize(capped).TotalMs, Summarize(contiguous).TotalMs; got != want {
+		t.Errorf("CapEvents(%d events, 100) total duration = %d, want %d", len(contiguous), got, want)
+	}
+
+	tests := []struct {
+		desc   string
+		events []Event
+		max    int
+		want   []Event
+	}{
+		{
+			desc: "smallest gaps merged first",
+			events: []Event{
+				{Start: 0, End: 10, Value: "a"},
+				{Start: 15, End: 20, Value: "b"},
+				{Start: 21, End: 30, Value: "c"},
+				{Start: 33, End: 40, Value: "d"},
+				{Start: 42, End: 50, Value: "e"},
+			},
+			max: 3,
+			want: []Event{
+				{Start: 0, End: 10, Value: "a"},
+				{Start: 15, End: 30, Value: "b"},
+				{Start: 33, End: 50, Value: "d"},
+			},
+		},
+		{
+			desc: "overlaps always merged",
+			events: []Event{
+				{Start: 100, End: 200, Value: "c"},
+				{Start: 0, End: 50, Value: "a"},
+				{Start: 10, End: 20, Value: "b"},
+				{Start: 30, End: 60, Value: "b"},
+			},
+			max: 3,
+			want: []Event{
+				{Start: 0, End: 60, Value: "a"},
+				{Start: 100, End: 200, Value: "c"},
+			},
+		},
+		{
+			desc: "open event covers later events",
+			events: []Event{
+				{Start: 0, End: 10, Value: "a"},
+				{Start: 20, End: -1, Value: "b"},
+				{Start: 30, End: 40, Value: "c"},
+				{Start: 1000, End: 1010, Value: "d"},
+			},
+			max: 2,
+			want: []Event{
+				{Start: 0, End: 10, Value: "a"},
+				{Start: 20, End: -1, Value: "b"},
+			},
+		},
+		{
+			desc: "open event merged into a closed one",
+			events: []Event{
+				{Start: 0, End: 100, Value: "a"},
+				{Start: 50, End: -1, Value: "b"},
+				{Start: 5000, End: 6000, Value: "c"},
+			},
+			max: 2,
+			want: []Event{
+				{Start: 0, End: -1, Value: "a"},
+			},
+		},
+	}
+	for _, test := range tests {
+		orig := CloneEvents(test.events)
+		if got := CapEvents(test.events, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: CapEvents(%v, %d) = %v, want %v", test.desc, test.events, test.max, got, test.want)
+		}
+		if !reflect.DeepEqual(test.events, orig) {
+			t.Errorf("%v: CapEvents(%v, %d) modified the input to %v", test.desc, orig, test.max, test.events)
+		}
+	}
+
+	under := contiguous[:10]
+	if got := CapEvents(under, 100); &got[0] != &under[0] || len(got) != len(under) {
+		t.Errorf("CapEvents(%d events, 100) didn't return the original events", len(under))
+	}
+}
+
+// TestPadToWindow tests that sentinels are only added at the edges of the window events don't reach.
+func TestPadToWindow(t *testing.T) {
+	tests := []struct {
+		desc   string
+		events []Event
+		want   []Event
+	}{
+		{
+			desc:   "both missing",
+			events: []Event{{Type: "bool", Start: 1000, End: 2000, Value: "true"}},
+			want: []Event{
+				{Start: 0, End: 0},
+				{Type: "bool", Start: 1000, End: 2000, Value: "true"},
+				{Start: 10000, End: 10000},
+			},
+		},
+		{
+			desc: "start present",
+			events: []Event{
+				{Type: "bool", Start: 5000, End: 6000, Value: "true"},
+				{Type: "bool", Start: 0, End: 1000, Value: "true"},
+			},
+			want: []Event{
+				{Type: "bool", Start: 5000, End: 6000, Value: "true"},
+				{Type: "bool", Start: 0, End: 1000, Value: "true"},
+				{Start: 10000, End: 10000},
+			},
+		},
+		{
+			desc:   "both present",
+			events: []Event{{Type: "bool", Start: 0, End: 10000, Value: "true"}},
+			want:   []Event{{Type: "bool", Start: 0, End: 10000, Value: "true"}},
+		},
+		{
+			desc: "no events",
+			want: []Event{{Start: 0, End: 0}, {Start: 10000, End: 10000}},
+		},
+	}
+	for _, test := range tests {
+		if got := PadToWindow(test.events, 10000); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: PadToWindow(%v, 10000) = %v, want %v", test.desc, test.events, got, test.want)
+		}
+	}
+}
+
+// TestCropToActive tests cropping the idle time before the first event and after the last event.
+func TestCropToActive(t *testing.T) {
+	// Events of a report running from 0 to 60000, with no activity before 5000 or after 9000.
+	input := []Event{
+		{Type: "service", Start: 7000, End: 9000, Value: "b"},
+		{Type: "service", Start: 5000, End: 6000, Value: "a"},
+		{Type: "service", Start: 5500, End: 5500, Value: "c"},
+	}
+	want := []Event{
+		{Type: "service", Start: 2000, End: 4000, Value: "b"},
+		{Type: "service", Start: 0, End: 1000, Value: "a"},
+		{Type: "service", Start: 500, End: 500, Value: "c"},
+	}
+	cropped, start, end := CropToActive(input)
+	if !reflect.DeepEqual(cropped, want) || start != 5000 || end != 9000 {
+		t.Errorf("CropToActive(%v) = %v, %d, %d, want %v, 5000, 9000", input, cropped, start, end, want)
+	}
+
+	// The last event is still open, so the active region runs until at least its start.
+	open := append(CloneEvents(input), Event{Type: "service", Start: 9500, End: -1, Value: "d"})
+	wantOpen := append(CloneEvents(want), Event{Type: "service", Start: 4500, End: -1, Value: "d"})
+	if cropped, start, end := CropToActive(open); !reflect.DeepEqual(cropped, wantOpen) || start != 5000 || end != 9500 {
+		t.Errorf("CropToActive(%v) = %v, %d, %d, want %v, 5000, 9500", open, cropped, start, end, wantOpen)
+	}
+
+	if cropped, start, end := CropToActive(nil); cropped != nil || start != 0 || end != 0 {
+		t.Errorf("CropToActive(nil) = %v, %d, %d, want nil, 0, 0", cropped, start, end)
+	}
+}
+
+// TestFilterByWindow tests keeping only the parts of events within a window.
+func TestFilterByWindow(t *testing.T) {
+	input := []Event{
+		{Type: "service", Start: 0, End: 2000, Value: "before"},
+		{Type: "service", Start: 4000, End: 12000, Value: "overlapping"},
+		{Type: "service", Start: 6000, End: 6000, Value: "instant"},
+		{Type: "service", Start: 9000, End: -1, Value: "ongoing"},
+		{Type: "service", Start: 11000, End: 13000, Value: "after"},
+	}
+	want := []Event{
+		{Type: "service", Start: 5000, End: 10000, Value: "overlapping"},
+		{Type: "service", Start: 6000, End: 6000, Value: "instant"},
+		{Type: "service", Start: 9000, End: 10000, Value: "ongoing"},
+	}
+	if got := FilterByWindow(input, 5000, 10000); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterByWindow(%v, 5000, 10000) = %v, want %v", input, got, want)
+	}
+}
+
+// TestMarkers tests that marker events are kept through merging and transforms.
+func TestMarkers(t *testing.T) {
+	reset := NewMarker(5000, "RESET")
+	input := []Event{
+		{Type: "bool", Start: 2000, End: 6000, Value: "true"},
+		reset,
+		{Type: "bool", Start: 5000, End: 8000, Value: "true"},
+	}
+
+	merged := MergeEvents(CloneEvents(input))
+	// MergeEvents only keeps the times of merged events.
+	want := []Event{{Start: 2000, End: 8000}, reset}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("MergeEvents(%v) = %v, want %v", input, merged, want)
+	}
+
+	filtered := FilterByWindow(merged, 4000, 7000)
+	want = []Event{{Start: 4000, End: 7000}, reset}
+	if !reflect.DeepEqual(filtered, want) {
+		t.Errorf("FilterByWindow(%v, 4000, 7000) = %v, want %v", merged, filtered, want)
+	}
+
+	if got := TrimShort(filtered, 1000, true); !reflect.DeepEqual(got, filtered) {
+		t.Errorf("TrimShort(%v, 1000, true) = %v, want %v", filtered, got, filtered)
+	}
+	if got := RemoveContained(filtered); !reflect.DeepEqual(got, filtered) {
+		t.Errorf("RemoveContained(%v) = %v, want %v", filtered, got, filtered)
+	}
+	capped := append(CloneEvents(filtered), Event{Start: 7500, End: 8000})
+	want = []Event{{Start: 4000, End: 8000}, reset}
+	if got := CapEvents(capped, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("CapEvents(%v, 1) = %v, want %v", capped, got, want)
+	}
+
+	// The marker ends before the merged event, so the merged events aren't ordered by End.
+	newEvents := []Event{{Start: 7000, End: 9000}}
+	want = []Event{{Start: 2000, End: 9000}, reset}
+	if got := MergeAppend(merged, newEvents); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeAppend(%v, %v) = %v, want %v", merged, newEvents, got, want)
+	}
+
+	coalesced, summary := CoalesceAndSummarize(input, 0)
+	wantMerged := MergeEventsWithGap(CloneEvents(input), 0)
+	if !reflect.DeepEqual(coalesced, wantMerged) {
+		t.Errorf("CoalesceAndSummarize(%v, 0) merged = %v, want %v", input, coalesced, wantMerged)
+	}
+	if wantSummary := Summarize(wantMerged); !reflect.DeepEqual(summary, wantSummary) {
+		t.Errorf("CoalesceAndSummarize(%v, 0) summary = %v, want %v", input, summary, wantSummary)
+	}
+}
@@ -18,6 +18,8 @@ package historianutils
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -36,6 +38,10 @@ var (
 
 	// piiSyncRE is a regular expression to match any PII string of the form *sync*/blah/blah/pii
 	piiSyncRE = regexp.MustCompile(`(?P<prefix>\*sync\*/\S+/)(?P<account>\S+)`)
+
+	// piiTextEmailRE is a regular expression to match an email address within a larger piece of text.
+	// The domain must end with a letter-only top level domain, so wakelock names such as "wake.lock@1a23b4" don't match.
+	piiTextEmailRE = regexp.MustCompile(`(?P<account>[\w.+-]+)` + `@` + `(?P<domain>[\w-]+(\.[\w-]+)*\.[A-Za-z]+)\b`)
 )
 
 // ScrubPII scrubs any part of the string that looks like PII (eg. an email address).
@@ -57,6 +63,26 @@ func ScrubPII(input string) string {
 	return input
 }
 
+// ScrubPIIConsistent replaces each email address in the text with a pseudonym, keeping the domain as
+// ScrubPII does, and returns the scrubbed text along with the mapping from each original address to its
+// pseudonym. Unlike ScrubPII, each distinct address gets its own pseudonym, numbered in order of first
+// appearance, so the same address maps to the same pseudonym throughout the text, and scrubbed
+// reports can still be compared. e.g. "a@google.com b@google.com a@google.com" gives
+// "XXX1@google.com XXX2@google.com XXX1@google.com".
+func ScrubPIIConsistent(text string) (string, map[string]string) {
+	mapping := make(map[string]string)
+	scrubbed := piiTextEmailRE.ReplaceAllStringFunc(text, func(email string) string {
+		if p, ok := mapping[email]; ok {
+			return p
+		}
+		domain := email[strings.LastIndex(email, "@")+1:]
+		p := fmt.Sprintf("XXX%d@%s", len(mapping)+1, domain)
+		mapping[email] = p
+		return p
+	})
+	return scrubbed, mapping
+}
+
 // SubexpNames returns a mapping of the sub-expression names to values if the Regexp
 // successfully matches the string, otherwise, it returns false.
 func SubexpNames(r *regexp.Regexp, s string) (bool, map[string]string) {
@@ -88,6 +114,78 @@ func ErrorsToString(errs []error) string {
 	return errorB.String()
 }
 
+// Classes of ParseError, describing why a line couldn't be parsed.
+const (
+	// ErrorClassMalformed is for lines that don't have the expected format.
+	ErrorClassMalformed = "malformed"
+	// ErrorClassInvalidValue is for lines with a field that couldn't be parsed, such as a number.
+	ErrorClassInvalidValue = "invalid_value"
+	// ErrorClassValidation is for lines that were parsed, but failed validation, such as CSV records
+	// failing a csv.Validator. ClassifyError doesn't return it, as only the validating caller knows.
+	ErrorClassValidation = "validation"
+)
+
+// ParseError describes a line of a section of input that was skipped because it couldn't be parsed,
+// so it can be reported to the user alongside the data that was parsed.
+type ParseError struct {
+	// Section is the name of the section of input the line is from, such as "batterystats history".
+	Section string `json:"section"`
+	// Line is the 1-based number of the line, or record for CSV input, within the section.
+	Line int `json:"line"`
+	// Class is one of the ErrorClass constants.
+	Class string `json:"class"`
+	Raw   string `json:"raw"`
+	// Err is the underlying error, and is reported as the message.
+	Err error `json:"-"`
+}
+
+// NewParseError returns a ParseError for the given line, classified with ClassifyError.
+func NewParseError(section string, line int, raw string, err error) *ParseError {
+	return &ParseError{Section: section, Line: line, Class: ClassifyError(err), Raw: raw, Err: err}
+}
+
+// Error returns the message of the underlying error, so wrapping an error in a ParseError doesn't
+// change how it's displayed.
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON encodes the error with its message.
+func (e *ParseError) MarshalJSON() ([]byte, error) {
+	type diag ParseError
+	return json.Marshal(struct {
+		*diag
+		Message string `json:"message"`
+	}{(*diag)(e), e.Error()})
+}
+
+// ClassifyError returns the ErrorClass for the error: ErrorClassInvalidValue if a number or duration
+// failed to parse, and ErrorClassMalformed otherwise.
+func ClassifyError(err error) string {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return ErrorClassInvalidValue
+	}
+	return ErrorClassMalformed
+}
+
+// Diagnostics returns the ParseErrors among the given errors, in order.
+func Diagnostics(errs []error) []*ParseError {
+	var res []*ParseError
+	for _, err := range errs {
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			res = append(res, pe)
+		}
+	}
+	return res
+}
+
 // GzipCompress compresses byte data.
 func GzipCompress(uncompressed []byte) ([]byte, error) {
 	var b bytes.Buffer
@@ -97,6 +195,21 @@ func GzipCompress(uncompressed []byte) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// FormatFloat formats f in decimal notation with at most prec digits after the decimal point.
+// Trailing zeros (and a trailing decimal point) are removed, and negative zero is output as "0",
+// so that the same value is always printed the same way. e.g. FormatFloat(4.2, 3) returns "4.2".
+func FormatFloat(f float64, prec int) string {
+	s := strconv.FormatFloat(f, 'f', prec, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
 // MaxInt64 returns the higher of a or b.
 func MaxInt64(a int64, b int64) int64 {
 	if a >= b {
@@ -134,9 +247,141 @@ func ParseDurationWithDays(input string) (int64, error) {
 	return dur.Nanoseconds() / int64(time.Millisecond), nil
 }
 
+// ParseAndroidDuration parses a duration in one of the forms printed in bug reports, and returns the milliseconds.
+// Handles durations with units, optionally separated by spaces, such as "1d 2h3m4s5ms" and "123ms",
+// and clock durations such as "01:02:03" (HH:MM:SS) and "02:03" (MM:SS).
+func ParseAndroidDuration(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ":") {
+		ms, err := ParseDurationWithDays(strings.Replace(s, " ", "", -1))
+		if err != nil {
+			return 0, fmt.Errorf("unrecognized duration %q: %v", s, err)
+		}
+		return ms, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("unrecognized duration %q", s)
+	}
+	var secs int64
+	for _, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("unrecognized duration %q", s)
+		}
+		secs = secs*60 + int64(v)
+	}
+	return secs * 1000, nil
+}
+
+// SplitFields splits a single line of CSV into its fields, as SplitRecord does, appending them to
+// dst[:0] so the caller can reuse the slice across lines.
+func SplitFields(line string, dst []string) []string {
+	fields, _ := SplitRecord(line, dst)
+	return fields
+}
+
+// SplitRecord splits the first record of the CSV input s into its fields, appending them to dst[:0],
+// and returns the fields along with the rest of the input following the record. Empty lines before the
+// record are skipped, and nil is returned if there are no more records. Fields are parsed the same way
+// as checkinutil.ParseCSV: leading and trailing spaces are trimmed, quoted fields may contain commas,
+// newlines and doubled "" quotes, and bare quotes are kept as is. Fields without doubled quotes are
+// substrings of s, so reusing dst avoids allocating for each record.
+func SplitRecord(s string, dst []string) ([]string, string) {
+	for strings.HasPrefix(s, "\n") || strings.HasPrefix(s, "\r\n") {
+		s = s[strings.IndexByte(s, '\n')+1:]
+	}
+	if s == "" {
+		return nil, ""
+	}
+	fields := dst[:0]
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\r') {
+			i++
+		}
+		if i < len(s) && s[i] == '"' {
+			field, n, end := quotedField(s[i+1:])
+			fields = append(fields, strings.TrimSpace(field))
+			i += 1 + n
+			if end {
+				return fields, s[i:]
+			}
+			continue
+		}
+		j := strings.IndexAny(s[i:], ",\n")
+		if j < 0 {
+			return append(fields, strings.TrimSpace(s[i:])), ""
+		}
+		fields = append(fields, strings.TrimSpace(s[i:i+j]))
+		i += j + 1
+		if s[i-1] == '\n' {
+			return fields, s[i:]
+		}
+	}
+}
+
+// quotedField parses a quoted CSV field from s, which starts just after the opening quote. It returns
+// the unquoted field, the number of bytes of s consumed, including the delimiter after the closing
+// quote, and whether the field ended the record. A quote not followed by another quote, a comma or
+// the end of the line is kept as part of the field, as is everything to the end of s if the field is
+// never closed.
+func quotedField(s string) (field string, n int, end bool) {
+	var b []byte // Only used if there are doubled quotes to unescape.
+	seg := 0
+	for j := 0; ; {
+		k := strings.IndexByte(s[j:], '"')
+		if k < 0 {
+			break
+		}
+		j += k
+		switch {
+		case strings.HasPrefix(s[j+1:], `"`):
+			b = append(b, s[seg:j+1]...)
+			j += 2
+			seg = j
+			continue
+		case j+1 == len(s):
+			return unescaped(b, s[seg:j]), j + 1, true
+		case s[j+1] == ',':
+			return unescaped(b, s[seg:j]), j + 2, false
+		case s[j+1] == '\n':
+			return unescaped(b, s[seg:j]), j + 2, true
+		case strings.HasPrefix(s[j+1:], "\r\n"):
+			return unescaped(b, s[seg:j]), j + 3, true
+		}
+		j++
+	}
+	return unescaped(b, s[seg:]), len(s), true
+}
+
+// unescaped returns the string of b followed by s, without copying s if b is empty.
+func unescaped(b []byte, s string) string {
+	if len(b) == 0 {
+		return s
+	}
+	return string(append(b, s...))
+}
+
+// ParseIntField parses value as a base 10 int64, prefixing any error with the name of the field
+// being parsed, e.g. `start: strconv.ParseInt: parsing "abc": invalid syntax`.
+func ParseIntField(field, value string) (int64, error) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", field, err)
+	}
+	return v, nil
+}
+
 // RunCommand executes the given command and returns the output.
 func RunCommand(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
+	return RunCommandContext(context.Background(), name, args...)
+}
+
+// RunCommandContext is the same as RunCommand, but kills the command if the context is done before
+// it finishes.
+func RunCommandContext(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
 	// Stdout pipe for reading the generated output.
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -15,7 +15,15 @@
 package historianutils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/chenjiacun35/battery-historian/checkinutil"
 )
 
 func TestScrubPII(t *testing.T) {
@@ -44,6 +52,33 @@ func TestScrubPII(t *testing.T) {
 	}
 }
 
+// TestScrubPIIConsistent tests that each distinct email address is replaced with the same pseudonym throughout the text.
+func TestScrubPIIConsistent(t *testing.T) {
+	input := strings.Join([]string{
+		`Wakelock_in,service,1000,2000,"*sync*/com.android.contacts/com.google/noogler@google.com",10012`,
+		`Wakelock_in,service,3000,4000,"wake.lock@1a23b4",10012`,
+		`Sync,service,5000,6000,"com.android.calendar/com.google/other.noogler@gmail.com",10013`,
+		`Sync,service,7000,8000,"com.android.gmail/com.google/noogler@google.com",10014`,
+	}, "\n")
+	wantText := strings.Join([]string{
+		`Wakelock_in,service,1000,2000,"*sync*/com.android.contacts/com.google/XXX1@google.com",10012`,
+		`Wakelock_in,service,3000,4000,"wake.lock@1a23b4",10012`,
+		`Sync,service,5000,6000,"com.android.calendar/com.google/XXX2@gmail.com",10013`,
+		`Sync,service,7000,8000,"com.android.gmail/com.google/XXX1@google.com",10014`,
+	}, "\n")
+	wantMapping := map[string]string{
+		"noogler@google.com":      "XXX1@google.com",
+		"other.noogler@gmail.com": "XXX2@gmail.com",
+	}
+	got, mapping := ScrubPIIConsistent(input)
+	if got != wantText {
+		t.Errorf("ScrubPIIConsistent(%v) output incorrect text:\n  got: %v\n  want: %v", input, got, wantText)
+	}
+	if !reflect.DeepEqual(mapping, wantMapping) {
+		t.Errorf("ScrubPIIConsistent(%v) mapping = %v, want %v", input, mapping, wantMapping)
+	}
+}
+
 func TestParseDurationWithDays(t *testing.T) {
 	tests := []struct {
 		unparsedDur string
@@ -69,3 +104,160 @@ func TestParseDurationWithDays(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAndroidDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantMs  int64
+		wantErr bool
+	}{
+		{input: "1d 2h3m4s5ms", wantMs: 93784005},
+		{input: "1d 2h 3m 4s 5ms", wantMs: 93784005},
+		{input: "123ms", wantMs: 123},
+		{input: "01:02:03", wantMs: 3723000},
+		{input: "02:03", wantMs: 123000},
+		{input: " 45s ", wantMs: 45000},
+		{input: "1:2:3:4", wantErr: true},
+		{input: "01:xx:03", wantErr: true},
+		{input: "12 parsecs", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		gotMs, err := ParseAndroidDuration(test.input)
+		gotErr := err != nil
+		if gotErr != test.wantErr {
+			t.Errorf("ParseAndroidDuration(%q) got err: %v, want err %v", test.input, err, test.wantErr)
+			continue
+		}
+		if gotMs != test.wantMs {
+			t.Errorf("ParseAndroidDuration(%q) got ms: %d, want ms %d", test.input, gotMs, test.wantMs)
+		}
+	}
+}
+
+func TestParseIntField(t *testing.T) {
+	tests := []struct {
+		field   string
+		value   string
+		want    int64
+		wantErr string
+	}{
+		{field: "start", value: "1422620451417", want: 1422620451417},
+		{field: "end", value: "-1", want: -1},
+		{field: "start", value: "abc", wantErr: `start: strconv.ParseInt: parsing "abc": invalid syntax`},
+		{field: "end", value: "", wantErr: `end: strconv.ParseInt: parsing "": invalid syntax`},
+	}
+
+	for _, test := range tests {
+		got, err := ParseIntField(test.field, test.value)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("ParseIntField(%q, %q) got err: %v, want err: %s", test.field, test.value, err, test.wantErr)
+			}
+			if !errors.Is(err, strconv.ErrSyntax) || ClassifyError(err) != ErrorClassInvalidValue {
+				t.Errorf("ParseIntField(%q, %q) err %v doesn't wrap the strconv error", test.field, test.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseIntField(%q, %q) unexpected err: %v", test.field, test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseIntField(%q, %q) = %d, want %d", test.field, test.value, got, test.want)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		f    float64
+		prec int
+		want string
+	}{
+		{f: 0, prec: 3, want: "0"},
+		{f: 4.262, prec: 3, want: "4.262"},
+		{f: 3.81, prec: 3, want: "3.81"},
+		{f: 4000, prec: 3, want: "4000"},
+		{f: 2.5, prec: 0, want: "2"}, // Round half to even.
+		{f: 1.0005, prec: 3, want: "1"},
+		{f: -12.3456, prec: 2, want: "-12.35"},
+		{f: -0.0001, prec: 3, want: "0"},
+		{f: 0.000001234, prec: 9, want: "0.000001234"},
+		{f: 0.000001234, prec: 3, want: "0"},
+		{f: 1e15, prec: 3, want: "1000000000000000"},
+		{f: 123456789.125, prec: 2, want: "123456789.12"},
+	}
+	for _, test := range tests {
+		if got := FormatFloat(test.f, test.prec); got != test.want {
+			t.Errorf("FormatFloat(%v, %d) = %q, want %q", test.f, test.prec, got, test.want)
+		}
+	}
+}
+
+// TestSplitRecord tests that splitting records one at a time gives the same fields as checkinutil.ParseCSV.
+func TestSplitRecord(t *testing.T) {
+	input := strings.Join([]string{
+		`metric,type,start_time,end_time,value,opt`,
+		`Screen,bool,1000,2000,true,`,
+		`CPU running,string,1000,2000,"1000~Abort:Pending Wakeup Sources: ipc000000b0, sync",`,
+		``,
+		`Wakelock_in,service,1000,2000,"com.google.android.gms ""persistent""",10012`,
+		`am_wtf,service,1000,1000," multi`,
+		`line, value",`,
+		`  Padded , service ,1000, 2000 ,"quoted" ,"x"y"`,
+		`Bare,service,1000,1000,a "quoted" word,`,
+		"Windows,bool,1000,2000,true,\r",
+		`Unterminated,service,1000,1000,"rest`,
+		`of the input`,
+	}, "\n")
+	want := checkinutil.ParseCSV(input)
+
+	var got [][]string
+	var fields []string
+	for rest := input; ; {
+		fields, rest = SplitRecord(rest, fields)
+		if fields == nil {
+			break
+		}
+		got = append(got, append([]string(nil), fields...))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitRecord(%q) records:\n  got: %q\n  want: %q", input, got, want)
+	}
+
+	line := `Wakelock_in,service,1000,2000,"com.google.android.gms ""persistent"", sync",10012`
+	wantFields := []string{"Wakelock_in", "service", "1000", "2000", `com.google.android.gms "persistent", sync`, "10012"}
+	if got := SplitFields(line, nil); !reflect.DeepEqual(got, wantFields) {
+		t.Errorf("SplitFields(%q, nil) = %q, want %q", line, got, wantFields)
+	}
+}
+
+
+// TestParseError tests that parse errors keep the message of the underlying error, and are found among other errors.
+func TestParseError(t *testing.T) {
+	_, numErr := strconv.ParseInt("x", 10, 64)
+	invalid := NewParseError("batterystats checkin", 3, "9,0,l,bt,x", fmt.Errorf("battery time: %w", numErr))
+	malformed := NewParseError("batterystats history", 7, "9,h,bad", errors.New("unknown format"))
+
+	if invalid.Class != ErrorClassInvalidValue || malformed.Class != ErrorClassMalformed {
+		t.Errorf("NewParseError() classes = %q, %q, want %q, %q", invalid.Class, malformed.Class, ErrorClassInvalidValue, ErrorClassMalformed)
+	}
+	if got, want := malformed.Error(), "unknown format"; got != want {
+		t.Errorf("ParseError.Error() = %q, want %q", got, want)
+	}
+
+	b, err := json.Marshal(malformed)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) unexpected error: %v", malformed, err)
+	}
+	if got, want := string(b), `{"section":"batterystats history","line":7,"class":"malformed","raw":"9,h,bad","message":"unknown format"}`; got != want {
+		t.Errorf("json.Marshal(%v) = %s, want %s", malformed, got, want)
+	}
+
+	errs := []error{errors.New("other"), invalid, fmt.Errorf("wrapped: %w", malformed)}
+	if got, want := Diagnostics(errs), []*ParseError{invalid, malformed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Diagnostics(%v) = %v, want %v", errs, got, want)
+	}
+}
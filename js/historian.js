@@ -613,7 +613,7 @@ historian.windowResizeHandler = function(event) {
 
 
 /**
- * Enables the error and warning dialogs to show the corresponding data.
+ * Enables the error, warning and skipped lines dialogs to show the corresponding data.
  */
 historian.initErrorAndWarning = function() {
   // Dialog is used to show erros and warnings.
@@ -637,6 +637,12 @@ historian.initErrorAndWarning = function() {
     historian.menu.showDialog('Warnings',
         /** @type {string} */(content.html()), 'multi-line');
   });
+  $('#btn-skipped').click(function() {
+    var content = $('<pre></pre>')
+        .text(/** @type {string} */($('#skipped').text()));
+    historian.menu.showDialog('Skipped lines',
+        /** @type {string} */(content.html()), 'multi-line');
+  });
 };
 
 
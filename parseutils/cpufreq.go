@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+// cpufreq.go computes the time the CPU spent at each frequency from the checkin log.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// globalCPUFreqSection is the checkin section listing the frequencies of all CPU clusters, in kHz.
+	// e.g. "9,0,l,gcf,300000,576000,1497600"
+	globalCPUFreqSection = "gcf"
+	// cpuTimesAtFreqSection is the checkin section with the CPU time of an app at each frequency, in ms,
+	// followed by the screen off times. e.g. "9,10012,l,ctf,A,3,100,200,300,10,20,30"
+	cpuTimesAtFreqSection = "ctf"
+)
+
+// FreqResidency is the time the CPU spent at a frequency.
+type FreqResidency struct {
+	FreqKHz int64
+	TimeMs  int64
+}
+
+// CPUFreqResidency returns the total CPU time of all apps at each frequency listed in the checkin log,
+// sorted by frequency. The history doesn't record CPU frequencies, so this is the residency attributed to
+// apps, and doesn't include time the CPU was idle. Frequencies shared by several clusters are combined.
+// App lines that don't match the listed frequencies are skipped and reported as errors.
+func CPUFreqResidency(checkin string) ([]FreqResidency, []error) {
+	var freqs []int64
+	var times [][]string
+	var errs []error
+	for _, l := range strings.Split(checkin, "\n") {
+		parts := strings.Split(strings.TrimSpace(l), ",")
+		if len(parts) < 4 {
+			continue
+		}
+		switch parts[3] {
+		case globalCPUFreqSection:
+			freqs = freqs[:0]
+			for _, p := range parts[4:] {
+				f, err := strconv.ParseInt(p, 10, 64)
+				if err != nil {
+					return nil, []error{fmt.Errorf("invalid CPU frequency in checkin %q line: %v", globalCPUFreqSection, err)}
+				}
+				freqs = append(freqs, f)
+			}
+		case cpuTimesAtFreqSection:
+			times = append(times, parts)
+		}
+	}
+	if len(freqs) == 0 {
+		return nil, nil
+	}
+
+	totals := make(map[int64]int64)
+	for _, parts := range times {
+		if len(parts) < 6 || parts[4] != "A" {
+			continue
+		}
+		n, err := strconv.Atoi(parts[5])
+		if err != nil || n != len(freqs) || len(parts) < 6+n {
+			errs = append(errs, fmt.Errorf("checkin %q line for UID %s doesn't match the %d CPU frequencies", cpuTimesAtFreqSection, parts[1], len(freqs)))
+			continue
+		}
+		// Parse all the times first so a bad line doesn't partially count.
+		ms := make([]int64, n)
+		for i, p := range parts[6 : 6+n] {
+			if ms[i], err = strconv.ParseInt(p, 10, 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CPU time in checkin %q line for UID %s: %v", cpuTimesAtFreqSection, parts[1], err))
+			continue
+		}
+		for i, t := range ms {
+			totals[freqs[i]] += t
+		}
+	}
+
+	var res []FreqResidency
+	for f, t := range totals {
+		res = append(res, FreqResidency{FreqKHz: f, TimeMs: t})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].FreqKHz < res[j].FreqKHz })
+	return res, errs
+}
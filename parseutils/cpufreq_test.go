@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCPUFreqResidency tests summing the CPU time of apps at each frequency from the checkin log.
+func TestCPUFreqResidency(t *testing.T) {
+	input := strings.Join([]string{
+		`9,0,i,vers,17,150,NMF26V,NMF26V`,
+		`9,0,l,gcf,300000,1497600`,
+		`9,10012,l,ctf,A,2,1000,250,100,50`,
+		`9,10041,l,ctf,A,2,500,750,0,0`,
+		`9,10050,l,ctf,A,3,1,2,3,0,0,0`,
+		`9,10051,l,ctf,A,2,1,x,0,0`,
+	}, "\n")
+	want := []FreqResidency{
+		{FreqKHz: 300000, TimeMs: 1500},
+		{FreqKHz: 1497600, TimeMs: 1000},
+	}
+	got, errs := CPUFreqResidency(input)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CPUFreqResidency(%v) = %v, want %v", input, got, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("CPUFreqResidency(%v) errors = %v, want 2 errors", input, errs)
+	}
+}
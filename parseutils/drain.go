@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+// drain.go ranks apps by an estimate of how much battery they used.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+)
+
+// DrainWeights are the weights TopDrainApps uses to combine the activity of an app into a single score.
+type DrainWeights struct {
+	// ActivePerHour is the score for each hour the app had events in progress, such as held wakelocks.
+	ActivePerHour float64
+	// CPUPerHour is the score for each hour of CPU time used by the app.
+	CPUPerHour float64
+	// NetworkPerMB is the score for each megabyte of network traffic of the app.
+	NetworkPerMB float64
+}
+
+// DefaultDrainWeights are rough weights where an hour of CPU time costs several times more than
+// an hour of keeping the device awake, and 100MB of network traffic costs about as much as an hour awake.
+var DefaultDrainWeights = DrainWeights{
+	ActivePerHour: 1,
+	CPUPerHour:    4,
+	NetworkPerMB:  0.01,
+}
+
+// AppDrain is the estimated drain of an app, along with the factors contributing to it.
+type AppDrain struct {
+	Name  string
+	Score float64
+
+	// ActiveMs is the total time the app had events in progress, with overlapping events only counted once.
+	ActiveMs     int64
+	CPUMs        int64
+	NetworkBytes int64
+}
+
+// TopDrainApps ranks apps by their estimated drain score and returns the top n, or all apps if n is
+// not positive. The events, CPU time and network traffic are each keyed by app name, and an app only
+// needs to appear in one of them. Apps with the same score are ordered by name. The given events are not modified.
+func TopDrainApps(events map[string][]csv.Event, cpuMs, networkBytes map[string]int64, w DrainWeights, n int) []AppDrain {
+	apps := make(map[string]*AppDrain)
+	get := func(name string) *AppDrain {
+		a, ok := apps[name]
+		if !ok {
+			a = &AppDrain{Name: name}
+			apps[name] = a
+		}
+		return a
+	}
+	for name, es := range events {
+		a := get(name)
+		for _, e := range csv.MergeEvents(csv.CloneEvents(es)) {
+			a.ActiveMs += e.End - e.Start
+		}
+	}
+	for name, ms := range cpuMs {
+		get(name).CPUMs = ms
+	}
+	for name, b := range networkBytes {
+		get(name).NetworkBytes = b
+	}
+
+	hourMs := float64(time.Hour / time.Millisecond)
+	var res []AppDrain
+	for _, a := range apps {
+		a.Score = w.ActivePerHour*float64(a.ActiveMs)/hourMs +
+			w.CPUPerHour*float64(a.CPUMs)/hourMs +
+			w.NetworkPerMB*float64(a.NetworkBytes)/(1<<20)
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].Name < res[j].Name
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+)
+
+// TestTopDrainApps tests ranking a busy app above a mostly idle one.
+func TestTopDrainApps(t *testing.T) {
+	events := map[string][]csv.Event{
+		"com.google.android.gms": {
+			{Start: 0, End: 1800000},
+			{Start: 900000, End: 3600000},
+		},
+		"com.android.chrome": {
+			{Start: 0, End: 60000},
+		},
+	}
+	cpuMs := map[string]int64{
+		"com.google.android.gms": 1800000,
+		"com.android.chrome":     60000,
+	}
+	networkBytes := map[string]int64{
+		"com.google.android.gms": 100 << 20,
+		"com.android.vending":    1 << 20,
+	}
+	w := DrainWeights{ActivePerHour: 1, CPUPerHour: 2, NetworkPerMB: 0.01}
+
+	tests := []struct {
+		desc string
+		n    int
+		want []AppDrain
+	}{
+		{
+			desc: "All apps",
+			want: []AppDrain{
+				{Name: "com.google.android.gms", Score: 3, ActiveMs: 3600000, CPUMs: 1800000, NetworkBytes: 100 << 20},
+				{Name: "com.android.chrome", Score: 0.05, ActiveMs: 60000, CPUMs: 60000},
+				{Name: "com.android.vending", Score: 0.01, NetworkBytes: 1 << 20},
+			},
+		},
+		{
+			desc: "Top app",
+			n:    1,
+			want: []AppDrain{
+				{Name: "com.google.android.gms", Score: 3, ActiveMs: 3600000, CPUMs: 1800000, NetworkBytes: 100 << 20},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := TopDrainApps(events, cpuMs, networkBytes, w, test.n)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: TopDrainApps(%v, %v, %v, %v, %d) = %v, want %v", test.desc, events, cpuMs, networkBytes, w, test.n, got, test.want)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package parseutils
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -50,18 +51,38 @@ const (
 	tsStringDefault       = "default"
 	unknownScreenOnReason = "unknown screen on reason"
 
+	// NoStartClockTime is the AnalysisReport StartClockTimeMs if the history had no TIME event.
+	NoStartClockTime = -1
+
 	// Strings related to Ecn broadcasts.
 	ecnConnected    = `"CONNECTED"`
 	ecnDisconnected = `"DISCONNECTED"`
 	ecnSuspended    = `"SUSPENDED"`
 
 	// Battery history event names.
-	BatteryLevel  = "Battery Level"
-	Charging      = "Charging on"
-	Foreground    = "Foreground process"
-	LongWakelocks = "Long Wakelocks"
-	Plugged       = "Plugged"
-	Top           = "Top app"
+	Alarm               = "Alarm"
+	BatteryLevel        = "Battery Level"
+	BatterySaver        = "Battery Saver"
+	BLEScanning         = "BLE scanning"
+	Bluetooth           = "Bluetooth on"
+	Brightness          = "Brightness"
+	Camera              = "Camera"
+	CellularHighTxPower = "Cellular high TX power"
+	Charging            = "Charging on"
+	Flashlight          = "Flashlight on"
+	Foreground          = "Foreground process"
+	GPS                 = "GPS"
+	JobScheduler        = "JobScheduler"
+	LongWakelocks       = "Long Wakelocks"
+	MobileRadio         = "Mobile radio active"
+	NetworkConnectivity = "Network connectivity"
+	PhoneCall           = "Phone call"
+	PlugType            = "Plug"
+	Plugged             = "Plugged"
+	Temperature         = "Temperature"
+	Top                 = "Top app"
+	Voltage             = "Voltage"
+	WifiSupplicant      = "Wifi supplicant"
 )
 
 var (
@@ -756,6 +777,7 @@ type DeviceState struct {
 	WifiScan        tsBool
 	WifiMulticastOn tsBool
 	MobileRadioOn   tsBool
+	HighTxPower     tsBool
 	WifiOn          tsBool
 	WifiRadio       tsBool
 	WifiRunning     tsBool
@@ -813,7 +835,6 @@ type DeviceState struct {
 	   EventSy   ServiceUID
 	*/
 
-	// Not implemented yet
 	BluetoothOn tsBool
 }
 
@@ -842,6 +863,7 @@ func (state *DeviceState) initStartTimeForAllStates() {
 	state.WifiScan.initStart(state.CurrentTime)
 	state.WifiMulticastOn.initStart(state.CurrentTime)
 	state.MobileRadioOn.initStart(state.CurrentTime)
+	state.HighTxPower.initStart(state.CurrentTime)
 	state.WifiOn.initStart(state.CurrentTime)
 	state.WifiRadio.initStart(state.CurrentTime)
 	state.WifiRunning.initStart(state.CurrentTime)
@@ -953,6 +975,7 @@ type ActivitySummary struct {
 	PluggedInSummary     Dist
 	ScreenOnSummary      Dist
 	MobileRadioOnSummary Dist
+	HighTxPowerSummary   Dist
 	WifiOnSummary        Dist
 	CPURunningSummary    Dist
 
@@ -974,7 +997,8 @@ type ActivitySummary struct {
 	PhoneCallSummary Dist
 	PhoneScanSummary Dist
 
-	BLEScanSummary Dist
+	BLEScanSummary     Dist
+	BluetoothOnSummary Dist
 
 	// Stats for total syncs without breaking down by apps.
 	TotalSyncSummary Dist
@@ -1151,12 +1175,18 @@ func concludeActiveFromState(state *DeviceState, summary *ActivitySummary) (*Dev
 	// Mobile Radio: Pr **
 	state.MobileRadioOn.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.MobileRadioOnSummary)
 
+	// Cellular high TX power: Chtp **
+	state.HighTxPower.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.HighTxPowerSummary)
+
 	// Phone scanning: Psc **
 	state.PhoneScanning.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.PhoneScanSummary)
 
 	// BLE scanning: bles **
 	state.BLEScanning.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.BLEScanSummary)
 
+	// Bluetooth: b **
+	state.BluetoothOn.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.BluetoothOnSummary)
+
 	// Wifi: W **
 	state.WifiOn.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.WifiOnSummary)
 
@@ -1202,6 +1232,9 @@ func concludeActiveFromState(state *DeviceState, summary *ActivitySummary) (*Dev
 	// Charging: ch
 	state.ChargingOn.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.ChargingOnSummary)
 
+	// Battery Saver: lp, ps
+	state.LowPowerModeOn.updateSummary(state.CurrentTime, summary.Active, summary.StartTimeMs, &summary.LowPowerModeOnSummary)
+
 	//////////////// String States ////////////
 
 	// Phone state: Pst
@@ -1383,6 +1416,9 @@ func (s *ActivitySummary) Print(b io.Writer) {
 	fmt.Fprintf(b, "%30s", "RadioOn: ")
 	s.MobileRadioOnSummary.print(b, duration)
 
+	fmt.Fprintf(b, "%30s", "HighTxPower: ")
+	s.HighTxPowerSummary.print(b, duration)
+
 	fmt.Fprintf(b, "%30s", "PhoneCall")
 	s.PhoneCallSummary.print(b, duration)
 
@@ -1413,6 +1449,9 @@ func (s *ActivitySummary) Print(b io.Writer) {
 	fmt.Fprintf(b, "%30s", "BLEScan")
 	s.BLEScanSummary.print(b, duration)
 
+	fmt.Fprintf(b, "%30s", "BluetoothOn")
+	s.BluetoothOnSummary.print(b, duration)
+
 	fmt.Fprintf(b, "%30s", "SensorOn")
 	s.SensorOnSummary.print(b, duration)
 
@@ -1736,13 +1775,13 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		}
 		return state, summary, state.PlugType.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			summary.PlugTypeSummary, value, "Plug", csvState)
+			summary.PlugTypeSummary, value, PlugType, csvState)
 
 	case "Bt": // temperature
-		return state, summary, state.Temperature.assign(state.CurrentTime, value, summary.Active, "Temperature", csvState)
+		return state, summary, state.Temperature.assign(state.CurrentTime, value, summary.Active, Temperature, csvState)
 
 	case "Bv": // volt
-		return state, summary, state.Voltage.assign(state.CurrentTime, value, summary.Active, "Voltage", csvState)
+		return state, summary, state.Voltage.assign(state.CurrentTime, value, summary.Active, Voltage, csvState)
 
 	case "Bl": // level
 		i := state.BatteryLevel
@@ -1987,9 +2026,11 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		csvState.AddEntry("Partial wakelock", &state.WakeLockHolder, state.CurrentTime)
 
 	case "g": // gps
+		// The history only records whether the GPS provider is on for the device as a whole.
+		// Location requests per app (and for other providers) are not logged, so there is nothing to attribute here.
 		return state, summary, state.GpsOn.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.GpsOnSummary, tr, "GPS", csvState)
+			&summary.GpsOnSummary, tr, GPS, csvState)
 
 	case "s": // sensor
 		return state, summary, state.SensorOn.assign(state.CurrentTime,
@@ -2052,12 +2093,13 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		return state, summary, nil
 
 	case "Sb": // brightness
-		return state, summary, state.Brightness.assign(state.CurrentTime, value, summary.Active, "Brightness", csvState)
+		return state, summary, state.Brightness.assign(state.CurrentTime, value, summary.Active, Brightness, csvState)
 
 	case "Pcl": // phone_in_call
+		// The history only records whether a call is active, not whether it is ringing or off hook.
 		return state, summary, state.PhoneInCall.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.PhoneCallSummary, tr, "Phone call", csvState)
+			&summary.PhoneCallSummary, tr, PhoneCall, csvState)
 
 	case "Pcn": // data_conn
 		return state, summary, state.DataConnection.assign(state.CurrentTime,
@@ -2067,7 +2109,12 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 	case "Pr": // modile_radio
 		return state, summary, state.MobileRadioOn.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.MobileRadioOnSummary, tr, "Mobile radio active", csvState)
+			&summary.MobileRadioOnSummary, tr, MobileRadio, csvState)
+
+	case "Chtp": // cellular_high_tx_power
+		return state, summary, state.HighTxPower.assign(state.CurrentTime,
+			summary.Active, summary.StartTimeMs,
+			&summary.HighTxPowerSummary, tr, CellularHighTxPower, csvState)
 
 	case "Psc": // phone_scanning
 		return state, summary, state.PhoneScanning.assign(state.CurrentTime,
@@ -2103,7 +2150,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 	case "bles": // ble_scanning
 		return state, summary, state.BLEScanning.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.BLEScanSummary, tr, "BLE scanning", csvState)
+			&summary.BLEScanSummary, tr, BLEScanning, csvState)
 
 	case "Enl": // null
 		return state, summary, errors.New("sample: Null Event line = " + tr + key + value)
@@ -2201,7 +2248,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 	case "lp", "ps": // Low power mode was renamed to power save mode in M
 		return state, summary, state.LowPowerModeOn.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.LowPowerModeOnSummary, tr, "Battery Saver", csvState)
+			&summary.LowPowerModeOnSummary, tr, BatterySaver, csvState)
 
 	case "a": // audio
 		return state, summary, state.AudioOn.assign(state.CurrentTime,
@@ -2211,7 +2258,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 	case "ca": // camera
 		return state, summary, state.CameraOn.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.CameraOnSummary, tr, "Camera", csvState)
+			&summary.CameraOnSummary, tr, Camera, csvState)
 
 	case "v": // video
 		return state, summary, state.VideoOn.assign(state.CurrentTime,
@@ -2253,7 +2300,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 					Service: tmp,
 					UID:     suid.UID,
 				}
-				csvState.AddEntry("Network connectivity", su, state.CurrentTime)
+				csvState.AddEntry(NetworkConnectivity, su, state.CurrentTime)
 			}
 			suid.Start = state.CurrentTime
 			activeNtwks[ts] = &suid
@@ -2282,7 +2329,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 					Service: ts,
 					UID:     suid.UID,
 				}
-				csvState.AddEntry("Network connectivity", su, suid.Start)
+				csvState.AddEntry(NetworkConnectivity, su, suid.Start)
 			}
 
 			if summary.Active {
@@ -2323,7 +2370,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 					Service: tmp,
 					UID:     suid.UID,
 				}
-				csvState.AddEntry("Network connectivity", su, suid.Start)
+				csvState.AddEntry(NetworkConnectivity, su, suid.Start)
 			}
 			d := ntwkSummary[tmp]
 			if summary.Active {
@@ -2339,7 +2386,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 				Service: tmp,
 				UID:     suid.UID,
 			}
-			csvState.AddEntry("Network connectivity", su, state.CurrentTime)
+			csvState.AddEntry(NetworkConnectivity, su, state.CurrentTime)
 
 			suid.Start = state.CurrentTime
 			activeNtwks[ts] = &suid
@@ -2353,7 +2400,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 			Service: ts,
 			UID:     suid.UID,
 		}
-		csvState.AddEntry("Network connectivity", su, state.CurrentTime)
+		csvState.AddEntry(NetworkConnectivity, su, state.CurrentTime)
 
 	case "Ewl": // wakelock_in
 		serviceUID, ok := idxMap[value]
@@ -2419,7 +2466,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		}
 		return state, summary, serviceUID.assign(state.CurrentTime,
 			summary.Active, true, summary.StartTimeMs, state.ScheduledJobMap,
-			summary.ScheduledJobSummary, tr, value, "JobScheduler", csvState)
+			summary.ScheduledJobSummary, tr, value, JobScheduler, csvState)
 
 	case "Elw": // longwake: long-held wakelocks
 		serviceUID, ok := idxMap[value]
@@ -2455,7 +2502,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		}
 		return state, summary, state.WifiSuppl.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			summary.WifiSupplSummary, value, "Wifi supplicant", csvState)
+			summary.WifiSupplSummary, value, WifiSupplicant, csvState)
 
 	case "Wss": // WiFi Signal Strength
 		signalValue, ok := signalStrengthConstants[value]
@@ -2469,7 +2516,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 	case "fl": // flashlight
 		return state, summary, state.FlashlightOn.assign(state.CurrentTime,
 			summary.Active, summary.StartTimeMs,
-			&summary.FlashlightOnSummary, tr, "Flashlight on", csvState)
+			&summary.FlashlightOnSummary, tr, Flashlight, csvState)
 
 	case "ch": // charging
 		// The "ch" bit is whether the device currently considers itself to be charging, which may not
@@ -2512,7 +2559,7 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		if !ok {
 			return state, summary, fmt.Errorf("unable to find index %q in idxMap for Alarm going off (Eal)", value)
 		}
-		err := suid.assign(state.CurrentTime, summary.Active, true, summary.StartTimeMs, state.AlarmMap, summary.AlarmSummary, tr, value, "Alarm", csvState)
+		err := suid.assign(state.CurrentTime, summary.Active, true, summary.StartTimeMs, state.AlarmMap, summary.AlarmSummary, tr, value, Alarm, csvState)
 		return state, summary, err
 
 	case "Est": // stats
@@ -2530,9 +2577,10 @@ func updateState(b io.Writer, csvState *csv.State, state *DeviceState, summary *
 		}
 		return state, summary, nil
 
-	// Not yet implemented in the framework
 	case "b": // bluetooth
-		return state, summary, fmt.Errorf("sample: bluetooth line = %s%s%s", tr, key, value)
+		return state, summary, state.BluetoothOn.assign(state.CurrentTime,
+			summary.Active, summary.StartTimeMs,
+			&summary.BluetoothOnSummary, tr, Bluetooth, csvState)
 
 	case "Dcpu": // cpu_summary
 		// "9,h,0,Dcpu=112830:66390/1000:32930:19830/0:9850:23180/10019:21720:5570"
@@ -2970,6 +3018,9 @@ func analyzeHistoryLine(b io.Writer, csvState *csv.State, state *DeviceState, su
 	return state, summary, nil
 }
 
+// HistorySection is the name of the battery history section in parse diagnostics.
+const HistorySection = "batterystats history"
+
 // AnalysisReport contains fields that are created as a result of analyzing and parsing a history.
 type AnalysisReport struct {
 	ReportVersion     int32
@@ -2979,8 +3030,14 @@ type AnalysisReport struct {
 	IdxMap            map[string]ServiceUID
 	Errs              []error
 	OverflowMs        int64
+	// StartClockTimeMs is the wall clock time, as a unix ms timestamp, given by the first TIME event
+	// in the history. It is NoStartClockTime if the history had no TIME event.
+	StartClockTimeMs int64
 	// The keys are the unix timestamp in ms, and the values are the human readable time deltas.
 	TimeToDelta map[string]string
+	// Diagnostics identifies each history line that couldn't be analyzed, for the corresponding
+	// errors in Errs. The rest of the history is still analyzed.
+	Diagnostics []*historianutils.ParseError
 }
 
 // levelSummaryDimension has the name of a dimension, its attribute name corresponding to the attributes of AcitivitySummary,
@@ -3092,6 +3149,25 @@ func BatteryLevelSummariesToCSV(buf io.Writer, summaries *[]ActivitySummary, pri
 // It then analyzes the log line by line (delimited by newline characters).
 // No summaries (before an OVERFLOW line) are excluded/filtered out.
 func AnalyzeHistory(csvWriter io.Writer, history, format string, pum PackageUIDMapping, scrubPII bool) *AnalysisReport {
+	return analyzeHistory(context.Background(), csvWriter, history, format, pum, scrubPII, nil)
+}
+
+// AnalyzeHistoryContext is the same as AnalyzeHistory, but stops analyzing the history at the first
+// line after the context is done. The report then covers the history up to that line, and its Errs
+// include the context's error.
+func AnalyzeHistoryContext(ctx context.Context, csvWriter io.Writer, history, format string, pum PackageUIDMapping, scrubPII bool) *AnalysisReport {
+	return analyzeHistory(ctx, csvWriter, history, format, pum, scrubPII, nil)
+}
+
+// AnalyzeHistoryWithHook is the same as AnalyzeHistory, but if onEvent is not nil, it is also
+// called with each CSV event as it is emitted, including for the FormatBatteryLevel format where
+// the events aren't written to csvWriter. This allows consuming the events of large histories
+// without buffering the CSV.
+func AnalyzeHistoryWithHook(csvWriter io.Writer, history, format string, pum PackageUIDMapping, scrubPII bool, onEvent func(metric string, e csv.Event)) *AnalysisReport {
+	return analyzeHistory(context.Background(), csvWriter, history, format, pum, scrubPII, onEvent)
+}
+
+func analyzeHistory(ctx context.Context, csvWriter io.Writer, history, format string, pum PackageUIDMapping, scrubPII bool, onEvent func(metric string, e csv.Event)) *AnalysisReport {
 	// 8,hsp,0,10073,"com.google.android.volta"
 	// 8,hsp,28,0,"200:qcom,smd-rpm:203:fc4281d0.qcom,mpm:222:fc4cf000.qcom,spmi"
 
@@ -3100,6 +3176,7 @@ func AnalyzeHistory(csvWriter io.Writer, history, format string, pum PackageUIDM
 	if err != nil {
 		errs = append(errs, err)
 	}
+	var diags []*historianutils.ParseError
 
 	deviceState := newDeviceState()
 	summary := newActivitySummary(format)
@@ -3114,14 +3191,20 @@ func AnalyzeHistory(csvWriter io.Writer, history, format string, pum PackageUIDM
 	}
 
 	csvState := csv.NewState(writer, true)
+	csvState.OnEvent = onEvent
 	var b bytes.Buffer
 	var v int32
 	overflowIdx := -1
 	var overflowMs int64
+	startClockMs := int64(NoStartClockTime)
 
 	d := newDeltaMapping()
 
 	for i, line := range h {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("stopped analyzing history at line %d: %v", i, err))
+			break
+		}
 		if OverflowRE.MatchString(line) {
 			overflowIdx = i
 			// There can be multiple overflow events, but we only care about plotting the first one.
@@ -3137,9 +3220,21 @@ func AnalyzeHistory(csvWriter io.Writer, history, format string, pum PackageUIDM
 			}
 			v = int32(p)
 		} else {
+			if startClockMs == NoStartClockTime {
+				m, result := historianutils.SubexpNames(ResetRE, line)
+				if !m {
+					m, result = historianutils.SubexpNames(TimeRE, line)
+				}
+				if m {
+					if t, err := strconv.ParseInt(result["timeStamp"], 10, 64); err == nil {
+						startClockMs = t
+					}
+				}
+			}
 			deviceState, summary, err = analyzeHistoryLine(&b, csvState, deviceState, summary, &summaries, idxMap, pum, d, line, scrubPII)
 			if err != nil && len(line) > 0 {
 				errs = append(errs, err)
+				diags = append(diags, historianutils.NewParseError(HistorySection, i+1, line, err))
 			}
 		}
 	}
@@ -3192,7 +3287,9 @@ func AnalyzeHistory(csvWriter io.Writer, history, format string, pum PackageUIDM
 		IdxMap:            idxMap,
 		Errs:              errs,
 		OverflowMs:        overflowMs,
+		StartClockTimeMs:  startClockMs,
 		TimeToDelta:       d.timeToDelta,
+		Diagnostics:       diags,
 	}
 }
 
@@ -16,6 +16,7 @@ package parseutils
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -27,6 +28,7 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/chenjiacun35/battery-historian/historianutils"
 
 	usagepb "github.com/chenjiacun35/battery-historian/pb/usagestats_proto"
 )
@@ -871,6 +873,19 @@ func TestTwoServiceUIDNegativeEvents(t *testing.T) {
 	if !reflect.DeepEqual(want, result.Errs) {
 		t.Errorf("AnalyzeHistory(%s,...) = %v, want %v", input, result.Errs, want)
 	}
+	wantDiags := []*historianutils.ParseError{
+		{
+			Section: HistorySection,
+			// Lines are numbered within the history, including the string pool lines.
+			Line:  9,
+			Class: historianutils.ErrorClassMalformed,
+			Raw:   `9,h,4321,-Esy=0`,
+			Err:   want[0],
+		},
+	}
+	if !reflect.DeepEqual(result.Diagnostics, wantDiags) {
+		t.Errorf("AnalyzeHistory(%s,...) diagnostics = %v, want %v", input, result.Diagnostics, wantDiags)
+	}
 }
 
 // TestTwoBooleanNegativeEvents tests an error condition containing two negative transitions.
@@ -1713,6 +1728,34 @@ func TestEjbParsing(t *testing.T) {
 	}
 }
 
+// TestEjbCSV tests that concurrent jobs from different apps are output as separate csv entries.
+func TestEjbCSV(t *testing.T) {
+	input := strings.Join([]string{
+		`9,0,i,vers,11,116,LMY06B,LMY06B`,
+		`9,hsp,19,10008,"com.android.providers.downloads/.DownloadIdleService"`,
+		`9,hsp,21,1010054,"com.google.android.gms/.gcm.nts.TaskExecutionService"`,
+		`9,h,0:RESET:TIME:1422620451417`,
+		`9,h,1000,+Ejb=19`,
+		`9,h,500,+Ejb=21`,
+		`9,h,1500,-Ejb=19`,
+		`9,h,1000,-Ejb=21`,
+	}, "\n")
+
+	want := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		`JobScheduler,service,1422620452417,1422620454417,com.android.providers.downloads/.DownloadIdleService,10008`,
+		`JobScheduler,service,1422620452917,1422620455417,com.google.android.gms/.gcm.nts.TaskExecutionService,10054`,
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, want)
+	}
+}
+
 // TestElwParsing tests the parsing of longwake (Elw) entries in a history log.
 func TestElwParsing(t *testing.T) {
 	input := strings.Join([]string{
@@ -4087,6 +4130,403 @@ func TestFlashlightOnParse(t *testing.T) {
 	}
 }
 
+// TestFlashlightIndependentOfCamera tests that a long torch span is emitted separately to camera use.
+func TestFlashlightIndependentOfCamera(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+fl`,
+		`9,h,2000,+ca`,
+		`9,h,3000,-ca`,
+		`9,h,600000,-fl`,
+		`9,h,1000,+ca`,
+		`9,h,2000,-ca`,
+	}, "\n")
+	wantFlashlight := Dist{
+		Num:           1,
+		TotalDuration: 605000 * time.Millisecond,
+		MaxDuration:   605000 * time.Millisecond,
+	}
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"Camera,bool,1432964303000,1432964306000,true,",
+		"Flashlight on,bool,1432964301000,1432964906000,true,",
+		"Camera,bool,1432964907000,1432964909000,true,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if s := result.Summaries[0]; !reflect.DeepEqual(s.FlashlightOnSummary, wantFlashlight) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].FlashlightOnSummary = %v, want %v", input, s.FlashlightOnSummary, wantFlashlight)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
+// TestWifiSupplicantParse tests that each Wifi supplicant state change closes the previous state's span.
+func TestWifiSupplicantParse(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,Wsp=scan`,
+		`9,h,2000,Wsp=ascing`,
+		`9,h,500,Wsp=compl`,
+		`9,h,3000,Bl=50`,
+	}, "\n")
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"Wifi supplicant,string,1432964301000,1432964303000,scan,",
+		"Wifi supplicant,string,1432964303000,1432964303500,ascing,",
+		"Battery Level,int,1432964306500,1432964306500,50,",
+		"Wifi supplicant,string,1432964303500,1432964306500,compl,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if s := result.Summaries[0]; s.WifiSupplSummary["compl"].Num != 1 {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].WifiSupplSummary[compl].Num = %d, want 1", input, s.WifiSupplSummary["compl"].Num)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
+// TestPlugTypeParse tests that each plug type change closes the previous plug type's span.
+func TestPlugTypeParse(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,Bp=u`,
+		`9,h,2000,Bp=a`,
+		`9,h,3000,Bp=u`,
+		`9,h,1000,Bp=n`,
+		`9,h,1000,Bl=50`,
+	}, "\n")
+	wantUSB := Dist{
+		Num:           2,
+		TotalDuration: 3000 * time.Millisecond,
+		MaxDuration:   2000 * time.Millisecond,
+	}
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"Plug,string,1432964301000,1432964303000,u,",
+		"Plug,string,1432964303000,1432964306000,a,",
+		"Plug,string,1432964306000,1432964307000,u,",
+		"Battery Level,int,1432964308000,1432964308000,50,",
+		"Plug,string,1432964307000,1432964308000,n,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if s := result.Summaries[0]; !reflect.DeepEqual(s.PlugTypeSummary["u"], wantUSB) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].PlugTypeSummary[u] = %v, want %v", input, s.PlugTypeSummary["u"], wantUSB)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
+// TestAnalyzeHistoryWithHook tests that the hook is called with each event written to the CSV.
+func TestAnalyzeHistoryWithHook(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+fl`,
+		`9,h,2000,+ca`,
+		`9,h,3000,-ca`,
+		`9,h,1000,Bl=50`,
+		`9,h,1000,-fl`,
+	}, "\n")
+	wantCounts := map[string]int{
+		Camera:       1,
+		Flashlight:   1,
+		BatteryLevel: 1,
+	}
+
+	var b bytes.Buffer
+	counts := make(map[string]int)
+	var events []string
+	result := AnalyzeHistoryWithHook(&b, input, FormatTotalTime, emptyUIDPackageMapping, true, func(metric string, e csv.Event) {
+		counts[metric]++
+		events = append(events, fmt.Sprintf("%s,%s,%d,%d,%s,%s", metric, e.Type, e.Start, e.End, e.Value, e.Opt))
+	})
+	validateHistory(input, t, result, 0, 1)
+
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("AnalyzeHistoryWithHook(%v) event counts = %v, want %v", input, counts, wantCounts)
+	}
+	want := normalizeCSV(b.String())
+	if got := normalizeCSV(strings.Join(append([]string{csv.FileHeader}, events...), "\n")); !reflect.DeepEqual(got, want) {
+		t.Errorf("AnalyzeHistoryWithHook(%v) hook events = %q, want the outputted csv %q", input, got, want)
+	}
+}
+
+// TestAnalyzeHistoryContext tests that analysing the history stops once the context is cancelled.
+func TestAnalyzeHistoryContext(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+fl`,
+		`9,h,1000,-fl`,
+	}, "\n")
+
+	var b bytes.Buffer
+	result := AnalyzeHistoryContext(context.Background(), &b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+	if !strings.Contains(b.String(), Flashlight) {
+		t.Errorf("AnalyzeHistoryContext(%v) = %q, want %s events", input, b.String(), Flashlight)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Reset()
+	result = AnalyzeHistoryContext(ctx, &b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	if len(result.Errs) != 1 || !strings.Contains(result.Errs[0].Error(), context.Canceled.Error()) {
+		t.Errorf("AnalyzeHistoryContext(%v) with cancelled context errors = %v, want the context error", input, result.Errs)
+	}
+	if strings.Contains(b.String(), Flashlight) {
+		t.Errorf("AnalyzeHistoryContext(%v) with cancelled context = %q, want no %s events", input, b.String(), Flashlight)
+	}
+}
+
+// TestBatterySaverParse tests the parsing of battery saver (lp/ps) events in a history log.
+func TestBatterySaverParse(t *testing.T) {
+	tests := []struct {
+		desc        string
+		input       string
+		wantSummary Dist
+		wantCSV     string
+	}{
+		{
+			"Battery saver toggled on then off",
+			strings.Join([]string{
+				`9,h,0:RESET:TIME:1432964300000`,
+				`9,h,1000,+ps`,
+				`9,h,3000,-ps`,
+				`9,h,2000,Bl=50`,
+			}, "\n"),
+			Dist{
+				Num:           1,
+				TotalDuration: 3000 * time.Millisecond,
+				MaxDuration:   3000 * time.Millisecond,
+			},
+			strings.Join([]string{
+				csv.FileHeader,
+				"Battery Saver,bool,1432964301000,1432964304000,true,",
+				"Battery Level,int,1432964306000,1432964306000,50,",
+			}, "\n"),
+		},
+		{
+			"Pre-M low power mode token",
+			strings.Join([]string{
+				`9,h,0:RESET:TIME:1432964300000`,
+				`9,h,1000,+lp`,
+				`9,h,500,-lp`,
+			}, "\n"),
+			Dist{
+				Num:           1,
+				TotalDuration: 500 * time.Millisecond,
+				MaxDuration:   500 * time.Millisecond,
+			},
+			strings.Join([]string{
+				csv.FileHeader,
+				"Battery Saver,bool,1432964301000,1432964301500,true,",
+			}, "\n"),
+		},
+		{
+			"Battery saver still on at end of report",
+			strings.Join([]string{
+				`9,h,0:RESET:TIME:1432964300000`,
+				`9,h,1000,+ps`,
+				`9,h,4000,Bl=50`,
+			}, "\n"),
+			Dist{
+				Num:           1,
+				TotalDuration: 4000 * time.Millisecond,
+				MaxDuration:   4000 * time.Millisecond,
+			},
+			strings.Join([]string{
+				csv.FileHeader,
+				"Battery Saver,bool,1432964301000,1432964305000,true,",
+				"Battery Level,int,1432964305000,1432964305000,50,",
+			}, "\n"),
+		},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		result := AnalyzeHistory(&b, test.input, FormatTotalTime, emptyUIDPackageMapping, true)
+		validateHistory(test.input, t, result, 0, 1)
+
+		s := result.Summaries[0]
+		if !reflect.DeepEqual(s.LowPowerModeOnSummary, test.wantSummary) {
+			t.Errorf("%v: AnalyzeHistory(%s,...).Summaries[0].LowPowerModeOnSummary = %v, want %v", test.desc, test.input, s.LowPowerModeOnSummary, test.wantSummary)
+		}
+
+		got := normalizeCSV(b.String())
+		want := normalizeCSV(test.wantCSV)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: AnalyzeHistory(%v) outputted csv = %q, want: %q", test.desc, test.input, got, want)
+		}
+	}
+}
+
+// TestGpsParse tests the parsing of gps (g) events in a history log.
+func TestGpsParse(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+g`,
+		`9,h,2000,-g`,
+		`9,h,1000,+g`,
+		`9,h,500,Bl=50`,
+	}, "\n")
+	wantSummary := Dist{
+		Num:           2,
+		TotalDuration: 2500 * time.Millisecond,
+		MaxDuration:   2000 * time.Millisecond,
+	}
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"GPS,bool,1432964301000,1432964303000,true,",
+		"GPS,bool,1432964304000,1432964304500,true,",
+		"Battery Level,int,1432964304500,1432964304500,50,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if s := result.Summaries[0]; !reflect.DeepEqual(s.GpsOnSummary, wantSummary) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].GpsOnSummary = %v, want %v", input, s.GpsOnSummary, wantSummary)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
+// TestStartClockTime tests reading the wall clock start time of a history.
+func TestStartClockTime(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []string
+		want  int64
+	}{
+		{
+			desc: "Reset time",
+			input: []string{
+				`9,h,0:RESET:TIME:1432964300000`,
+				`9,h,1000,+Pcl`,
+				`9,h,1000,-Pcl`,
+				`9,h,60000:TIME:1432964362000`,
+				`9,h,1000,+Pcl`,
+			},
+			want: 1432964300000,
+		},
+		{
+			desc: "Time after start",
+			input: []string{
+				`9,h,0:START`,
+				`9,h,0:TIME:1432964300500`,
+				`9,h,1000,+Pcl`,
+			},
+			want: 1432964300500,
+		},
+		{
+			desc: "No time",
+			input: []string{
+				`9,h,1000,+Pcl`,
+				`9,h,1000,-Pcl`,
+			},
+			want: NoStartClockTime,
+		},
+	}
+	for _, test := range tests {
+		input := strings.Join(test.input, "\n")
+		result := AnalyzeHistory(ioutil.Discard, input, FormatTotalTime, emptyUIDPackageMapping, true)
+		if result.StartClockTimeMs != test.want {
+			t.Errorf("%v: AnalyzeHistory(%v).StartClockTimeMs = %d, want %d", test.desc, input, result.StartClockTimeMs, test.want)
+		}
+	}
+}
+
+// TestPhoneCallParse tests the parsing of phone_in_call (Pcl) events in a history log.
+func TestPhoneCallParse(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+Pcl`,
+		`9,h,60000,-Pcl`,
+		`9,h,5000,+Pcl`,
+		`9,h,2000,Bl=50`,
+	}, "\n")
+	wantSummary := Dist{
+		Num:           2,
+		TotalDuration: 62000 * time.Millisecond,
+		MaxDuration:   60000 * time.Millisecond,
+	}
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"Phone call,bool,1432964301000,1432964361000,true,",
+		"Phone call,bool,1432964366000,1432964368000,true,",
+		"Battery Level,int,1432964368000,1432964368000,50,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	if s := result.Summaries[0]; !reflect.DeepEqual(s.PhoneCallSummary, wantSummary) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].PhoneCallSummary = %v, want %v", input, s.PhoneCallSummary, wantSummary)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
+// TestBluetoothParse tests the parsing of 'b' and 'bles' events in a history log.
+func TestBluetoothParse(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+b`,
+		`9,h,2000,+bles`,
+		`9,h,3000,-bles`,
+		`9,h,4000,-b`,
+		`9,h,2000,Bl=50`,
+	}, "\n")
+	wantBluetooth := Dist{
+		Num:           1,
+		TotalDuration: 9000 * time.Millisecond,
+		MaxDuration:   9000 * time.Millisecond,
+	}
+	wantBLEScan := Dist{
+		Num:           1,
+		TotalDuration: 3000 * time.Millisecond,
+		MaxDuration:   3000 * time.Millisecond,
+	}
+	wantCSV := normalizeCSV(strings.Join([]string{
+		csv.FileHeader,
+		"BLE scanning,bool,1432964303000,1432964306000,true,",
+		"Bluetooth on,bool,1432964301000,1432964310000,true,",
+		"Battery Level,int,1432964312000,1432964312000,50,",
+	}, "\n"))
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	s := result.Summaries[0]
+	if !reflect.DeepEqual(s.BluetoothOnSummary, wantBluetooth) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].BluetoothOnSummary = %v, want %v", input, s.BluetoothOnSummary, wantBluetooth)
+	}
+	if !reflect.DeepEqual(s.BLEScanSummary, wantBLEScan) {
+		t.Errorf("AnalyzeHistory(%s,...).Summaries[0].BLEScanSummary = %v, want %v", input, s.BLEScanSummary, wantBLEScan)
+	}
+	if got := normalizeCSV(b.String()); !reflect.DeepEqual(got, wantCSV) {
+		t.Errorf("AnalyzeHistory(%v) outputted csv = %q, want: %q", input, got, wantCSV)
+	}
+}
+
 // TestCameraEventParsing tests the parsing of 'ca' events in a history log.
 func TestCameraEventParsing(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,271 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+// series.go extracts numeric series from the CSV generated by AnalyzeHistory.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/chenjiacun35/battery-historian/packageutils"
+)
+
+// Reading is a single numeric sample from the battery history.
+type Reading struct {
+	TimeMs int64
+	Value  int64
+}
+
+// Temperatures returns the battery temperature readings, in tenths of a degree Celsius,
+// from the CSV generated by AnalyzeHistory. Readings are ordered by time.
+func Temperatures(csvInput string) ([]Reading, []error) {
+	return intSeries(csvInput, Temperature)
+}
+
+// Voltages returns the battery voltage readings, in mV, from the CSV generated by AnalyzeHistory.
+// Readings are ordered by time.
+func Voltages(csvInput string) ([]Reading, []error) {
+	return intSeries(csvInput, Voltage)
+}
+
+// brightnessLevels are the names of the screen brightness bins, indexed by the history brightness value.
+var brightnessLevels = []string{"dark", "dim", "medium", "light", "bright"}
+
+// BrightnessLevels returns the screen brightness spans from the CSV generated by AnalyzeHistory,
+// with the Value of each span replaced by the brightness level name (e.g. "dim"). Spans are ordered by time.
+func BrightnessLevels(csvInput string) ([]csv.Event, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{Brightness})
+	var res []csv.Event
+	for _, e := range events[Brightness] {
+		v, err := strconv.Atoi(e.Value)
+		if err != nil || v < 0 || v >= len(brightnessLevels) {
+			errs = append(errs, fmt.Errorf("invalid %s value %q", Brightness, e.Value))
+			continue
+		}
+		e.Value = brightnessLevels[v]
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start < res[j].Start
+	})
+	return res, errs
+}
+
+// ConnectivityTypes returns spans of the type of data connection the device had, derived from the
+// network connectivity events in the CSV generated by AnalyzeHistory. The Value of each span is
+// "wifi", "mobile" or "none", with wifi taking precedence when both are connected. Other network
+// types, such as VPNs, are ignored. Spans cover the time from the first to the last connectivity change.
+func ConnectivityTypes(csvInput string) ([]csv.Event, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{NetworkConnectivity})
+	var bounds []int64
+	for _, e := range events[NetworkConnectivity] {
+		bounds = append(bounds, e.Start, e.End)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var res []csv.Event
+	for i := 1; i < len(bounds); i++ {
+		start, end := bounds[i-1], bounds[i]
+		if start == end {
+			continue
+		}
+		t := "none"
+		for _, e := range events[NetworkConnectivity] {
+			if e.Start > start || e.End < end || !strings.HasSuffix(e.Value, `:`+ecnConnected) {
+				continue
+			}
+			if strings.HasPrefix(e.Value, `TYPE_WIFI:`) {
+				t = "wifi"
+				break
+			}
+			if strings.HasPrefix(e.Value, `TYPE_MOBILE`) {
+				t = "mobile"
+			}
+		}
+		if n := len(res); n > 0 && res[n-1].Value == t {
+			res[n-1].End = end
+			continue
+		}
+		res = append(res, csv.Event{Type: "string", Start: start, End: end, Value: t})
+	}
+	return res, errs
+}
+
+// BluetoothSpans returns the bluetooth activity spans from the CSV generated by AnalyzeHistory, with
+// the Value of each span set to "on" while bluetooth was enabled, and "le-scan" while a BLE scan was
+// running. The history does not record which apps requested BLE scans or bluetooth connections, so
+// Opt is left empty and overlapping scans appear as a single span. Spans are ordered by time.
+func BluetoothSpans(csvInput string) ([]csv.Event, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{Bluetooth, BLEScanning})
+	var res []csv.Event
+	for _, e := range events[Bluetooth] {
+		e.Value = "on"
+		res = append(res, e)
+	}
+	for _, e := range events[BLEScanning] {
+		e.Value = "le-scan"
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start < res[j].Start
+	})
+	return res, errs
+}
+
+// RadioPowerStates returns spans of the power state of the mobile radio, derived from the mobile radio
+// active and cellular high TX power events in the CSV generated by AnalyzeHistory. The Value of each
+// span is "high-tx" while transmitting at high power, "active" while the radio is otherwise active,
+// and "idle" when it isn't. The history doesn't distinguish receiving from transmitting at lower
+// power, so both are "active". Spans cover the time from the first to the last state change.
+func RadioPowerStates(csvInput string) ([]csv.Event, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{MobileRadio, CellularHighTxPower})
+	var bounds []int64
+	for _, m := range []string{MobileRadio, CellularHighTxPower} {
+		for _, e := range events[m] {
+			bounds = append(bounds, e.Start, e.End)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	covers := func(metric string, start, end int64) bool {
+		for _, e := range events[metric] {
+			if e.Start <= start && e.End >= end {
+				return true
+			}
+		}
+		return false
+	}
+	var res []csv.Event
+	for i := 1; i < len(bounds); i++ {
+		start, end := bounds[i-1], bounds[i]
+		if start == end {
+			continue
+		}
+		v := "idle"
+		switch {
+		case covers(CellularHighTxPower, start, end):
+			v = "high-tx"
+		case covers(MobileRadio, start, end):
+			v = "active"
+		}
+		if n := len(res); n > 0 && res[n-1].Value == v {
+			res[n-1].End = end
+			continue
+		}
+		res = append(res, csv.Event{Type: "string", Start: start, End: end, Value: v})
+	}
+	return res, errs
+}
+
+// AlarmsByApp returns the alarms that went off in the CSV generated by AnalyzeHistory, along with the
+// number of alarms for each package. The Opt of each returned alarm is set to the package that owns
+// the alarm's UID, or left as the UID if there is no matching package. Alarms are ordered by time.
+func AlarmsByApp(csvInput string, pum PackageUIDMapping) ([]csv.Event, map[string]int, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{Alarm})
+	var alarms []csv.Event
+	counts := make(map[string]int)
+	for _, e := range events[Alarm] {
+		uid, err := strconv.ParseInt(e.Opt, 10, 32)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s UID %q: %v", Alarm, e.Opt, err))
+			continue
+		}
+		pkg, ok := pum.uidToPackage[int32(uid)]
+		if !ok {
+			pkg, ok = pum.uidToPackage[packageutils.AppID(int32(uid))]
+		}
+		if ok {
+			e.Opt = pkg
+		}
+		counts[e.Opt]++
+		alarms = append(alarms, e)
+	}
+	sort.SliceStable(alarms, func(i, j int) bool {
+		return alarms[i].Start < alarms[j].Start
+	})
+	return alarms, counts, errs
+}
+
+// ChargeRate is the estimated average charge current during a charging span.
+type ChargeRate struct {
+	StartMs, EndMs int64
+	// LevelDelta is the change in battery level, in percent, over the span.
+	LevelDelta int64
+	MA         float64
+}
+
+// ChargeRates estimates the average charge current of each charging span in the CSV generated by
+// AnalyzeHistory, from the battery level changes during the span and the battery capacity in mAh.
+// The rate is measured between the first and last level changes within the span, which are the
+// StartMs and EndMs of the returned rate. Spans with fewer than two level changes are skipped.
+func ChargeRates(csvInput string, capacityMah float64) ([]ChargeRate, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{Charging})
+	levels, lErrs := intSeries(csvInput, BatteryLevel)
+	errs = append(errs, lErrs...)
+
+	spans := events[Charging]
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	var res []ChargeRate
+	for _, e := range spans {
+		var first, last *Reading
+		for i := range levels {
+			r := &levels[i]
+			if r.TimeMs < e.Start || r.TimeMs > e.End {
+				continue
+			}
+			if first == nil {
+				first = r
+			}
+			last = r
+		}
+		if first == nil || last.TimeMs == first.TimeMs {
+			continue
+		}
+		delta := last.Value - first.Value
+		hours := float64(last.TimeMs-first.TimeMs) / float64(time.Hour/time.Millisecond)
+		res = append(res, ChargeRate{
+			StartMs:    first.TimeMs,
+			EndMs:      last.TimeMs,
+			LevelDelta: delta,
+			MA:         float64(delta) / 100 * capacityMah / hours,
+		})
+	}
+	return res, errs
+}
+
+// intSeries returns the value and start time of each event for the given int metric, ordered by time.
+func intSeries(csvInput, metric string) ([]Reading, []error) {
+	events, errs := csv.ExtractEvents(csvInput, []string{metric})
+	var readings []Reading
+	for _, e := range events[metric] {
+		v, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s value %q: %v", metric, e.Value, err))
+			continue
+		}
+		readings = append(readings, Reading{TimeMs: e.Start, Value: v})
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].TimeMs < readings[j].TimeMs
+	})
+	return readings, errs
+}
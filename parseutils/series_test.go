@@ -0,0 +1,283 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parseutils
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chenjiacun35/battery-historian/csv"
+	"github.com/golang/protobuf/proto"
+
+	usagepb "github.com/chenjiacun35/battery-historian/pb/usagestats_proto"
+)
+
+// TestTemperatures tests extracting temperature readings from a history.
+func TestTemperatures(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,Bt=236`,
+		`9,h,2000,Bl=50,Bt=241`,
+		`9,h,3000,Bt=239`,
+	}, "\n")
+	want := []Reading{
+		{TimeMs: 1432964301000, Value: 236},
+		{TimeMs: 1432964303000, Value: 241},
+		{TimeMs: 1432964306000, Value: 239},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := Temperatures(b.String())
+	if len(errs) > 0 {
+		t.Errorf("Temperatures(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Temperatures(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestVoltages tests extracting the battery voltage readings from a history.
+func TestVoltages(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,Bv=4173`,
+		`9,h,2000,Bl=50,Bv=4012`,
+	}, "\n")
+	want := []Reading{
+		{TimeMs: 1432964301000, Value: 4173},
+		{TimeMs: 1432964303000, Value: 4012},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := Voltages(b.String())
+	if len(errs) > 0 {
+		t.Errorf("Voltages(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Voltages(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestBrightnessLevels tests extracting named screen brightness spans from a history.
+func TestBrightnessLevels(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,Sb=1`,
+		`9,h,2000,Sb=3`,
+		`9,h,3000,Bl=50`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "int", Start: 1432964301000, End: 1432964303000, Value: "dim"},
+		{Type: "int", Start: 1432964303000, End: 1432964306000, Value: "light"},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := BrightnessLevels(b.String())
+	if len(errs) > 0 {
+		t.Errorf("BrightnessLevels(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BrightnessLevels(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestConnectivityTypes tests deriving the connection type from the network connectivity events.
+func TestConnectivityTypes(t *testing.T) {
+	input := strings.Join([]string{
+		`9,0,i,vers,11,116,LMY06B,LMY06B`,
+		`9,hsp,3,1,"CONNECTED"`,
+		`9,hsp,28,1,"DISCONNECTED"`,
+		`9,hsp,30,0,"CONNECTED"`,
+		`9,hsp,46,0,"DISCONNECTED"`,
+		`9,h,0:RESET:TIME:1422620451417`,
+		`9,h,1000,Ecn=3`,  // wifi connected
+		`9,h,1000,Ecn=30`, // mobile connected
+		`9,h,1000,Ecn=28`, // wifi disconnected
+		`9,h,1000,Ecn=46`, // mobile disconnected
+		`9,h,2000,Ecn=3`,
+		`9,h,1000,Ecn=28`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "string", Start: 1422620452417, End: 1422620454417, Value: "wifi"},
+		{Type: "string", Start: 1422620454417, End: 1422620455417, Value: "mobile"},
+		{Type: "string", Start: 1422620455417, End: 1422620457417, Value: "none"},
+		{Type: "string", Start: 1422620457417, End: 1422620458417, Value: "wifi"},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := ConnectivityTypes(b.String())
+	if len(errs) > 0 {
+		t.Errorf("ConnectivityTypes(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ConnectivityTypes(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestBluetoothSpans tests extracting bluetooth spans when a BLE scan overlaps bluetooth being on.
+func TestBluetoothSpans(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+b`,
+		`9,h,2000,+bles`,
+		`9,h,3000,-bles`,
+		`9,h,4000,-b`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "bool", Start: 1432964301000, End: 1432964310000, Value: "on"},
+		{Type: "bool", Start: 1432964303000, End: 1432964306000, Value: "le-scan"},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := BluetoothSpans(b.String())
+	if len(errs) > 0 {
+		t.Errorf("BluetoothSpans(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BluetoothSpans(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestChargeRates tests estimating the charge current from battery level changes while charging.
+func TestChargeRates(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,0,Bl=40`,
+		`9,h,1000,+ch`,
+		`9,h,1000,Bl=50`,
+		`9,h,900000,Bl=55`,
+		`9,h,900000,Bl=60`,
+		`9,h,1000,-ch`,
+		`9,h,60000,Bl=59`,
+		`9,h,1000,+ch`,
+		`9,h,1000,Bl=60`,
+		`9,h,1000,-ch`,
+	}, "\n")
+	want := []ChargeRate{
+		{StartMs: 1432964302000, EndMs: 1432966102000, LevelDelta: 10, MA: 600},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := ChargeRates(b.String(), 3000)
+	if len(errs) > 0 {
+		t.Errorf("ChargeRates(%v, 3000) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ChargeRates(%v, 3000) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestRadioPowerStates tests deriving the mobile radio power state spans.
+func TestRadioPowerStates(t *testing.T) {
+	input := strings.Join([]string{
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+Pr`,
+		`9,h,1000,+Chtp`,
+		`9,h,1000,-Chtp`,
+		`9,h,1000,-Pr`,
+		`9,h,2000,+Pr`,
+		`9,h,1000,-Pr`,
+	}, "\n")
+	want := []csv.Event{
+		{Type: "string", Start: 1432964301000, End: 1432964302000, Value: "active"},
+		{Type: "string", Start: 1432964302000, End: 1432964303000, Value: "high-tx"},
+		{Type: "string", Start: 1432964303000, End: 1432964304000, Value: "active"},
+		{Type: "string", Start: 1432964304000, End: 1432964306000, Value: "idle"},
+		{Type: "string", Start: 1432964306000, End: 1432964307000, Value: "active"},
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	got, errs := RadioPowerStates(b.String())
+	if len(errs) > 0 {
+		t.Errorf("RadioPowerStates(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RadioPowerStates(%v) = %v, want %v", b.String(), got, want)
+	}
+}
+
+// TestAlarmsByApp tests attributing alarms to the packages that own them.
+func TestAlarmsByApp(t *testing.T) {
+	input := strings.Join([]string{
+		`9,hsp,35,10116,"*walarm*:flipboard.app.REFRESH"`,
+		`9,hsp,40,10105,"*walarm*:com.whatsapp.MessageService"`,
+		`9,hsp,41,10999,"*walarm*:unknown.alarm"`,
+		`9,h,0:RESET:TIME:1432964300000`,
+		`9,h,1000,+Eal=40`,
+		`9,h,10,-Eal=40`,
+		`9,h,1000,+Eal=35`,
+		`9,h,10,-Eal=35`,
+		`9,h,1000,+Eal=40`,
+		`9,h,10,-Eal=40`,
+		`9,h,1000,+Eal=41`,
+		`9,h,10,-Eal=41`,
+	}, "\n")
+	pum, errs := UIDAndPackageNameMapping("", []*usagepb.PackageInfo{
+		{PkgName: proto.String("flipboard.app"), Uid: proto.Int32(10116)},
+		{PkgName: proto.String("com.whatsapp"), Uid: proto.Int32(10105)},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("UIDAndPackageNameMapping() unexpected errors: %v", errs)
+	}
+	wantAlarms := []csv.Event{
+		{Type: "service", Start: 1432964301000, End: 1432964301010, Value: "*walarm*:com.whatsapp.MessageService", Opt: "com.whatsapp"},
+		{Type: "service", Start: 1432964302010, End: 1432964302020, Value: "*walarm*:flipboard.app.REFRESH", Opt: "flipboard.app"},
+		{Type: "service", Start: 1432964303020, End: 1432964303030, Value: "*walarm*:com.whatsapp.MessageService", Opt: "com.whatsapp"},
+		{Type: "service", Start: 1432964304030, End: 1432964304040, Value: "*walarm*:unknown.alarm", Opt: "10999"},
+	}
+	wantCounts := map[string]int{
+		"com.whatsapp":  2,
+		"flipboard.app": 1,
+		"10999":         1,
+	}
+
+	var b bytes.Buffer
+	result := AnalyzeHistory(&b, input, FormatTotalTime, emptyUIDPackageMapping, true)
+	validateHistory(input, t, result, 0, 1)
+
+	alarms, counts, errs := AlarmsByApp(b.String(), pum)
+	if len(errs) > 0 {
+		t.Errorf("AlarmsByApp(%v) unexpected errors: %v", b.String(), errs)
+	}
+	if !reflect.DeepEqual(alarms, wantAlarms) {
+		t.Errorf("AlarmsByApp(%v) alarms = %v, want %v", b.String(), alarms, wantAlarms)
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("AlarmsByApp(%v) counts = %v, want %v", b.String(), counts, wantCounts)
+	}
+}
@@ -223,7 +223,7 @@ func output(state *csv.State, curMs int64, r reading) {
 		Desc:  currentEvent,
 		Start: curMs,
 		Type:  "float",
-		Value: strconv.FormatFloat(r.mA, 'f', 3, 64),
+		Value: historianutils.FormatFloat(r.mA, 3),
 	})
 	if r.volts != nil {
 		state.EndEvent(powerEvent, "", curMs)
@@ -231,7 +231,7 @@ func output(state *csv.State, curMs int64, r reading) {
 			Desc:  powerEvent,
 			Start: curMs,
 			Type:  "float",
-			Value: strconv.FormatFloat(r.mA*(*r.volts), 'f', 3, 64),
+			Value: historianutils.FormatFloat(r.mA*(*r.volts), 3),
 		})
 	}
 }
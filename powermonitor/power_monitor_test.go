@@ -51,7 +51,7 @@ func TestParse(t *testing.T) {
 			}, "\n"),
 			wantCSV: strings.Join([]string{
 				csv.FileHeader,
-				`Power Monitor (mA),float,1433786060000,1433786061000,4000.000,`,
+				`Power Monitor (mA),float,1433786060000,1433786061000,4000,`,
 			}, "\n"),
 			matched: true,
 		},
@@ -114,8 +114,8 @@ func TestParse(t *testing.T) {
 			wantCSV: strings.Join([]string{
 				csv.FileHeader,
 				`Power Monitor (mA),float,1433786060000,1433786060500,3.802,`,
-				`Power Monitor (mA),float,1433786060500,1433786061000,3.810,`,
-				`Power Monitor (mA),float,1433786061000,1433786061500,3.810,`,
+				`Power Monitor (mA),float,1433786060500,1433786061000,3.81,`,
+				`Power Monitor (mA),float,1433786061000,1433786061500,3.81,`,
 				`Power Monitor (mA),float,1433786061500,1433786062000,4.686,`,
 				`Power Monitor (mA),float,1433786062000,1433786063000,4.479,`,
 			}, "\n"),
@@ -157,7 +157,7 @@ func TestParse(t *testing.T) {
 				`Power Monitor (mA),float,1433786061500,1433786062000,3.791,`,
 				`Power Monitor (mA),float,1433786062000,1433786062333,17.514,`,
 				`Power Monitor (mA),float,1433786062333,1433786062666,5.186,`,
-				`Power Monitor (mA),float,1433786062666,1433786063000,3.810,`,
+				`Power Monitor (mA),float,1433786062666,1433786063000,3.81,`,
 			}, "\n"),
 			matched: true,
 		},
@@ -182,7 +182,7 @@ func TestParse(t *testing.T) {
 				`Power Monitor (mA),float,1433786060400,1433786060600,6.574,`,
 				`Power Monitor (mA),float,1433786060600,1433786060800,53.441,`,
 				`Power Monitor (mA),float,1433786060800,1433786061000,4.486,`,
-				`Power Monitor (mA),float,1433786061000,1433786061200,3.810,`,
+				`Power Monitor (mA),float,1433786061000,1433786061200,3.81,`,
 				`Power Monitor (mA),float,1433786061200,1433786061400,4.686,`,
 				`Power Monitor (mA),float,1433786061400,1433786061600,4.479,`,
 				`Power Monitor (mA),float,1433786061600,1433786061800,3.811,`,
@@ -306,22 +306,22 @@ func TestParse(t *testing.T) {
 			}, "\n"),
 			wantCSV: strings.Join([]string{
 				csv.FileHeader,
-				`Power Monitor (mA),float,1484169264601,1484169264701,451.900,`,
-				`Power Monitor (mA),float,1484169264701,1484169264801,443.200,`,
-				`Power Monitor (mA),float,1484169264801,1484169264901,446.100,`,
-				`Power Monitor (mA),float,1484169264901,1484169265001,449.000,`,
-				`Power Monitor (mA),float,1484169265001,1484169265101,280.500,`,
-				`Power Monitor (mA),float,1484169265101,1484169265201,277.600,`,
-				`Power Monitor (mA),float,1484169265201,1484169265301,202.000,`,
-				`Power Monitor (mA),float,1484169265301,1484169265301,181.700,`,
+				`Power Monitor (mA),float,1484169264601,1484169264701,451.9,`,
+				`Power Monitor (mA),float,1484169264701,1484169264801,443.2,`,
+				`Power Monitor (mA),float,1484169264801,1484169264901,446.1,`,
+				`Power Monitor (mA),float,1484169264901,1484169265001,449,`,
+				`Power Monitor (mA),float,1484169265001,1484169265101,280.5,`,
+				`Power Monitor (mA),float,1484169265101,1484169265201,277.6,`,
+				`Power Monitor (mA),float,1484169265201,1484169265301,202,`,
+				`Power Monitor (mA),float,1484169265301,1484169265301,181.7,`,
 				`Power Monitor (mW),float,1484169264601,1484169264701,1898.432,`,
 				`Power Monitor (mW),float,1484169264701,1484169264801,1860.554,`,
-				`Power Monitor (mW),float,1484169264801,1484169264901,1871.390,`,
+				`Power Monitor (mW),float,1484169264801,1484169264901,1871.39,`,
 				`Power Monitor (mW),float,1484169264901,1484169265001,1880.861,`,
 				`Power Monitor (mW),float,1484169265001,1484169265101,1185.926,`,
 				`Power Monitor (mW),float,1484169265101,1484169265201,1176.996,`,
 				`Power Monitor (mW),float,1484169265201,1484169265301,860.096,`,
-				`Power Monitor (mW),float,1484169265301,1484169265301,773.660,`,
+				`Power Monitor (mW),float,1484169265301,1484169265301,773.66,`,
 			}, "\n"),
 			matched: true,
 		},
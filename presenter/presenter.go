@@ -80,6 +80,8 @@ type HTMLData struct {
 	AppStats               []AppStat
 	Overflow               bool
 	HasBatteryStatsHistory bool
+	// Diagnostics identifies the lines that were skipped because they couldn't be parsed.
+	Diagnostics []*historianutils.ParseError
 }
 
 // CombinedCheckinSummary is the combined structure for the 2 files being compared